@@ -4,6 +4,6 @@ set -ex
 
 go generate pkg/common/rev.go
 
-CGO_ENABLED=0 go build -o build/ra cmd/ra/main.go
-CGO_ENABLED=0 go build -o build/raise cmd/raise/main.go
-CGO_ENABLED=0 go build -o build/raised cmd/raised/main.go
\ No newline at end of file
+CGO_ENABLED=0 go build -o build/ra ./cmd/ra
+CGO_ENABLED=0 go build -o build/raise ./cmd/raise
+CGO_ENABLED=0 go build -o build/raised ./cmd/raised
\ No newline at end of file
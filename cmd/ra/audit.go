@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Vbitz/raise/v2/pkg/client"
+	"github.com/Vbitz/raise/v2/pkg/proto"
+)
+
+// parseAuditTime parses an RFC 3339 time or a duration before now such as 24h.
+func parseAuditTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %s: expected RFC 3339 or a duration", value)
+	}
+
+	return t, nil
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// runAudit queries the audit log of the server and prints the events.
+func runAudit(cl *client.Client, args []string) error {
+	fs := flag.NewFlagSet("audit", flag.ContinueOnError)
+
+	clientName := fs.String("client", "", "Only show events from this client.")
+	worker := fs.String("worker", "", "Only show events for this worker.")
+	since := fs.String("since", "", "Only show events after this time.")
+	until := fs.String("until", "", "Only show events before this time.")
+	limit := fs.Int("limit", 100, "Only show this many of the most recent events. Zero shows as many as the server allows.")
+	asJSON := fs.Bool("json", false, "Print each event as a JSON line.")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	req := proto.AuditEventsReq{
+		Client: *clientName,
+		Worker: *worker,
+		Limit:  *limit,
+	}
+
+	var err error
+
+	req.Since, err = parseAuditTime(*since)
+	if err != nil {
+		return err
+	}
+
+	req.Until, err = parseAuditTime(*until)
+	if err != nil {
+		return err
+	}
+
+	events, err := cl.AuditEvents(req)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, event := range events {
+			if err := enc.Encode(event); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tCLIENT\tWORKER\tKIND\tFILENAME\tOUTCOME\tDURATION")
+
+	for _, event := range events {
+		kind := event.Kind
+		if kind == "" {
+			kind = event.Method
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			formatTime(event.Time), event.Client, orDash(event.Worker), kind, orDash(event.Filename),
+			event.Outcome, time.Duration(event.DurationMS)*time.Millisecond)
+	}
+
+	return tw.Flush()
+}
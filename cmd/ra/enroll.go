@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"github.com/Vbitz/raise/v2/pkg/proto"
+	"github.com/Vbitz/raise/v2/pkg/security"
+)
+
+// certificatePaths returns where the client certificate and key are kept. They default to
+// client.crt and client.key next to the executable.
+func certificatePaths() (string, string, error) {
+	if *clientCertificate != "" && *clientKey != "" {
+		return *clientCertificate, *clientKey, nil
+	}
+
+	exec, err := os.Executable()
+	if err != nil {
+		return "", "", err
+	}
+
+	execDir := path.Dir(exec)
+
+	return path.Join(execDir, "client.crt"), path.Join(execDir, "client.key"), nil
+}
+
+func saveIssued(resp proto.EnrollResp, privBytes []byte) error {
+	certFile, keyFile, err := certificatePaths()
+	if err != nil {
+		return err
+	}
+
+	err = security.SaveCertificatePair(certFile, keyFile, resp.Certificate, privBytes)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("wrote certificate for %s %s to %s and %s", resp.Role, resp.Name, certFile, keyFile)
+
+	return nil
+}
+
+// runEnroll gets a certificate from the CA of the server using a token created with raised token.
+func runEnroll(token string) error {
+	if token == "" {
+		return fmt.Errorf("usage: ra enroll <token>")
+	}
+
+	resp, privBytes, err := security.Enroll(*serverAddress, *serverCertificate, token)
+	if err != nil {
+		return err
+	}
+
+	return saveIssued(resp, privBytes)
+}
+
+// renewCertificate replaces the client certificate with a new one from the CA of the server.
+// Unless force is set this only happens once it is due.
+func renewCertificate(force bool) error {
+	crt, err := security.LoadCertificatePair(*clientCertificate, *clientKey)
+	if err != nil {
+		return err
+	}
+
+	due, notAfter, err := security.RenewalDue(crt)
+	if err != nil {
+		return err
+	}
+
+	if !due && !force {
+		return nil
+	}
+
+	log.Printf("renewing client certificate that expires at %s", notAfter.Format(time.RFC3339))
+
+	resp, privBytes, err := security.Renew(*serverAddress, *serverCertificate, crt)
+	if err != nil {
+		return err
+	}
+
+	return saveIssued(resp, privBytes)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/Vbitz/raise/v2/pkg/client"
+)
+
+// parseForwardSpec splits <localport>:<remotehost>:<remoteport> into the local listen address and the remote address.
+func parseForwardSpec(spec string) (string, string, error) {
+	tokens := strings.SplitN(spec, ":", 2)
+	if len(tokens) != 2 {
+		return "", "", fmt.Errorf("invalid forward %q: want <localport>:<remotehost>:<remoteport>", spec)
+	}
+
+	host, port, err := net.SplitHostPort(tokens[1])
+	if err != nil {
+		return "", "", fmt.Errorf("invalid forward %q: %v", spec, err)
+	}
+
+	return net.JoinHostPort("localhost", tokens[0]), net.JoinHostPort(host, port), nil
+}
+
+// runForward listens on a local port and tunnels every connection to it through a worker until interrupted.
+func runForward(cl *client.Client, name string, spec string) error {
+	if name == "" || spec == "" {
+		return fmt.Errorf("usage: ra forward <worker> <localport>:<remotehost>:<remoteport>")
+	}
+
+	localAddress, remoteAddress, err := parseForwardSpec(spec)
+	if err != nil {
+		return err
+	}
+
+	remote, err := cl.Remote(name)
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", localAddress)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	log.Printf("forwarding %s to %s through %s", listener.Addr(), remoteAddress, name)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		go forwardConn(remote, conn, remoteAddress)
+	}
+}
+
+func forwardConn(remote *client.Remote, conn net.Conn, address string) {
+	defer conn.Close()
+
+	session, err := remote.OpenForward(address)
+	if err != nil {
+		log.Printf("failed to forward connection from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	defer session.Close()
+
+	// Each direction is half-closed when it is done so protocols that stop sending before they read
+	// the response keep working. The session ends once the worker sees both directions are done.
+	sent := make(chan struct{})
+
+	go func() {
+		defer close(sent)
+
+		if _, err := io.Copy(session, conn); err != nil {
+			session.Close()
+			return
+		}
+
+		if err := session.CloseWrite(); err != nil {
+			session.Close()
+		}
+	}()
+
+	io.Copy(conn, session)
+
+	select {
+	case <-session.Done():
+		// The session is over so nothing more will be sent either way.
+		conn.Close()
+	default:
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+	}
+
+	<-sent
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Vbitz/raise/v2/pkg/client"
+	"github.com/Vbitz/raise/v2/pkg/proto"
+)
+
+// firstLine shortens a script to its first line for a listing.
+func firstLine(script string) string {
+	script = strings.TrimSpace(script)
+
+	if i := strings.IndexByte(script, '\n'); i >= 0 {
+		return script[:i] + " ..."
+	}
+
+	return script
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+// copyJobOutput writes all the output of a job on one stream to w.
+func copyJobOutput(ctx context.Context, remote *client.Remote, id string, stream proto.OutputStream, w io.Writer) error {
+	var offset int64
+
+	for {
+		chunk, size, err := remote.JobOutput(ctx, id, stream, offset)
+		if err != nil {
+			return err
+		}
+
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+
+		offset += int64(len(chunk))
+
+		if len(chunk) == 0 || offset >= size {
+			return nil
+		}
+	}
+}
+
+// runJobs lists the jobs on a worker, or prints the status and output of one job.
+func runJobs(cl *client.Client, name string, id string) error {
+	if name == "" {
+		return fmt.Errorf("usage: ra jobs <worker> [job]")
+	}
+
+	remote, err := cl.Remote(name)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	if id == "" {
+		jobs, err := remote.Jobs(ctx)
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tSTATE\tSTARTED\tFINISHED\tEXIT\tSCRIPT")
+
+		for _, job := range jobs {
+			exitCode := "-"
+			if job.ExitCode >= 0 {
+				exitCode = fmt.Sprint(job.ExitCode)
+			}
+
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				job.ID, job.State, formatTime(job.StartTime), formatTime(job.EndTime), exitCode, firstLine(job.Script))
+		}
+
+		return tw.Flush()
+	}
+
+	job, err := remote.JobStatus(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "job %s %s (pid %d, exit code %d)\n", job.ID, job.State, job.Pid, job.ExitCode)
+	fmt.Fprintf(os.Stderr, "started %s, finished %s\n", formatTime(job.StartTime), formatTime(job.EndTime))
+
+	if err := copyJobOutput(ctx, remote, id, proto.StreamStdout, os.Stdout); err != nil {
+		return err
+	}
+
+	return copyJobOutput(ctx, remote, id, proto.StreamStderr, os.Stderr)
+}
@@ -1,15 +1,30 @@
 // ra is the client frontend for Raise.
 // ra is installed and authenticated on clients granting access to any workers.
 // Scripting is provided though a Starlark API. ra takes a single argument as a argument.
+//
+// Other commands:
+//
+//	ra shell <worker>    Open an interactive shell on a worker.
+//	ra forward <worker> <localport>:<remotehost>:<remoteport>
+//	                     Forward a local port to an address reachable from a worker.
+//	ra jobs <worker> [job]
+//	                     List the detached jobs on a worker or show the status and output of one.
+//	ra audit [-client name] [-worker name] [-since time] [-until time] [-limit n] [-json]
+//	                     Show the audit log of the server. Times are RFC 3339 or durations before now.
+//	ra enroll <token>    Get a client certificate from the CA of the server using a token from raised token.
+//	ra renew             Renew the client certificate now. It is renewed automatically once two thirds of its lifetime passed.
 package main
 
 import (
+	"context"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path"
 
 	"github.com/Vbitz/raise/v2/pkg/client"
@@ -23,6 +38,7 @@ var (
 	serverCertificate = flag.String("serverCertificate", "", "The certificate of the server to connect to. The certificate is base64 encoded in DER format.")
 	clientCertificate = flag.String("clientCertificate", "", "The certificate the client uses to authenticate to the server.")
 	clientKey         = flag.String("clientKey", "", "The private key the client uses to authenticate to the server.")
+	quiet             = flag.Bool("quiet", false, "Do not print the output of scripts on workers as it is produced.")
 	version           = flag.Bool("version", false, "Print the current version and exit.")
 )
 
@@ -97,14 +113,13 @@ func main() {
 		log.Fatalf("failed to load configuration: %v", err)
 	}
 
-	filename := flag.Arg(0)
-	if filename == "" {
-		log.Fatalf("no script specified")
-	}
+	if flag.Arg(0) == "enroll" {
+		err = runEnroll(flag.Arg(1))
+		if err != nil {
+			log.Fatalf("error enrolling: %v", err)
+		}
 
-	fileContents, err := os.ReadFile(filename)
-	if err != nil {
-		log.Fatalf("error reading script: %v", err)
+		return
 	}
 
 	if *clientCertificate == "" || *clientKey == "" {
@@ -126,18 +141,79 @@ func main() {
 		return
 	}
 
-	client := client.NewClient(
+	if flag.Arg(0) == "renew" {
+		err = renewCertificate(true)
+		if err != nil {
+			log.Fatalf("error renewing certificate: %v", err)
+		}
+
+		return
+	}
+
+	err = renewCertificate(false)
+	if err != nil {
+		log.Printf("failed to renew certificate: %v", err)
+	}
+
+	cl := client.NewClient(
 		*serverAddress,
 		*serverCertificate,
 		*clientCertificate,
 		*clientKey,
 	)
-	defer client.Close()
+	defer cl.Close()
 
-	engine := star.NewEngine()
+	switch flag.Arg(0) {
+	case "shell":
+		code, err := runShell(cl, flag.Arg(1))
+		if err != nil {
+			log.Fatalf("error running shell: %v", err)
+		}
+
+		cl.Close()
+		os.Exit(code)
+	case "forward":
+		err = runForward(cl, flag.Arg(1), flag.Arg(2))
+		if err != nil {
+			log.Fatalf("error forwarding: %v", err)
+		}
+	case "jobs":
+		err = runJobs(cl, flag.Arg(1), flag.Arg(2))
+		if err != nil {
+			log.Fatalf("error listing jobs: %v", err)
+		}
+	case "audit":
+		err = runAudit(cl, flag.Args()[1:])
+		if err != nil {
+			log.Fatalf("error querying audit log: %v", err)
+		}
+	default:
+		err = runScript(cl, flag.Arg(0))
+		if err != nil {
+			log.Fatalf("error running script: %v", err)
+		}
+	}
+}
 
-	err = engine.RunFile(client, nil, filename, fileContents)
+func runScript(cl *client.Client, filename string) error {
+	if filename == "" {
+		return fmt.Errorf("no script specified")
+	}
+
+	fileContents, err := os.ReadFile(filename)
 	if err != nil {
-		log.Fatalf("error running script: %v", err)
+		return fmt.Errorf("error reading script: %v", err)
+	}
+
+	if !*quiet {
+		cl.SetOutputHandler(client.NewLinePrinter(os.Stderr))
 	}
+
+	engine := star.NewEngine()
+
+	// Ctrl-C cancels the script and everything it is waiting on.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	return engine.RunFile(ctx, cl, nil, filename, fileContents)
 }
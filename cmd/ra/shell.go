@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/Vbitz/raise/v2/pkg/client"
+)
+
+// Signals received by ra that are passed on to the remote shell.
+var forwardedSignals = map[os.Signal]string{
+	os.Interrupt:    "SIGINT",
+	syscall.SIGQUIT: "SIGQUIT",
+	syscall.SIGTERM: "SIGTERM",
+	syscall.SIGHUP:  "SIGHUP",
+}
+
+// runShell opens an interactive shell on a worker and connects it to the local terminal.
+// It returns the exit code of the remote shell.
+func runShell(cl *client.Client, name string) (int, error) {
+	if name == "" {
+		return 0, fmt.Errorf("usage: ra shell <worker>")
+	}
+
+	remote, err := cl.Remote(name)
+	if err != nil {
+		return 0, err
+	}
+
+	stdin := int(os.Stdin.Fd())
+
+	opts := client.ShellOptions{
+		Term: os.Getenv("TERM"),
+	}
+
+	if isTerminal(stdin) {
+		opts.Rows, opts.Cols, err = terminalSize(stdin)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	session, err := remote.OpenShell(opts)
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+
+	if isTerminal(stdin) {
+		// Keys like Ctrl-C are sent to the remote terminal as is.
+		restore, err := makeRaw(stdin)
+		if err != nil {
+			return 0, err
+		}
+		defer restore()
+
+		stopResize := notifyResize(func() {
+			rows, cols, err := terminalSize(stdin)
+			if err != nil {
+				return
+			}
+
+			if err := session.Resize(rows, cols); err != nil {
+				log.Printf("failed to resize remote terminal: %v\r", err)
+			}
+		})
+		defer stopResize()
+	}
+
+	signals := make(chan os.Signal, 1)
+	for sig := range forwardedSignals {
+		signal.Notify(signals, sig)
+	}
+	defer signal.Stop(signals)
+
+	go func() {
+		for sig := range signals {
+			if err := session.Signal(forwardedSignals[sig]); err != nil {
+				log.Printf("failed to forward signal: %v\r", err)
+			}
+		}
+	}()
+
+	go io.Copy(os.Stdout, session)
+	go io.Copy(session, os.Stdin)
+
+	return session.Wait()
+}
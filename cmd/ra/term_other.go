@@ -0,0 +1,26 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Terminal handling is only implemented on Linux. Elsewhere the shell runs without a local raw terminal.
+
+func isTerminal(fd int) bool {
+	return false
+}
+
+func terminalSize(fd int) (rows uint16, cols uint16, err error) {
+	return 0, 0, fmt.Errorf("terminal size is not supported on %s", runtime.GOOS)
+}
+
+func makeRaw(fd int) (func(), error) {
+	return nil, fmt.Errorf("raw terminals are not supported on %s", runtime.GOOS)
+}
+
+func notifyResize(fn func()) func() {
+	return func() {}
+}
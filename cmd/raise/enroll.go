@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"github.com/Vbitz/raise/v2/pkg/security"
+)
+
+// How often the worker checks whether its certificate is due for renewal.
+const renewalCheckInterval = time.Hour
+
+// enroll gets a worker certificate from the CA of the server using a token and writes it where the
+// worker certificate and key are configured, or next to the executable if they are not.
+func enroll(token string) error {
+	resp, privBytes, err := security.Enroll(*serverAddress, *serverCertificate, token)
+	if err != nil {
+		return err
+	}
+
+	if *name == "" {
+		*name = resp.Name
+	} else if *name != resp.Name {
+		return fmt.Errorf("token was issued for worker %s, not %s", resp.Name, *name)
+	}
+
+	if *workerCertificate == "" || *workerKey == "" {
+		exec, err := os.Executable()
+		if err != nil {
+			return err
+		}
+
+		execDir := path.Dir(exec)
+
+		*workerCertificate = path.Join(execDir, "worker.crt")
+		*workerKey = path.Join(execDir, "worker.key")
+	}
+
+	err = security.SaveCertificatePair(*workerCertificate, *workerKey, resp.Certificate, privBytes)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("enrolled as worker %s, wrote %s and %s", resp.Name, *workerCertificate, *workerKey)
+
+	return nil
+}
+
+// renewCertificate replaces the worker certificate with a new one from the CA of the server once it is due.
+// The worker reads the files again the next time it connects.
+func renewCertificate() error {
+	crt, err := security.LoadCertificatePair(*workerCertificate, *workerKey)
+	if err != nil {
+		return err
+	}
+
+	due, notAfter, err := security.RenewalDue(crt)
+	if err != nil || !due {
+		return err
+	}
+
+	log.Printf("renewing worker certificate that expires at %s", notAfter.Format(time.RFC3339))
+
+	resp, privBytes, err := security.Renew(*serverAddress, *serverCertificate, crt)
+	if err != nil {
+		return err
+	}
+
+	return security.SaveCertificatePair(*workerCertificate, *workerKey, resp.Certificate, privBytes)
+}
+
+// renewPeriodically keeps the worker certificate renewed. It runs until the process exits.
+func renewPeriodically() {
+	for range time.Tick(renewalCheckInterval) {
+		if err := renewCertificate(); err != nil {
+			log.Printf("failed to renew certificate: %v", err)
+		}
+	}
+}
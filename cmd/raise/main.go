@@ -2,14 +2,21 @@
 package main
 
 import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"flag"
 	"log"
 	"os"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/Vbitz/raise/v2/pkg/common"
+	"github.com/Vbitz/raise/v2/pkg/heartbeat"
+	"github.com/Vbitz/raise/v2/pkg/security"
+	"github.com/Vbitz/raise/v2/pkg/selector"
 	"github.com/Vbitz/raise/v2/pkg/worker"
 )
 
@@ -17,13 +24,37 @@ var (
 	serverAddress     = flag.String("server", "", "The address of the server to connect to.")
 	serverCertificate = flag.String("cert", "", "The certificate of the server to connect to.")
 	name              = flag.String("name", "", "The name the worker identifies to the server.")
+	workerCertificate = flag.String("workerCertificate", "", "The certificate the worker uses to authenticate to the server.")
+	workerKey         = flag.String("workerKey", "", "The private key the worker uses to authenticate to the server.")
+	labels            = flag.String("labels", "", "Comma separated key=value labels the worker registers with.")
+	heartbeatInterval = flag.Duration("heartbeatInterval", heartbeat.DefaultConfig.Interval, "How often to send heartbeats to the server.")
+	heartbeatTimeout  = flag.Duration("heartbeatTimeout", heartbeat.DefaultConfig.Timeout, "How long the server can go without answering a heartbeat before reconnecting.")
+	disableFacts      = flag.String("disableFacts", "", "Comma separated names of host fact collectors to turn off.")
+	factsDir          = flag.String("factsDir", "", "A directory of executables such as /etc/raise/facts.d whose output is reported as custom facts.")
+	factsTTL          = flag.Duration("factsTTL", 5*time.Minute, "How long the output of custom fact scripts is cached.")
+	enrollToken       = flag.String("enroll", "", "A token from raised token to get a worker certificate from the CA of the server with before connecting.")
+	jobsDir           = flag.String("jobsDir", "", "The directory detached jobs are kept in such as /var/lib/raise/jobs. Defaults to /var/lib/raise/jobs for root and ~/.local/state/raise/jobs for other users.")
 	version           = flag.Bool("version", false, "Print the current version and exit.")
 )
 
 type ConfigFile struct {
-	ServerAddress     string
-	ServerCertificate string
-	WorkerName        string
+	ServerAddress         string
+	ServerCertificate     string
+	WorkerName            string
+	WorkerCertificatePath string
+	WorkerKeyPath         string
+	// Labels such as {"role": "db", "env": "prod"}. Overrides the labels flag when set.
+	Labels map[string]string
+	// Durations in time.ParseDuration format. The flag defaults are used when empty.
+	HeartbeatInterval string
+	HeartbeatTimeout  string
+	// Names of host fact collectors to turn off such as ["filesystems", "network"].
+	DisabledFacts []string
+	// A directory of custom fact scripts and how long their output is cached in time.ParseDuration format.
+	FactsDir string
+	FactsTTL string
+	// The directory detached jobs are kept in.
+	JobsDir string
 }
 
 func loadConfig() error {
@@ -52,6 +83,70 @@ func loadConfig() error {
 	*serverAddress = config.ServerAddress
 	*serverCertificate = config.ServerCertificate
 	*name = config.WorkerName
+	*workerCertificate = config.WorkerCertificatePath
+	*workerKey = config.WorkerKeyPath
+
+	if len(config.Labels) > 0 {
+		var pairs []string
+		for k, v := range config.Labels {
+			pairs = append(pairs, k+"="+v)
+		}
+		*labels = strings.Join(pairs, ",")
+	}
+
+	if config.FactsDir != "" {
+		*factsDir = config.FactsDir
+	}
+
+	if config.FactsTTL != "" {
+		*factsTTL, err = time.ParseDuration(config.FactsTTL)
+		if err != nil {
+			return err
+		}
+	}
+
+	if config.JobsDir != "" {
+		*jobsDir = config.JobsDir
+	}
+
+	if len(config.DisabledFacts) > 0 {
+		*disableFacts = strings.Join(config.DisabledFacts, ",")
+	}
+
+	if config.HeartbeatInterval != "" {
+		*heartbeatInterval, err = time.ParseDuration(config.HeartbeatInterval)
+		if err != nil {
+			return err
+		}
+	}
+
+	if config.HeartbeatTimeout != "" {
+		*heartbeatTimeout, err = time.ParseDuration(config.HeartbeatTimeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeCertAndKey(certBytes []byte, privBytes []byte) error {
+	exec, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	execDir := path.Dir(exec)
+
+	err = os.WriteFile(path.Join(execDir, "worker.crt"), certBytes, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(path.Join(execDir, "worker.key"), privBytes, 0600)
+	if err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -68,7 +163,74 @@ func main() {
 		log.Fatalf("failed to load configuration: %v", err)
 	}
 
-	worker := worker.NewWorker(*serverAddress, *serverCertificate, *name)
+	if *enrollToken != "" {
+		err = enroll(*enrollToken)
+		if err != nil {
+			log.Fatalf("failed to enroll: %v", err)
+		}
+	}
+
+	if *workerCertificate == "" || *workerKey == "" {
+		// Generate a new certificate and key then exit.
+		log.Printf("No certificate or key specified. Generating a keypair now.")
+
+		cert, certBytes, err := security.GenerateCertificatePair()
+		if err != nil {
+			log.Fatalf("failed to generate certificate: %v", err)
+		}
+
+		privBytes := x509.MarshalPKCS1PrivateKey(cert.PrivateKey.(*rsa.PrivateKey))
+
+		err = writeCertAndKey(certBytes, privBytes)
+		if err != nil {
+			log.Fatalf("failed to write certificate and key: %v", err)
+		}
+
+		// This is the line to add to the worker list on the server.
+		log.Printf("%s %s", base64.StdEncoding.EncodeToString(certBytes), *name)
+
+		return
+	}
+
+	worker := worker.NewWorker(*serverAddress, *serverCertificate, *name, *workerCertificate, *workerKey)
+
+	workerLabels, err := selector.ParseLabels(*labels)
+	if err != nil {
+		log.Fatalf("failed to parse labels: %v", err)
+	}
+
+	worker.SetLabels(workerLabels)
+
+	worker.SetHeartbeatConfig(heartbeat.Config{
+		Interval: *heartbeatInterval,
+		Timeout:  *heartbeatTimeout,
+	})
+
+	if *factsDir != "" {
+		worker.SetFactsDir(*factsDir, *factsTTL)
+	}
+
+	if *jobsDir != "" {
+		err = worker.SetJobsDir(*jobsDir)
+		if err != nil {
+			log.Fatalf("failed to set jobs directory: %v", err)
+		}
+	}
+
+	if *disableFacts != "" {
+		err = worker.SetDisabledFacts(strings.Split(*disableFacts, ","))
+		if err != nil {
+			log.Fatalf("failed to disable facts: %v", err)
+		}
+	}
+
+	// Certificates issued by the CA of the server are renewed before they expire.
+	err = renewCertificate()
+	if err != nil {
+		log.Printf("failed to renew certificate: %v", err)
+	}
+
+	go renewPeriodically()
 
 	for {
 		log.Printf("attempting to connect to: %s", *serverAddress)
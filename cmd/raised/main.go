@@ -1,4 +1,11 @@
 // raised is the Raise control plane. It accepts commands from clients and forwards the commands to workers.
+//
+// Other commands:
+//
+//	raised token -role <client|worker> -name <name> [-ttl 24h]
+//	                     Create a one-time token a client or worker enrolls with the built-in CA using.
+//	raised revoke -role <client|worker> -name <name> | -serial <serial>
+//	                     Revoke every certificate the built-in CA issued to a client or worker, or one by serial number.
 package main
 
 import (
@@ -6,10 +13,15 @@ import (
 	"flag"
 	"log"
 	"os"
+	"os/signal"
 	"path"
-	"strings"
+	"syscall"
+	"time"
 
+	"github.com/Vbitz/raise/v2/pkg/audit"
+	"github.com/Vbitz/raise/v2/pkg/ca"
 	"github.com/Vbitz/raise/v2/pkg/common"
+	"github.com/Vbitz/raise/v2/pkg/heartbeat"
 	"github.com/Vbitz/raise/v2/pkg/server"
 )
 
@@ -18,7 +30,25 @@ var (
 	certFile   = flag.String("cert", "", "The certificate file to use for HTTPS.")
 	keyFile    = flag.String("key", "", "The key file to use for HTTPS.")
 	clientList = flag.String("clientList", "", "A file containing a list of client keys to trust.")
-	version    = flag.Bool("version", false, "Print the current version and exit.")
+	workerList = flag.String("workerList", "", "A file containing a list of worker keys to trust.")
+	queueDir   = flag.String("queueDir", "", "A directory to keep messages queued for offline workers in. They are only kept in memory if empty.")
+
+	forwardPolicy map[string][]server.ForwardRule
+	policy        *server.Policy
+	version       = flag.Bool("version", false, "Print the current version and exit.")
+
+	heartbeatInterval = flag.Duration("heartbeatInterval", heartbeat.DefaultConfig.Interval, "How often to send heartbeats to workers.")
+	heartbeatTimeout  = flag.Duration("heartbeatTimeout", heartbeat.DefaultConfig.Timeout, "How long a worker can go without answering a heartbeat before it is dropped.")
+
+	clientListInterval = flag.Duration("clientListInterval", 10*time.Second, "How often to check the client list and revoked certificates for changes. Zero only checks on SIGHUP.")
+
+	auditLog      = flag.String("auditLog", "", "A file to write a JSON line for every call clients make to. No audit log is kept if empty.")
+	auditMaxSize  = flag.Int64("auditMaxSize", 100<<20, "The size in bytes the audit log is rotated at. Zero never rotates it.")
+	auditMaxFiles = flag.Int("auditMaxFiles", 10, "How many rotated audit logs to keep.")
+	auditContent  = flag.Bool("auditContent", false, "Record the content of scripts and files in the audit log instead of only their hash.")
+
+	caDir        = flag.String("caDir", "", "A directory for the built-in certificate authority. Clients and workers with a certificate it issued are trusted. It is created if missing.")
+	certValidity = flag.Duration("certValidity", ca.DefaultValidity, "How long certificates issued by the built-in certificate authority are valid for.")
 )
 
 type ConfigFile struct {
@@ -26,6 +56,24 @@ type ConfigFile struct {
 	CertificateFile string
 	KeyFile         string
 	ClientListFile  string
+	WorkerListFile  string
+	// Durations in time.ParseDuration format. The flag defaults are used when empty.
+	HeartbeatInterval string
+	HeartbeatTimeout  string
+	// Where each client, by name, may forward TCP connections to. Clients not listed can not forward.
+	ForwardPolicy map[string][]server.ForwardRule
+	// Roles limiting what each client may do. Every client may do everything if not set.
+	Policy *server.Policy
+	// Where messages queued for offline workers are kept.
+	QueueDirectory string
+	// Where the audit log is written. The flag defaults are used for the others when zero.
+	AuditLogFile  string
+	AuditMaxSize  int64
+	AuditMaxFiles int
+	AuditContent  bool
+	// Where the built-in certificate authority is kept and how long its certificates are valid for in time.ParseDuration format.
+	CADirectory         string
+	CertificateValidity string
 }
 
 func loadConfig() error {
@@ -55,6 +103,54 @@ func loadConfig() error {
 	*certFile = config.CertificateFile
 	*keyFile = config.KeyFile
 	*clientList = config.ClientListFile
+	*workerList = config.WorkerListFile
+	forwardPolicy = config.ForwardPolicy
+	policy = config.Policy
+
+	if config.QueueDirectory != "" {
+		*queueDir = config.QueueDirectory
+	}
+
+	if config.CADirectory != "" {
+		*caDir = config.CADirectory
+	}
+
+	if config.CertificateValidity != "" {
+		*certValidity, err = time.ParseDuration(config.CertificateValidity)
+		if err != nil {
+			return err
+		}
+	}
+
+	if config.AuditLogFile != "" {
+		*auditLog = config.AuditLogFile
+	}
+
+	if config.AuditMaxSize != 0 {
+		*auditMaxSize = config.AuditMaxSize
+	}
+
+	if config.AuditMaxFiles != 0 {
+		*auditMaxFiles = config.AuditMaxFiles
+	}
+
+	if config.AuditContent {
+		*auditContent = true
+	}
+
+	if config.HeartbeatInterval != "" {
+		*heartbeatInterval, err = time.ParseDuration(config.HeartbeatInterval)
+		if err != nil {
+			return err
+		}
+	}
+
+	if config.HeartbeatTimeout != "" {
+		*heartbeatTimeout, err = time.ParseDuration(config.HeartbeatTimeout)
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -71,28 +167,104 @@ func main() {
 		log.Fatalf("failed to load configuration: %v", err)
 	}
 
+	if flag.Arg(0) == "token" {
+		err = runToken(flag.Args()[1:])
+		if err != nil {
+			log.Fatalf("failed to create token: %v", err)
+		}
+
+		return
+	} else if flag.Arg(0) == "revoke" {
+		err = runRevoke(flag.Args()[1:])
+		if err != nil {
+			log.Fatalf("failed to revoke: %v", err)
+		}
+
+		return
+	}
+
 	svr := server.NewServer(*addr, *certFile, *keyFile)
 
-	clientListContent, err := os.ReadFile(*clientList)
+	svr.SetHeartbeatConfig(heartbeat.Config{
+		Interval: *heartbeatInterval,
+		Timeout:  *heartbeatTimeout,
+	})
+
+	err = svr.SetForwardPolicy(forwardPolicy)
 	if err != nil {
-		log.Fatalf("failed to read client list: %v", err)
+		log.Fatalf("failed to set forward policy: %v", err)
 	}
 
-	for _, line := range strings.Split(string(clientListContent), "\n") {
-		tokens := strings.Split(line, " ")
+	err = svr.SetPolicy(policy)
+	if err != nil {
+		log.Fatalf("failed to set policy: %v", err)
+	}
 
-		if len(tokens) != 2 {
-			continue
+	if *queueDir != "" {
+		err = svr.SetQueueDir(*queueDir)
+		if err != nil {
+			log.Fatalf("failed to load message queue: %v", err)
 		}
+	}
 
-		client := server.Client{
-			Name:              tokens[1],
-			CertificateString: tokens[0],
+	if *auditLog != "" {
+		logger, err := audit.NewLogger(*auditLog, *auditMaxSize, *auditMaxFiles)
+		if err != nil {
+			log.Fatalf("failed to open audit log: %v", err)
 		}
+		defer logger.Close()
+
+		svr.SetAuditLog(logger, *auditContent)
+	}
+
+	if *caDir != "" {
+		authority, err := ca.Open(*caDir, *certValidity)
+		if err != nil {
+			log.Fatalf("failed to open certificate authority: %v", err)
+		}
+
+		svr.SetAuthority(authority)
+	}
+
+	// Clients and workers with a certificate from the CA do not need to be listed.
+	if *clientList != "" || *caDir == "" {
+		err = svr.LoadClientList(*clientList)
+		if err != nil {
+			log.Fatalf("failed to load client list: %v", err)
+		}
+	}
+
+	// The client list is reloaded on SIGHUP and whenever the file changes without dropping workers.
+	// The audit log is reopened so it can be rotated by another program, and clients and workers
+	// whose certificate was revoked are disconnected.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			log.Printf("got SIGHUP, reloading client list")
+
+			if err := svr.ReloadClientList(); err != nil {
+				log.Printf("failed to reload client list: %v", err)
+			}
+
+			if err := svr.ReopenAuditLog(); err != nil {
+				log.Printf("failed to reopen audit log: %v", err)
+			}
+
+			svr.CloseRevoked()
+		}
+	}()
+
+	if *clientListInterval > 0 {
+		go svr.WatchClientList(*clientListInterval)
+		go svr.WatchRevocations(*clientListInterval)
+	}
 
-		err := svr.AddClient(client)
+	if *workerList != "" || *caDir == "" {
+		err = svr.LoadWorkerList(*workerList)
 		if err != nil {
-			log.Fatalf("failed to add client: %v", err)
+			log.Fatalf("failed to load worker list: %v", err)
 		}
 	}
 
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/Vbitz/raise/v2/pkg/ca"
+)
+
+// runToken creates an enrollment token in the directory of the certificate authority.
+// The server does not need to be restarted to accept it.
+func runToken(args []string) error {
+	fs := flag.NewFlagSet("token", flag.ContinueOnError)
+
+	role := fs.String("role", ca.RoleClient, "What the token enrolls: client or worker.")
+	name := fs.String("name", "", "The name the certificate is issued for.")
+	ttl := fs.Duration("ttl", 24*time.Hour, "How long the token can be used for.")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *caDir == "" {
+		return fmt.Errorf("no certificate authority directory set")
+	}
+
+	if *name == "" {
+		return fmt.Errorf("usage: raised token -role <client|worker> -name <name> [-ttl 24h]")
+	}
+
+	authority, err := ca.Open(*caDir, *certValidity)
+	if err != nil {
+		return err
+	}
+
+	token, err := authority.CreateToken(*role, *name, *ttl)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(token)
+
+	return nil
+}
+
+// runRevoke adds certificates to the revocation list of the certificate authority. A running server
+// stops trusting them straight away and disconnects them within the client list interval.
+func runRevoke(args []string) error {
+	fs := flag.NewFlagSet("revoke", flag.ContinueOnError)
+
+	role := fs.String("role", ca.RoleClient, "Whose certificates to revoke: client or worker.")
+	name := fs.String("name", "", "Revoke every certificate issued for this name.")
+	serial := fs.String("serial", "", "Revoke the certificate with this hex serial number.")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *caDir == "" {
+		return fmt.Errorf("no certificate authority directory set")
+	}
+
+	if (*name == "") == (*serial == "") {
+		return fmt.Errorf("usage: raised revoke -role <client|worker> -name <name> | -serial <serial>")
+	}
+
+	authority, err := ca.Open(*caDir, *certValidity)
+	if err != nil {
+		return err
+	}
+
+	serials := []string{*serial}
+	if *name != "" {
+		serials, err = authority.IssuedSerials(*role, *name)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := authority.Revoke(serials); err != nil {
+		return err
+	}
+
+	for _, serial := range serials {
+		fmt.Println(serial)
+	}
+
+	return nil
+}
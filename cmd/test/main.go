@@ -1,14 +1,22 @@
 package main
 
 import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
 	"encoding/base64"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"time"
 
 	"github.com/Vbitz/raise/v2/pkg/client"
 	"github.com/Vbitz/raise/v2/pkg/common"
+	"github.com/Vbitz/raise/v2/pkg/security"
 	"github.com/Vbitz/raise/v2/pkg/server"
 	"github.com/Vbitz/raise/v2/pkg/star"
 	"github.com/Vbitz/raise/v2/pkg/worker"
@@ -18,11 +26,47 @@ var (
 	serverAddr     = flag.String("addr", ":5634", "The address the server listens on.")
 	serverCertFile = flag.String("serverCert", "testData/server.crt", "The certificate file to use for HTTPS.")
 	serverKeyFile  = flag.String("serverKey", "testData/server.key", "The key file to use for HTTPS.")
-	clientCertFile = flag.String("clientCert", "build/client.crt", "The certificate the client uses.")
-	clientKeyFile  = flag.String("clientKey", "build/client.key", "The certificate the client uses.")
+	clientCertFile = flag.String("clientCert", "build/client.crt", "The certificate the client uses. It is generated along with the key if neither exists.")
+	clientKeyFile  = flag.String("clientKey", "build/client.key", "The key the client uses.")
+	workerCertFile = flag.String("workerCert", "build/worker.crt", "The certificate the worker uses. It is generated along with the key if neither exists.")
+	workerKeyFile  = flag.String("workerKey", "build/worker.key", "The key the worker uses.")
 	version        = flag.Bool("version", false, "Print the current version and exit.")
 )
 
+// readCertificate reads a certificate for the test client or worker. A new certificate and key
+// are generated if neither file exists so the tests run from a fresh checkout.
+func readCertificate(certFile string, keyFile string) ([]byte, error) {
+	content, err := os.ReadFile(certFile)
+	if err == nil {
+		return content, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	if _, err := os.Stat(keyFile); err == nil {
+		return nil, fmt.Errorf("%s exists without %s", keyFile, certFile)
+	}
+
+	cert, certBytes, err := security.GenerateCertificatePair()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate certificate: %v", err)
+	}
+
+	privBytes := x509.MarshalPKCS1PrivateKey(cert.PrivateKey.(*rsa.PrivateKey))
+
+	if err := os.MkdirAll(filepath.Dir(certFile), 0755); err != nil {
+		return nil, err
+	}
+
+	if err := security.SaveCertificatePair(certFile, keyFile, certBytes, privBytes); err != nil {
+		return nil, fmt.Errorf("failed to write certificate and key: %v", err)
+	}
+
+	log.Printf("generated %s and %s", certFile, keyFile)
+
+	return certBytes, nil
+}
+
 func main() {
 	flag.Parse()
 
@@ -40,13 +84,19 @@ func main() {
 		log.Fatalf("error reading script: %v", err)
 	}
 
+	// Both certificates are read before anything starts since they may have to be generated first.
+	clientCertContent, err := readCertificate(*clientCertFile, *clientKeyFile)
+	if err != nil {
+		log.Fatalf("failed to read client certificate: %v", err)
+	}
+
+	workerCertContent, err := readCertificate(*workerCertFile, *workerKeyFile)
+	if err != nil {
+		log.Fatalf("failed to read worker certificate: %v", err)
+	}
+
 	// Start the server.
 	go func() {
-		clientCertContent, err := os.ReadFile(*clientCertFile)
-		if err != nil {
-			log.Fatalf("failed to read client certificate: %v", err)
-		}
-
 		svr := server.NewServer(*serverAddr, *serverCertFile, *serverKeyFile)
 
 		client := server.Client{
@@ -54,11 +104,19 @@ func main() {
 			CertificateString: base64.StdEncoding.EncodeToString(clientCertContent),
 		}
 
-		err = svr.AddClient(client)
+		err := svr.AddClient(client)
 		if err != nil {
 			log.Fatalf("failed to add client: %v", err)
 		}
 
+		err = svr.AddWorker(server.WorkerIdentity{
+			Name:              "testing",
+			CertificateString: base64.StdEncoding.EncodeToString(workerCertContent),
+		})
+		if err != nil {
+			log.Fatalf("failed to add worker: %v", err)
+		}
+
 		err = svr.Listen()
 		if err != nil {
 			log.Fatal(err)
@@ -76,7 +134,9 @@ func main() {
 
 	// Start the worker.
 	go func() {
-		worker := worker.NewWorker("wss://localhost"+*serverAddr, serverCert, "testing")
+		worker := worker.NewWorker("wss://localhost"+*serverAddr, serverCert, "testing", *workerCertFile, *workerKeyFile)
+
+		worker.SetLabels(map[string]string{"env": "test", "role": "testing"})
 
 		err := worker.Connect()
 		if err != nil {
@@ -87,22 +147,28 @@ func main() {
 	time.Sleep(100 * time.Millisecond)
 
 	// Start the client and have it execute the passed script.
-	client := client.NewClient(
+	cl := client.NewClient(
 		"wss://localhost"+*serverAddr,
 		serverCert,
 		*clientCertFile,
 		*clientKeyFile,
 	)
-	defer client.Close()
+	defer cl.Close()
+
+	cl.SetOutputHandler(client.NewLinePrinter(os.Stderr))
 
 	engine := star.NewEngine()
 
-	remote, err := client.Remote("testing")
+	remote, err := cl.Remote("testing")
 	if err != nil {
 		log.Fatalf("failed to get client remote: %v", err)
 	}
 
-	err = engine.RunFile(client, remote, filename, fileContents)
+	// Ctrl-C cancels the script and everything it is waiting on.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	err = engine.RunFile(ctx, cl, remote, filename, fileContents)
 	if err != nil {
 		log.Fatalf("error running script: %v", err)
 	}
@@ -9,6 +9,6 @@ EXESUFFIX=$2
 
 go generate pkg/common/rev.go
 
-CGO_ENABLED=0 go build -o build/$NAMEPREFIX/ra$EXESUFFIX cmd/ra/main.go
-CGO_ENABLED=0 go build -o build/$NAMEPREFIX/raise$EXESUFFIX cmd/raise/main.go
-CGO_ENABLED=0 go build -o build/$NAMEPREFIX/raised$EXESUFFIX cmd/raised/main.go
\ No newline at end of file
+CGO_ENABLED=0 go build -o build/$NAMEPREFIX/ra$EXESUFFIX ./cmd/ra
+CGO_ENABLED=0 go build -o build/$NAMEPREFIX/raise$EXESUFFIX ./cmd/raise
+CGO_ENABLED=0 go build -o build/$NAMEPREFIX/raised$EXESUFFIX ./cmd/raised
\ No newline at end of file
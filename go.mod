@@ -6,6 +6,7 @@ require (
 	github.com/cenkalti/rpc2 v0.0.0-20210604223624-c1acbc6ec984
 	github.com/gobwas/ws v1.1.0
 	go.starlark.net v0.0.0-20230302034142-4b1e35fe2254
+	golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8
 )
 
 require (
@@ -13,5 +14,4 @@ require (
 	github.com/cenkalti/hub v1.0.1 // indirect
 	github.com/gobwas/httphead v0.1.0 // indirect
 	github.com/gobwas/pool v0.2.1 // indirect
-	golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8 // indirect
 )
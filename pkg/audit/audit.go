@@ -0,0 +1,240 @@
+// Package audit writes and reads the log of calls clients make through the server.
+// The log is a file of JSON lines that is only ever appended to. It is rotated by size,
+// keeping older files with a numbered suffix, or by an external tool followed by Reopen.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/Vbitz/raise/v2/pkg/proto"
+)
+
+// MaxQueryLimit is the most events a query returns. Queries without a limit or with a larger one get this many.
+var MaxQueryLimit = 10000
+
+type Logger struct {
+	filename string
+	// Rotate once the file is larger than maxSize. Zero never rotates.
+	maxSize int64
+	// How many rotated files to keep.
+	maxFiles int
+
+	mtx  sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// rotatedName returns the name of the nth most recent rotated file.
+func rotatedName(filename string, n int) string {
+	return fmt.Sprintf("%s.%d", filename, n)
+}
+
+func (l *Logger) openLocked() error {
+	f, err := os.OpenFile(l.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	l.f = f
+	l.size = fi.Size()
+
+	return nil
+}
+
+func (l *Logger) rotateLocked() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+
+	os.Remove(rotatedName(l.filename, l.maxFiles))
+
+	for n := l.maxFiles - 1; n >= 1; n-- {
+		err := os.Rename(rotatedName(l.filename, n), rotatedName(l.filename, n+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	if l.maxFiles > 0 {
+		if err := os.Rename(l.filename, rotatedName(l.filename, 1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(l.filename); err != nil {
+		return err
+	}
+
+	return l.openLocked()
+}
+
+// Log appends an event to the log.
+func (l *Logger) Log(event proto.AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotateLocked(); err != nil {
+			return fmt.Errorf("failed to rotate audit log: %v", err)
+		}
+	}
+
+	n, err := l.f.Write(line)
+	l.size += int64(n)
+
+	return err
+}
+
+// Reopen closes the log and opens it again. Call it after the file was moved away to rotate it.
+func (l *Logger) Reopen() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+
+	return l.openLocked()
+}
+
+func (l *Logger) Close() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	return l.f.Close()
+}
+
+// matches reports whether an event is selected by a query.
+func matches(event proto.AuditEvent, req proto.AuditEventsReq) bool {
+	if req.Client != "" && event.Client != req.Client {
+		return false
+	}
+	if req.Worker != "" && event.Worker != req.Worker {
+		return false
+	}
+	if !req.Since.IsZero() && event.Time.Before(req.Since) {
+		return false
+	}
+	if !req.Until.IsZero() && event.Time.After(req.Until) {
+		return false
+	}
+	return true
+}
+
+// queryFile appends the events in f matching req to events, keeping only the most recent limit of them.
+func queryFile(f *os.File, req proto.AuditEventsReq, limit int, events []proto.AuditEvent) ([]proto.AuditEvent, error) {
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+
+	for scanner.Scan() {
+		var event proto.AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			// A line cut short by a crash is skipped rather than hiding everything after it.
+			continue
+		}
+
+		if matches(event, req) {
+			events = append(events, event)
+			if len(events) > limit {
+				events = events[1:]
+			}
+		}
+	}
+
+	return events, scanner.Err()
+}
+
+// openFiles opens the rotated files, oldest first, followed by the log itself.
+// Files that do not exist are left out.
+func (l *Logger) openFiles() ([]*os.File, error) {
+	var names []string
+	for n := l.maxFiles; n >= 1; n-- {
+		names = append(names, rotatedName(l.filename, n))
+	}
+	names = append(names, l.filename)
+
+	var files []*os.File
+
+	for _, name := range names {
+		f, err := os.Open(name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+
+		files = append(files, f)
+	}
+
+	return files, nil
+}
+
+// Query reads the most recent events matching req from the log and the rotated files it kept.
+// At most MaxQueryLimit events are returned.
+func (l *Logger) Query(req proto.AuditEventsReq) ([]proto.AuditEvent, error) {
+	limit := req.Limit
+	if limit <= 0 || limit > MaxQueryLimit {
+		limit = MaxQueryLimit
+	}
+
+	// Open the files under the lock so a rotation does not move them in between, but read them
+	// without it so logging is not held up by the query.
+	l.mtx.Lock()
+	files, err := l.openFiles()
+	l.mtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	var events []proto.AuditEvent
+
+	for _, f := range files {
+		events, err = queryFile(f, req, limit, events)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return events, nil
+}
+
+// NewLogger opens an audit log for appending. Once the file grows past maxSize it is renamed with
+// a .1 suffix, shifting older files up, and only maxFiles of those are kept. A zero maxSize leaves
+// rotation to an external tool.
+func NewLogger(filename string, maxSize int64, maxFiles int) (*Logger, error) {
+	l := &Logger{
+		filename: filename,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+
+	if err := l.openLocked(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
@@ -0,0 +1,529 @@
+// Package ca is the certificate authority built into the server. It signs client and worker
+// certificates from certificate requests presented with a one-time enrollment token, renews
+// certificates it issued while they are still valid, and verifies the certificates peers present.
+//
+// Everything is kept in a directory:
+//
+//	ca.crt, ca.key     The PEM encoded certificate and key of the authority.
+//	tokens/            A JSON file per unused token, named by the SHA-256 of the token.
+//	issued/            Every certificate issued as <role>/<name>/<serial>.crt.
+//	revoked            The hex serial numbers of revoked certificates, one per line.
+package ca
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The role of a certificate is kept in its organizational unit. Its name is the common name.
+const (
+	RoleClient = "client"
+	RoleWorker = "worker"
+)
+
+// DefaultValidity is how long issued certificates are valid for unless set otherwise.
+const DefaultValidity = 90 * 24 * time.Hour
+
+// caValidity is how long the certificate of a new authority is valid for.
+const caValidity = 10 * 365 * 24 * time.Hour
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Token is what an enrollment token grants. The token itself is only known to whoever created it.
+type Token struct {
+	Role      string
+	Name      string
+	ExpiresAt time.Time
+}
+
+type Authority struct {
+	dir      string
+	validity time.Duration
+	cert     *x509.Certificate
+	key      *rsa.PrivateKey
+	roots    *x509.CertPool
+
+	// The revocation list as last read and the state of the file it was read from.
+	revokedMtx  sync.Mutex
+	revoked     map[string]bool
+	revokedMod  time.Time
+	revokedSize int64
+}
+
+func checkIdentity(role string, name string) error {
+	if role != RoleClient && role != RoleWorker {
+		return fmt.Errorf("unknown role %s: want %s or %s", role, RoleClient, RoleWorker)
+	}
+
+	if !validName.MatchString(name) {
+		return fmt.Errorf("invalid name %q", name)
+	}
+
+	return nil
+}
+
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func writePEM(filename string, blockType string, der []byte, perm os.FileMode) error {
+	return os.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), perm)
+}
+
+func readPEM(filename string, blockType string) ([]byte, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("%s does not contain a %s", filename, blockType)
+	}
+
+	return block.Bytes, nil
+}
+
+// create generates the key and self-signed certificate of a new authority.
+func (a *Authority) create() error {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+
+	serial, err := serialNumber()
+	if err != nil {
+		return err
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"Raise"},
+			CommonName:   "Raise CA",
+		},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().Add(caValidity),
+
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	if err := writePEM(filepath.Join(a.dir, "ca.key"), "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key), 0600); err != nil {
+		return err
+	}
+
+	return writePEM(filepath.Join(a.dir, "ca.crt"), "CERTIFICATE", der, 0644)
+}
+
+func (a *Authority) load() error {
+	certDER, err := readPEM(filepath.Join(a.dir, "ca.crt"), "CERTIFICATE")
+	if err != nil {
+		return err
+	}
+
+	keyDER, err := readPEM(filepath.Join(a.dir, "ca.key"), "RSA PRIVATE KEY")
+	if err != nil {
+		return err
+	}
+
+	a.cert, err = x509.ParseCertificate(certDER)
+	if err != nil {
+		return fmt.Errorf("failed to parse CA certificate: %v", err)
+	}
+
+	a.key, err = x509.ParsePKCS1PrivateKey(keyDER)
+	if err != nil {
+		return fmt.Errorf("failed to parse CA key: %v", err)
+	}
+
+	a.roots = x509.NewCertPool()
+	a.roots.AddCert(a.cert)
+
+	return nil
+}
+
+// Certificate returns the certificate of the authority.
+func (a *Authority) Certificate() *x509.Certificate {
+	return a.cert
+}
+
+func (a *Authority) tokenFile(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return filepath.Join(a.dir, "tokens", hex.EncodeToString(sum[:])+".json")
+}
+
+// CreateToken returns a token that can be used once before ttl passes to enroll a certificate with the role and name.
+// Tokens are files in the directory of the authority so they can be created while the server is running.
+func (a *Authority) CreateToken(role string, name string, ttl time.Duration) (string, error) {
+	if err := checkIdentity(role, name); err != nil {
+		return "", err
+	}
+
+	var buf [32]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(buf[:])
+
+	content, err := json.Marshal(Token{
+		Role:      role,
+		Name:      name,
+		ExpiresAt: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.WriteFile(a.tokenFile(token), content, 0600); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// useToken looks up a token and removes it so it can not be used again.
+func (a *Authority) useToken(token string) (Token, error) {
+	filename := a.tokenFile(token)
+
+	content, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return Token{}, fmt.Errorf("invalid or used enrollment token")
+	} else if err != nil {
+		return Token{}, err
+	}
+
+	// Whoever removes the file first gets to use the token.
+	if err := os.Remove(filename); errors.Is(err, os.ErrNotExist) {
+		return Token{}, fmt.Errorf("invalid or used enrollment token")
+	} else if err != nil {
+		return Token{}, err
+	}
+
+	var ret Token
+	if err := json.Unmarshal(content, &ret); err != nil {
+		return Token{}, fmt.Errorf("failed to parse token: %v", err)
+	}
+
+	if time.Now().After(ret.ExpiresAt) {
+		return Token{}, fmt.Errorf("enrollment token expired at %s", ret.ExpiresAt.Format(time.RFC3339))
+	}
+
+	return ret, nil
+}
+
+func parseRequest(csrDER []byte) (*x509.CertificateRequest, error) {
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate request: %v", err)
+	}
+
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid certificate request signature: %v", err)
+	}
+
+	return csr, nil
+}
+
+// sign issues a certificate for the key in csr. The subject of the request is ignored.
+func (a *Authority) sign(csr *x509.CertificateRequest, role string, name string) ([]byte, error) {
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	notAfter := time.Now().Add(a.validity)
+	if notAfter.After(a.cert.NotAfter) {
+		notAfter = a.cert.NotAfter
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization:       []string{"Raise"},
+			OrganizationalUnit: []string{role},
+			CommonName:         name,
+		},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  notAfter,
+
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, a.cert, csr.PublicKey, a.key)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := a.issuedDir(role, name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	if err := writePEM(filepath.Join(dir, SerialString(serial)+".crt"), "CERTIFICATE", der, 0644); err != nil {
+		return nil, err
+	}
+
+	return der, nil
+}
+
+func (a *Authority) issuedDir(role string, name string) string {
+	return filepath.Join(a.dir, "issued", role, name)
+}
+
+// SerialString formats a serial number the way it is written in the revocation list.
+func SerialString(serial *big.Int) string {
+	return serial.Text(16)
+}
+
+func (a *Authority) revokedFile() string {
+	return filepath.Join(a.dir, "revoked")
+}
+
+// revokedSerials returns the revocation list. The file is only read again once it changed
+// so serials revoked by another process are picked up.
+func (a *Authority) revokedSerials() (map[string]bool, error) {
+	a.revokedMtx.Lock()
+	defer a.revokedMtx.Unlock()
+
+	fi, err := os.Stat(a.revokedFile())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if a.revoked != nil && fi.ModTime().Equal(a.revokedMod) && fi.Size() == a.revokedSize {
+		return a.revoked, nil
+	}
+
+	content, err := os.ReadFile(a.revokedFile())
+	if err != nil {
+		return nil, err
+	}
+
+	revoked := make(map[string]bool)
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		revoked[strings.ToLower(line)] = true
+	}
+
+	a.revoked, a.revokedMod, a.revokedSize = revoked, fi.ModTime(), fi.Size()
+
+	return revoked, nil
+}
+
+// Revoked reports whether a certificate is on the revocation list. Errors reading the list count as revoked.
+func (a *Authority) Revoked(cert *x509.Certificate) bool {
+	revoked, err := a.revokedSerials()
+	if err != nil {
+		return true
+	}
+
+	return revoked[SerialString(cert.SerialNumber)]
+}
+
+// Revoke adds serial numbers to the revocation list. Servers using the same directory stop trusting them
+// the next time they check.
+func (a *Authority) Revoke(serials []string) error {
+	f, err := os.OpenFile(a.revokedFile(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for _, serial := range serials {
+		serial = strings.ToLower(strings.TrimSpace(serial))
+
+		if _, ok := new(big.Int).SetString(serial, 16); !ok {
+			return fmt.Errorf("invalid serial number %q", serial)
+		}
+
+		if _, err := fmt.Fprintln(f, serial); err != nil {
+			return err
+		}
+	}
+
+	return f.Close()
+}
+
+// IssuedSerials returns the serial numbers of every certificate issued for the role and name.
+func (a *Authority) IssuedSerials(role string, name string) ([]string, error) {
+	if err := checkIdentity(role, name); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(a.issuedDir(role, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("no certificate was issued for %s %s", role, name)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var ret []string
+	for _, entry := range entries {
+		if serial := strings.TrimSuffix(entry.Name(), ".crt"); serial != entry.Name() {
+			ret = append(ret, serial)
+		}
+	}
+
+	return ret, nil
+}
+
+// Enroll uses a token to issue a DER encoded certificate for the key in csrDER.
+// It returns the certificate and the token it was issued for.
+func (a *Authority) Enroll(token string, csrDER []byte) ([]byte, Token, error) {
+	csr, err := parseRequest(csrDER)
+	if err != nil {
+		return nil, Token{}, err
+	}
+
+	t, err := a.useToken(token)
+	if err != nil {
+		return nil, Token{}, err
+	}
+
+	der, err := a.sign(csr, t.Role, t.Name)
+	if err != nil {
+		return nil, Token{}, err
+	}
+
+	return der, t, nil
+}
+
+// Renew issues a new certificate with the same role and name as a valid certificate issued by the authority.
+func (a *Authority) Renew(certs []*x509.Certificate, csrDER []byte) ([]byte, Token, error) {
+	if len(certs) == 0 {
+		return nil, Token{}, fmt.Errorf("no certificate presented")
+	}
+
+	role := ""
+	if ou := certs[0].Subject.OrganizationalUnit; len(ou) == 1 {
+		role = ou[0]
+	}
+
+	name, err := a.Verify(certs, role)
+	if err != nil {
+		return nil, Token{}, err
+	}
+
+	csr, err := parseRequest(csrDER)
+	if err != nil {
+		return nil, Token{}, err
+	}
+
+	der, err := a.sign(csr, role, name)
+	if err != nil {
+		return nil, Token{}, err
+	}
+
+	return der, Token{Role: role, Name: name}, nil
+}
+
+// Verify checks that the first certificate was issued by the authority for role, is valid now, has not been
+// revoked and returns its name.
+// Any further certificates are treated as intermediates.
+func (a *Authority) Verify(certs []*x509.Certificate, role string) (string, error) {
+	if len(certs) == 0 {
+		return "", fmt.Errorf("no certificate presented")
+	}
+
+	leaf := certs[0]
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         a.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if a.Revoked(leaf) {
+		return "", fmt.Errorf("certificate %s has been revoked", SerialString(leaf.SerialNumber))
+	}
+
+	if ou := leaf.Subject.OrganizationalUnit; len(ou) != 1 || ou[0] != role {
+		return "", fmt.Errorf("certificate was not issued to a %s", role)
+	}
+
+	name := leaf.Subject.CommonName
+	if err := checkIdentity(role, name); err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+// Issued reports whether a certificate was ever issued for the role and name.
+func (a *Authority) Issued(role string, name string) bool {
+	if checkIdentity(role, name) != nil {
+		return false
+	}
+
+	_, err := os.Stat(a.issuedDir(role, name))
+	return err == nil
+}
+
+// Open loads the authority kept in dir. A new authority is created if dir does not hold one yet.
+// Certificates it issues are valid for validity.
+func Open(dir string, validity time.Duration) (*Authority, error) {
+	a := &Authority{
+		dir:      dir,
+		validity: validity,
+	}
+
+	for _, sub := range []string{"tokens", "issued"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "ca.crt")); errors.Is(err, os.ErrNotExist) {
+		if err := a.create(); err != nil {
+			return nil, fmt.Errorf("failed to create CA: %v", err)
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
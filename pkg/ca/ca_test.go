@@ -0,0 +1,179 @@
+package ca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// enroll issues a certificate for a new key with a token from a.
+func enroll(t *testing.T, a *Authority, role string, name string) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := a.CreateToken(role, name, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, _, err := a.Enroll(token, csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+// forge returns a self signed certificate that looks like one the authority issues.
+func forge(t *testing.T, role string, name string) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			Organization:       []string{"Raise"},
+			OrganizationalUnit: []string{role},
+			CommonName:         name,
+		},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(time.Hour),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+
+	a, err := Open(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := Open(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Opening the directory again is how raised revoke and raised token change it while the server runs.
+	expiring, err := Open(dir, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := enroll(t, a, RoleClient, "alice")
+	web1 := enroll(t, a, RoleWorker, "web1")
+	revoked := enroll(t, a, RoleClient, "bob")
+	expired := enroll(t, expiring, RoleClient, "carol")
+	foreign := enroll(t, other, RoleClient, "alice")
+
+	if err := expiring.Revoke([]string{SerialString(revoked.SerialNumber)}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		certs []*x509.Certificate
+		role  string
+		want  string
+	}{
+		{"client", []*x509.Certificate{alice}, RoleClient, "alice"},
+		{"worker", []*x509.Certificate{web1}, RoleWorker, "web1"},
+		{"client as worker", []*x509.Certificate{alice}, RoleWorker, ""},
+		{"worker as client", []*x509.Certificate{web1}, RoleClient, ""},
+		{"revoked", []*x509.Certificate{revoked}, RoleClient, ""},
+		{"expired", []*x509.Certificate{expired}, RoleClient, ""},
+		{"other authority", []*x509.Certificate{foreign}, RoleClient, ""},
+		{"forged", []*x509.Certificate{forge(t, RoleClient, "alice")}, RoleClient, ""},
+		{"authority itself", []*x509.Certificate{a.Certificate()}, RoleClient, ""},
+		{"none", nil, RoleClient, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, err := a.Verify(tt.certs, tt.role)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("verified as %s", name)
+				}
+				return
+			}
+
+			if err != nil || name != tt.want {
+				t.Fatalf("got %q, %v, want %q", name, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRevokedAfterVerify(t *testing.T) {
+	dir := t.TempDir()
+
+	a, err := Open(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := enroll(t, a, RoleClient, "alice")
+
+	if _, err := a.Verify([]*x509.Certificate{cert}, RoleClient); err != nil {
+		t.Fatal(err)
+	}
+
+	if a.Revoked(cert) {
+		t.Fatalf("certificate is revoked before revoking it")
+	}
+
+	// The revocation list is cached, so a change from another process has to be noticed.
+	other, err := Open(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := other.Revoke([]string{SerialString(cert.SerialNumber)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !a.Revoked(cert) {
+		t.Fatalf("certificate is not revoked")
+	}
+
+	if _, err := a.Verify([]*x509.Certificate{cert}, RoleClient); err == nil {
+		t.Fatalf("revoked certificate verified")
+	}
+}
@@ -0,0 +1,157 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/Vbitz/raise/v2/pkg/proto"
+	"github.com/Vbitz/raise/v2/pkg/request"
+	"go.starlark.net/starlark"
+)
+
+type ArchiveOptions struct {
+	// The number of leading path elements to remove from every entry when extracting.
+	StripComponents int
+	// Patterns of paths to leave out when packing. See manifest.Excluded.
+	Exclude []string
+	// Called as the archive is transferred.
+	Progress ProgressFunc
+}
+
+// isGzipArchive reports whether an archive should be compressed going by its name.
+func isGzipArchive(filename string) bool {
+	return strings.HasSuffix(filename, ".tar.gz") || strings.HasSuffix(filename, ".tgz")
+}
+
+// Extract uploads a local tar or tar.gz archive and extracts it into dirname on the remote.
+// Entries that would end up outside dirname are rejected. It returns the extracted entries.
+func (r *Remote) Extract(ctx context.Context, localArchive string, dirname string, opts ArchiveOptions) ([]proto.FileInfo, error) {
+	if err := r.Mkdir(ctx, dirname, 0, true); err != nil {
+		return nil, err
+	}
+
+	// The archive is uploaded next to where it is extracted so it is on the same filesystem.
+	archive := path.Join(dirname, ".raise-archive-"+request.NewID())
+
+	err := r.Upload(ctx, localArchive, archive, TransferOptions{Progress: opts.Progress})
+	if err != nil {
+		return nil, err
+	}
+	defer r.Remove(context.Background(), archive, false)
+
+	var resp proto.SendMessageResp
+
+	err = r.fileOperation(ctx, "extract", proto.SendMessageReq{
+		Kind:            proto.MessageExtract,
+		Filename:        archive,
+		Destination:     dirname,
+		StripComponents: opts.StripComponents,
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Files, nil
+}
+
+// Pack packs dirname on the remote into a local archive. The archive is compressed if its name
+// ends in .tar.gz or .tgz.
+func (r *Remote) Pack(ctx context.Context, dirname string, localArchive string, opts ArchiveOptions) error {
+	var resp proto.SendMessageResp
+
+	err := r.fileOperation(ctx, "pack", proto.SendMessageReq{
+		Kind:     proto.MessagePack,
+		Filename: dirname,
+		Exclude:  opts.Exclude,
+		Gzip:     isGzipArchive(localArchive),
+	}, &resp)
+	if err != nil {
+		return err
+	}
+
+	archive := string(resp.Content)
+	defer r.Remove(context.Background(), archive, false)
+
+	return r.Download(ctx, archive, localArchive, TransferOptions{Progress: opts.Progress})
+}
+
+// archiveBuiltin returns Remote.extract or Remote.pack.
+func (r *Remote) archiveBuiltin(name string) starlark.Value {
+	return starlark.NewBuiltin("Remote."+name, func(
+		thread *starlark.Thread,
+		fn *starlark.Builtin,
+		args starlark.Tuple,
+		kwargs []starlark.Tuple,
+	) (starlark.Value, error) {
+		var (
+			source          string
+			destination     string
+			stripComponents int
+			exclude         starlark.Value
+			onProgress      starlark.Callable
+		)
+		if name == "extract" {
+			if err := starlark.UnpackArgs("Remote."+name, args, kwargs,
+				"source", &source,
+				"destination", &destination,
+				"strip_components?", &stripComponents,
+				"on_progress?", &onProgress,
+			); err != nil {
+				return starlark.None, err
+			}
+		} else {
+			if err := starlark.UnpackArgs("Remote."+name, args, kwargs,
+				"source", &source,
+				"destination", &destination,
+				"exclude?", &exclude,
+				"on_progress?", &onProgress,
+			); err != nil {
+				return starlark.None, err
+			}
+		}
+
+		patterns, err := stringList(exclude)
+		if err != nil {
+			return starlark.None, fmt.Errorf("Remote.%s: exclude: %v", name, err)
+		}
+
+		opts := ArchiveOptions{
+			StripComponents: stripComponents,
+			Exclude:         patterns,
+		}
+
+		if onProgress != nil {
+			opts.Progress = func(transferred int64, total int64) error {
+				_, err := starlark.Call(thread, onProgress, starlark.Tuple{
+					starlark.MakeInt64(transferred),
+					starlark.MakeInt64(total),
+				}, nil)
+				return err
+			}
+		}
+
+		if name == "pack" {
+			err := r.Pack(threadContext(thread), source, destination, opts)
+			if err != nil {
+				return starlark.None, err
+			}
+
+			return starlark.None, nil
+		}
+
+		files, err := r.Extract(threadContext(thread), source, destination, opts)
+		if err != nil {
+			return starlark.None, err
+		}
+
+		var ret []starlark.Value
+
+		for _, info := range files {
+			ret = append(ret, fileInfoToStarlark(info))
+		}
+
+		return starlark.NewList(ret), nil
+	})
+}
@@ -8,11 +8,16 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/Vbitz/raise/v2/pkg/proto"
+	"github.com/Vbitz/raise/v2/pkg/request"
+	"github.com/Vbitz/raise/v2/pkg/security"
 	"github.com/cenkalti/rpc2"
 	"github.com/gobwas/ws"
 	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
 )
 
 type Client struct {
@@ -22,6 +27,13 @@ type Client struct {
 	rpcConn           net.Conn
 	clientCertificate string
 	clientKey         string
+
+	outputMtx      sync.Mutex
+	outputHandlers map[string]OutputHandler
+	defaultOutput  OutputHandler
+
+	sessionMtx sync.Mutex
+	sessions   map[string]*Session
 }
 
 // Ping implements proto.CommonService
@@ -47,24 +59,9 @@ func (c *Client) Connect() error {
 
 	dialer.TLSConfig = &tls.Config{}
 
-	certContent, err := os.ReadFile(c.clientCertificate)
-	if err != nil {
-		return fmt.Errorf("failed to read certificate: %v", err)
-	}
-
-	keyContent, err := os.ReadFile(c.clientKey)
-	if err != nil {
-		return fmt.Errorf("failed to read key: %v", err)
-	}
-
-	priv, err := x509.ParsePKCS1PrivateKey(keyContent)
+	crt, err := security.LoadCertificatePair(c.clientCertificate, c.clientKey)
 	if err != nil {
-		return fmt.Errorf("failed to parse key: %v", err)
-	}
-
-	crt := tls.Certificate{
-		PrivateKey:  priv,
-		Certificate: [][]byte{certContent},
+		return err
 	}
 
 	dialer.TLSConfig.ServerName = "localhost"
@@ -94,10 +91,28 @@ func (c *Client) Connect() error {
 	go c.rpcClient.Run()
 
 	c.rpcClient.Handle(proto.Common_Ping, c.Ping)
+	c.rpcClient.Handle(proto.Client_Output, c.Output)
+	c.rpcClient.Handle(proto.Common_SessionData, c.SessionData)
+	c.rpcClient.Handle(proto.Common_CloseSession, c.CloseSession)
+
+	go func() {
+		<-c.rpcClient.DisconnectNotify()
+		c.closeSessions()
+	}()
 
 	return nil
 }
 
+// call makes a call to the server. If ctx is done before the server answers the server is told to cancel the request.
+func (c *Client) call(ctx context.Context, method string, requestID string, args interface{}, reply interface{}) error {
+	err := c.rpcClient.CallWithContext(ctx, method, args, reply)
+	if ctx.Err() != nil && requestID != "" {
+		c.rpcClient.Notify(proto.Common_Cancel, proto.CancelReq{RequestID: requestID})
+	}
+
+	return err
+}
+
 func (c *Client) Close() error {
 	if c.rpcConn != nil {
 		if err := c.rpcConn.Close(); err != nil {
@@ -122,7 +137,12 @@ func (c *Client) Remote(name string) (*Remote, error) {
 	}, nil
 }
 
-func (c *Client) GetWorkers() ([]string, error) {
+func (c *Client) GetWorkers() ([]proto.WorkerRecord, error) {
+	return c.SelectWorkers("")
+}
+
+// SelectWorkers returns the connected workers matching a label selector.
+func (c *Client) SelectWorkers(selector string) ([]proto.WorkerRecord, error) {
 	// Lazily connect to the server when we get our first client connection.
 	if c.rpcConn == nil {
 		err := c.Connect()
@@ -132,7 +152,9 @@ func (c *Client) GetWorkers() ([]string, error) {
 	}
 
 	var resp proto.GetWorkersResp
-	err := c.rpcClient.Call(proto.Client_GetWorkers, proto.GetWorkersReq{}, &resp)
+	err := c.rpcClient.Call(proto.Client_GetWorkers, proto.GetWorkersReq{
+		Selector: selector,
+	}, &resp)
 	if err != nil {
 		return nil, err
 	}
@@ -140,6 +162,252 @@ func (c *Client) GetWorkers() ([]string, error) {
 	return resp.Workers, nil
 }
 
+// Select returns a Remote for every connected worker matching a label selector.
+func (c *Client) Select(selector string) ([]*Remote, error) {
+	workers, err := c.SelectWorkers(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []*Remote
+	for _, worker := range workers {
+		remote, err := c.Remote(worker.Name)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, remote)
+	}
+
+	return ret, nil
+}
+
+// SendMessageAll sends the same message to many workers. The server fans the message out
+// so this is a single round trip no matter how many targets there are.
+func (c *Client) SendMessageAll(ctx context.Context, targets []string, msg proto.SendMessageReq, parallelism int) ([]proto.SendMessageResult, error) {
+	// Lazily connect to the server when we get our first client connection.
+	if c.rpcConn == nil {
+		err := c.Connect()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if msg.RequestID == "" {
+		msg.RequestID = request.NewID()
+	}
+
+	var resp proto.SendMessageAllResp
+	err := c.call(ctx, proto.Client_SendMessageAll, msg.RequestID, proto.SendMessageAllReq{
+		Targets:     targets,
+		Message:     msg,
+		Parallelism: parallelism,
+	}, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call SendMessageAll: %v", err)
+	}
+
+	return resp.Results, nil
+}
+
+// RunAll runs a script on every target and returns the result for each one.
+func (c *Client) RunAll(ctx context.Context, targets []string, script string, parallelism int, opts RunScriptOptions) ([]proto.SendMessageResult, error) {
+	req := proto.SendMessageReq{
+		Kind:      proto.MessageRunScript,
+		Content:   []byte(script),
+		Timeout:   opts.Timeout,
+		QueueFor:  opts.QueueFor,
+		RequestID: request.NewID(),
+	}
+
+	if c.addOutputHandler(req.RequestID, opts.OnOutput) {
+		defer c.removeOutputHandler(req.RequestID)
+
+		req.StreamOutput = true
+	}
+
+	return c.SendMessageAll(ctx, targets, req, parallelism)
+}
+
+// QueuedMessages returns the messages the server queued for offline workers and what became of them.
+// target and id narrow the result down if set.
+func (c *Client) QueuedMessages(target string, id string) ([]proto.QueuedMessage, error) {
+	// Lazily connect to the server when we get our first client connection.
+	if c.rpcConn == nil {
+		err := c.Connect()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var resp proto.QueuedMessagesResp
+	err := c.rpcClient.Call(proto.Client_QueuedMessages, proto.QueuedMessagesReq{
+		Target: target,
+		ID:     id,
+	}, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call QueuedMessages: %v", err)
+	}
+
+	return resp.Messages, nil
+}
+
+// AuditEvents returns the events in the audit log of the server that match req.
+func (c *Client) AuditEvents(req proto.AuditEventsReq) ([]proto.AuditEvent, error) {
+	// Lazily connect to the server when we get our first client connection.
+	if c.rpcConn == nil {
+		err := c.Connect()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var resp proto.AuditEventsResp
+	err := c.rpcClient.Call(proto.Client_AuditEvents, req, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call AuditEvents: %v", err)
+	}
+
+	return resp.Events, nil
+}
+
+// GetWorkerNames returns just the names of the connected workers.
+func (c *Client) GetWorkerNames() ([]string, error) {
+	return c.selectNames("")
+}
+
+const threadContextKey = "raise.context"
+
+// SetThreadContext sets the context requests made from a Starlark thread run under.
+// Cancelling it cancels the requests on the server and workers.
+func SetThreadContext(thread *starlark.Thread, ctx context.Context) {
+	thread.SetLocal(threadContextKey, ctx)
+}
+
+func threadContext(thread *starlark.Thread) context.Context {
+	if ctx, ok := thread.Local(threadContextKey).(context.Context); ok {
+		return ctx
+	}
+	return context.Background()
+}
+
+// secondsToDuration converts an optional number of seconds passed to a builtin.
+func secondsToDuration(value starlark.Value) (time.Duration, error) {
+	if value == nil || value == starlark.None {
+		return 0, nil
+	}
+
+	seconds, ok := starlark.AsFloat(value)
+	if !ok {
+		return 0, fmt.Errorf("expected a number of seconds, got %s", value.Type())
+	}
+
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// targetNames converts a Starlark list of worker names or Remote objects to names.
+// A string is treated as a label selector.
+func (c *Client) targetNames(targets starlark.Value) ([]string, error) {
+	if sel, ok := targets.(starlark.String); ok {
+		return c.selectNames(string(sel))
+	}
+
+	iterable, ok := targets.(starlark.Iterable)
+	if !ok {
+		return nil, fmt.Errorf("expected a list of targets or a selector, got %s", targets.Type())
+	}
+
+	var ret []string
+
+	iter := iterable.Iterate()
+	defer iter.Done()
+
+	var value starlark.Value
+	for iter.Next(&value) {
+		switch target := value.(type) {
+		case starlark.String:
+			ret = append(ret, string(target))
+		case *Remote:
+			ret = append(ret, target.name)
+		default:
+			return nil, fmt.Errorf("expected %s or %s, got %s", "String", "Remote", value.Type())
+		}
+	}
+
+	return ret, nil
+}
+
+func (c *Client) selectNames(selector string) ([]string, error) {
+	workers, err := c.SelectWorkers(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []string
+	for _, worker := range workers {
+		ret = append(ret, worker.Name)
+	}
+
+	return ret, nil
+}
+
+// runResultToStarlark converts the result of RunAll on one target. ok is only true if the script exited cleanly.
+func runResultToStarlark(result proto.SendMessageResult) starlark.Value {
+	fields := scriptResultFields(result.Response.ScriptResult)
+
+	if result.Error == "" {
+		if err := checkScriptResult(result.Target, result.Response.ScriptResult); err != nil {
+			result.Error = err.Error()
+		}
+	}
+
+	fields["name"] = starlark.String(result.Target)
+	fields["ok"] = starlark.Bool(result.Error == "")
+	fields["error"] = starlark.String(result.Error)
+	fields["queued"] = starlark.String(result.Response.QueuedID)
+
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, fields)
+}
+
+func queuedMessageToStarlark(msg proto.QueuedMessage) starlark.Value {
+	deliveredAt := ""
+	if !msg.DeliveredAt.IsZero() {
+		deliveredAt = msg.DeliveredAt.Format(time.RFC3339)
+	}
+
+	fields := scriptResultFields(msg.Response.ScriptResult)
+
+	fields["id"] = starlark.String(msg.ID)
+	fields["client"] = starlark.String(msg.Client)
+	fields["name"] = starlark.String(msg.Target)
+	fields["kind"] = starlark.String(msg.Message.Kind)
+	fields["state"] = starlark.String(msg.State)
+	fields["queued_at"] = starlark.String(msg.QueuedAt.Format(time.RFC3339))
+	fields["expires_at"] = starlark.String(msg.ExpiresAt.Format(time.RFC3339))
+	fields["delivered_at"] = starlark.String(deliveredAt)
+	fields["error"] = starlark.String(msg.Error)
+
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, fields)
+}
+
+func workerRecordToStarlark(worker proto.WorkerRecord) starlark.Value {
+	labels := starlark.NewDict(len(worker.Labels))
+	for k, v := range worker.Labels {
+		labels.SetKey(starlark.String(k), starlark.String(v))
+	}
+
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"name":           starlark.String(worker.Name),
+		"address":        starlark.String(worker.Address),
+		"state":          starlark.String(worker.State),
+		"connected_at":   starlark.String(worker.ConnectedAt.Format(time.RFC3339)),
+		"last_heartbeat": starlark.String(worker.LastHeartbeat.Format(time.RFC3339)),
+		"commit":         starlark.String(worker.Commit),
+		"os":             starlark.String(worker.OperatingSystem),
+		"arch":           starlark.String(worker.Architecture),
+		"labels":         labels,
+	})
+}
+
 // Attr implements starlark.HasAttrs
 func (c *Client) Attr(name string) (starlark.Value, error) {
 	if name == "remote" {
@@ -166,7 +434,36 @@ func (c *Client) Attr(name string) (starlark.Value, error) {
 			args starlark.Tuple,
 			kwargs []starlark.Tuple,
 		) (starlark.Value, error) {
-			workerList, err := c.GetWorkers()
+			var (
+				selector string
+			)
+			if err := starlark.UnpackArgs("Client.get_workers", args, kwargs,
+				"selector?", &selector,
+			); err != nil {
+				return starlark.None, err
+			}
+
+			workerList, err := c.SelectWorkers(selector)
+			if err != nil {
+				return starlark.None, err
+			}
+
+			var ret []starlark.Value
+
+			for _, worker := range workerList {
+				ret = append(ret, workerRecordToStarlark(worker))
+			}
+
+			return starlark.NewList(ret), nil
+		}), nil
+	} else if name == "get_worker_names" {
+		return starlark.NewBuiltin("Client.get_worker_names", func(
+			thread *starlark.Thread,
+			fn *starlark.Builtin,
+			args starlark.Tuple,
+			kwargs []starlark.Tuple,
+		) (starlark.Value, error) {
+			workerList, err := c.GetWorkerNames()
 			if err != nil {
 				return starlark.None, err
 			}
@@ -177,6 +474,130 @@ func (c *Client) Attr(name string) (starlark.Value, error) {
 				ret = append(ret, starlark.String(name))
 			}
 
+			return starlark.NewList(ret), nil
+		}), nil
+	} else if name == "select" {
+		return starlark.NewBuiltin("Client.select", func(
+			thread *starlark.Thread,
+			fn *starlark.Builtin,
+			args starlark.Tuple,
+			kwargs []starlark.Tuple,
+		) (starlark.Value, error) {
+			var (
+				selector string
+			)
+			if err := starlark.UnpackArgs("Client.select", args, kwargs,
+				"selector", &selector,
+			); err != nil {
+				return starlark.None, err
+			}
+
+			remotes, err := c.Select(selector)
+			if err != nil {
+				return starlark.None, err
+			}
+
+			var ret []starlark.Value
+
+			for _, remote := range remotes {
+				ret = append(ret, remote)
+			}
+
+			return starlark.NewList(ret), nil
+		}), nil
+	} else if name == "run_all" {
+		return starlark.NewBuiltin("Client.run_all", func(
+			thread *starlark.Thread,
+			fn *starlark.Builtin,
+			args starlark.Tuple,
+			kwargs []starlark.Tuple,
+		) (starlark.Value, error) {
+			var (
+				targets     starlark.Value
+				script      string
+				parallelism int = 32
+				timeout     starlark.Value
+				onOutput    starlark.Callable
+				queueFor    starlark.Value
+			)
+			if err := starlark.UnpackArgs("Client.run_all", args, kwargs,
+				"targets", &targets,
+				"script", &script,
+				"parallelism?", &parallelism,
+				"timeout?", &timeout,
+				"on_output?", &onOutput,
+				"queue_for?", &queueFor,
+			); err != nil {
+				return starlark.None, err
+			}
+
+			names, err := c.targetNames(targets)
+			if err != nil {
+				return starlark.None, err
+			}
+
+			timeoutDuration, err := secondsToDuration(timeout)
+			if err != nil {
+				return starlark.None, err
+			}
+
+			queueForDuration, err := secondsToDuration(queueFor)
+			if err != nil {
+				return starlark.None, err
+			}
+
+			var results []proto.SendMessageResult
+
+			err = runWithOutput(thread, onOutput, func(handler OutputHandler) error {
+				var err error
+				results, err = c.RunAll(threadContext(thread), names, script, parallelism, RunScriptOptions{
+					Timeout:  timeoutDuration,
+					OnOutput: handler,
+					QueueFor: queueForDuration,
+				})
+				return err
+			})
+			if err != nil {
+				return starlark.None, err
+			}
+
+			var ret []starlark.Value
+
+			for _, result := range results {
+				ret = append(ret, runResultToStarlark(result))
+			}
+
+			return starlark.NewList(ret), nil
+		}), nil
+	} else if name == "queued" {
+		return starlark.NewBuiltin("Client.queued", func(
+			thread *starlark.Thread,
+			fn *starlark.Builtin,
+			args starlark.Tuple,
+			kwargs []starlark.Tuple,
+		) (starlark.Value, error) {
+			var (
+				target string
+				id     string
+			)
+			if err := starlark.UnpackArgs("Client.queued", args, kwargs,
+				"target?", &target,
+				"id?", &id,
+			); err != nil {
+				return starlark.None, err
+			}
+
+			messages, err := c.QueuedMessages(target, id)
+			if err != nil {
+				return starlark.None, err
+			}
+
+			var ret []starlark.Value
+
+			for _, msg := range messages {
+				ret = append(ret, queuedMessageToStarlark(msg))
+			}
+
 			return starlark.NewList(ret), nil
 		}), nil
 	} else if name == "read_file" {
@@ -233,7 +654,7 @@ func (c *Client) Attr(name string) (starlark.Value, error) {
 }
 
 func (*Client) AttrNames() []string {
-	return []string{"remote", "get_workers", "read_file", "write_file"}
+	return []string{"remote", "get_workers", "get_worker_names", "select", "run_all", "queued", "read_file", "write_file"}
 }
 
 func (*Client) String() string       { return "Client" }
@@ -248,7 +669,7 @@ var (
 	_ starlark.Value    = &Client{}
 	_ starlark.HasAttrs = &Client{}
 
-	_ proto.CommonService = &Client{}
+	_ proto.ClientCallbackService = &Client{}
 )
 
 func NewClient(serverAddress string, serverCertificate string, clientCertificate string, clientKey string) *Client {
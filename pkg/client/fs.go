@@ -0,0 +1,426 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Vbitz/raise/v2/pkg/proto"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// FileError is a filesystem error reported by a worker that has a known cause.
+// It matches os.ErrNotExist, os.ErrPermission or os.ErrExist with errors.Is.
+type FileError struct {
+	Op   string
+	Path string
+	Code proto.FileErrorCode
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	// The message from the worker already names the operation and path.
+	return e.Err.Error()
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+// fileOperation sends a filesystem message to the remote and turns the errors it knows about into a FileError.
+func (r *Remote) fileOperation(ctx context.Context, op string, req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	err := r.sendMessage(ctx, req, resp)
+	if err == nil {
+		return nil
+	}
+
+	var fileErr *proto.FileError
+	if errors.As(err, &fileErr) {
+		return &FileError{Op: op, Path: req.Filename, Code: fileErr.Code, Err: fileErr}
+	}
+
+	return fmt.Errorf("failed to call %s: %v", op, err)
+}
+
+// Stat describes a file on the remote. Symbolic links are not followed.
+func (r *Remote) Stat(ctx context.Context, filename string) (*proto.FileInfo, error) {
+	var resp proto.SendMessageResp
+
+	err := r.fileOperation(ctx, "stat", proto.SendMessageReq{
+		Kind:     proto.MessageStat,
+		Filename: filename,
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Files) != 1 {
+		return nil, fmt.Errorf("stat %s: worker returned %d results", filename, len(resp.Files))
+	}
+
+	return &resp.Files[0], nil
+}
+
+// ListDir describes every entry in a directory on the remote.
+func (r *Remote) ListDir(ctx context.Context, dirname string) ([]proto.FileInfo, error) {
+	var resp proto.SendMessageResp
+
+	err := r.fileOperation(ctx, "list", proto.SendMessageReq{
+		Kind:     proto.MessageListDir,
+		Filename: dirname,
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Files, nil
+}
+
+// Mkdir creates a directory on the remote. A zero mode uses 0755. With parents set missing parent
+// directories are created too and an existing directory is not an error.
+func (r *Remote) Mkdir(ctx context.Context, dirname string, mode os.FileMode, parents bool) error {
+	var resp proto.SendMessageResp
+
+	return r.fileOperation(ctx, "mkdir", proto.SendMessageReq{
+		Kind:      proto.MessageMkdir,
+		Filename:  dirname,
+		Mode:      mode,
+		Recursive: parents,
+	}, &resp)
+}
+
+// Remove removes a file or empty directory on the remote. With recursive set directories are removed with everything in them.
+func (r *Remote) Remove(ctx context.Context, filename string, recursive bool) error {
+	var resp proto.SendMessageResp
+
+	return r.fileOperation(ctx, "remove", proto.SendMessageReq{
+		Kind:      proto.MessageRemove,
+		Filename:  filename,
+		Recursive: recursive,
+	}, &resp)
+}
+
+func (r *Remote) Rename(ctx context.Context, oldFilename string, newFilename string) error {
+	var resp proto.SendMessageResp
+
+	return r.fileOperation(ctx, "rename", proto.SendMessageReq{
+		Kind:        proto.MessageRename,
+		Filename:    oldFilename,
+		Destination: newFilename,
+	}, &resp)
+}
+
+// Symlink creates a symbolic link on the remote at link pointing to target.
+func (r *Remote) Symlink(ctx context.Context, target string, link string) error {
+	var resp proto.SendMessageResp
+
+	return r.fileOperation(ctx, "symlink", proto.SendMessageReq{
+		Kind:        proto.MessageSymlink,
+		Filename:    link,
+		Destination: target,
+	}, &resp)
+}
+
+// Readlink returns where a symbolic link on the remote points.
+func (r *Remote) Readlink(ctx context.Context, link string) (string, error) {
+	var resp proto.SendMessageResp
+
+	err := r.fileOperation(ctx, "readlink", proto.SendMessageReq{
+		Kind:     proto.MessageReadlink,
+		Filename: link,
+	}, &resp)
+	if err != nil {
+		return "", err
+	}
+
+	return string(resp.Content), nil
+}
+
+// Chmod sets the permission bits of a file on the remote.
+func (r *Remote) Chmod(ctx context.Context, filename string, mode os.FileMode) error {
+	var resp proto.SendMessageResp
+
+	return r.fileOperation(ctx, "chmod", proto.SendMessageReq{
+		Kind:     proto.MessageChmod,
+		Filename: filename,
+		Mode:     mode,
+	}, &resp)
+}
+
+// Chown sets the owner and group of a file on the remote. Either may be a name or numeric id
+// and is left as it is if empty.
+func (r *Remote) Chown(ctx context.Context, filename string, owner string, group string) error {
+	var resp proto.SendMessageResp
+
+	return r.fileOperation(ctx, "chown", proto.SendMessageReq{
+		Kind:     proto.MessageChown,
+		Filename: filename,
+		Owner:    owner,
+		Group:    group,
+	}, &resp)
+}
+
+func fileInfoToStarlark(info proto.FileInfo) starlark.Value {
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"name":        starlark.String(info.Name),
+		"path":        starlark.String(info.Path),
+		"type":        starlark.String(info.Type),
+		"size":        starlark.MakeInt64(info.Size),
+		"mode":        starlark.MakeInt(int(info.Mode.Perm())),
+		"mod_time":    starlark.String(info.ModTime.Format(time.RFC3339Nano)),
+		"owner":       starlark.String(info.Owner),
+		"group":       starlark.String(info.Group),
+		"uid":         starlark.MakeInt(info.Uid),
+		"gid":         starlark.MakeInt(info.Gid),
+		"link_target": starlark.String(info.LinkTarget),
+	})
+}
+
+var fileAttrNames = []string{"stat", "list_dir", "mkdir", "remove", "rename", "symlink", "readlink", "chmod", "chown"}
+
+// fileAttr returns the Starlark builtin for a filesystem operation or nil.
+func (r *Remote) fileAttr(name string) starlark.Value {
+	if name == "stat" {
+		return starlark.NewBuiltin("Remote.stat", func(
+			thread *starlark.Thread,
+			fn *starlark.Builtin,
+			args starlark.Tuple,
+			kwargs []starlark.Tuple,
+		) (starlark.Value, error) {
+			var (
+				filename string
+			)
+			if err := starlark.UnpackArgs("Remote.stat", args, kwargs,
+				"filename", &filename,
+			); err != nil {
+				return starlark.None, err
+			}
+
+			info, err := r.Stat(threadContext(thread), filename)
+			if errors.Is(err, os.ErrNotExist) {
+				// Scripts can not catch errors so a missing file is None instead.
+				return starlark.None, nil
+			} else if err != nil {
+				return starlark.None, err
+			}
+
+			return fileInfoToStarlark(*info), nil
+		})
+	} else if name == "list_dir" {
+		return starlark.NewBuiltin("Remote.list_dir", func(
+			thread *starlark.Thread,
+			fn *starlark.Builtin,
+			args starlark.Tuple,
+			kwargs []starlark.Tuple,
+		) (starlark.Value, error) {
+			var (
+				dirname string
+			)
+			if err := starlark.UnpackArgs("Remote.list_dir", args, kwargs,
+				"dirname", &dirname,
+			); err != nil {
+				return starlark.None, err
+			}
+
+			files, err := r.ListDir(threadContext(thread), dirname)
+			if err != nil {
+				return starlark.None, err
+			}
+
+			var ret []starlark.Value
+
+			for _, info := range files {
+				ret = append(ret, fileInfoToStarlark(info))
+			}
+
+			return starlark.NewList(ret), nil
+		})
+	} else if name == "mkdir" {
+		return starlark.NewBuiltin("Remote.mkdir", func(
+			thread *starlark.Thread,
+			fn *starlark.Builtin,
+			args starlark.Tuple,
+			kwargs []starlark.Tuple,
+		) (starlark.Value, error) {
+			var (
+				dirname string
+				mode    int
+				parents bool
+			)
+			if err := starlark.UnpackArgs("Remote.mkdir", args, kwargs,
+				"dirname", &dirname,
+				"mode?", &mode,
+				"parents?", &parents,
+			); err != nil {
+				return starlark.None, err
+			}
+
+			err := r.Mkdir(threadContext(thread), dirname, os.FileMode(mode), parents)
+			if err != nil {
+				return starlark.None, err
+			}
+
+			return starlark.None, nil
+		})
+	} else if name == "remove" {
+		return starlark.NewBuiltin("Remote.remove", func(
+			thread *starlark.Thread,
+			fn *starlark.Builtin,
+			args starlark.Tuple,
+			kwargs []starlark.Tuple,
+		) (starlark.Value, error) {
+			var (
+				filename  string
+				recursive bool
+				missingOk bool
+			)
+			if err := starlark.UnpackArgs("Remote.remove", args, kwargs,
+				"filename", &filename,
+				"recursive?", &recursive,
+				"missing_ok?", &missingOk,
+			); err != nil {
+				return starlark.None, err
+			}
+
+			err := r.Remove(threadContext(thread), filename, recursive)
+			if missingOk && errors.Is(err, os.ErrNotExist) {
+				err = nil
+			}
+			if err != nil {
+				return starlark.None, err
+			}
+
+			return starlark.None, nil
+		})
+	} else if name == "rename" {
+		return starlark.NewBuiltin("Remote.rename", func(
+			thread *starlark.Thread,
+			fn *starlark.Builtin,
+			args starlark.Tuple,
+			kwargs []starlark.Tuple,
+		) (starlark.Value, error) {
+			var (
+				oldFilename string
+				newFilename string
+			)
+			if err := starlark.UnpackArgs("Remote.rename", args, kwargs,
+				"old", &oldFilename,
+				"new", &newFilename,
+			); err != nil {
+				return starlark.None, err
+			}
+
+			err := r.Rename(threadContext(thread), oldFilename, newFilename)
+			if err != nil {
+				return starlark.None, err
+			}
+
+			return starlark.None, nil
+		})
+	} else if name == "symlink" {
+		return starlark.NewBuiltin("Remote.symlink", func(
+			thread *starlark.Thread,
+			fn *starlark.Builtin,
+			args starlark.Tuple,
+			kwargs []starlark.Tuple,
+		) (starlark.Value, error) {
+			var (
+				target string
+				link   string
+			)
+			if err := starlark.UnpackArgs("Remote.symlink", args, kwargs,
+				"target", &target,
+				"link", &link,
+			); err != nil {
+				return starlark.None, err
+			}
+
+			err := r.Symlink(threadContext(thread), target, link)
+			if err != nil {
+				return starlark.None, err
+			}
+
+			return starlark.None, nil
+		})
+	} else if name == "readlink" {
+		return starlark.NewBuiltin("Remote.readlink", func(
+			thread *starlark.Thread,
+			fn *starlark.Builtin,
+			args starlark.Tuple,
+			kwargs []starlark.Tuple,
+		) (starlark.Value, error) {
+			var (
+				link string
+			)
+			if err := starlark.UnpackArgs("Remote.readlink", args, kwargs,
+				"link", &link,
+			); err != nil {
+				return starlark.None, err
+			}
+
+			target, err := r.Readlink(threadContext(thread), link)
+			if err != nil {
+				return starlark.None, err
+			}
+
+			return starlark.String(target), nil
+		})
+	} else if name == "chmod" {
+		return starlark.NewBuiltin("Remote.chmod", func(
+			thread *starlark.Thread,
+			fn *starlark.Builtin,
+			args starlark.Tuple,
+			kwargs []starlark.Tuple,
+		) (starlark.Value, error) {
+			var (
+				filename string
+				mode     int
+			)
+			if err := starlark.UnpackArgs("Remote.chmod", args, kwargs,
+				"filename", &filename,
+				"mode", &mode,
+			); err != nil {
+				return starlark.None, err
+			}
+
+			err := r.Chmod(threadContext(thread), filename, os.FileMode(mode))
+			if err != nil {
+				return starlark.None, err
+			}
+
+			return starlark.None, nil
+		})
+	} else if name == "chown" {
+		return starlark.NewBuiltin("Remote.chown", func(
+			thread *starlark.Thread,
+			fn *starlark.Builtin,
+			args starlark.Tuple,
+			kwargs []starlark.Tuple,
+		) (starlark.Value, error) {
+			var (
+				filename string
+				owner    string
+				group    string
+			)
+			if err := starlark.UnpackArgs("Remote.chown", args, kwargs,
+				"filename", &filename,
+				"owner?", &owner,
+				"group?", &group,
+			); err != nil {
+				return starlark.None, err
+			}
+
+			err := r.Chown(threadContext(thread), filename, owner, group)
+			if err != nil {
+				return starlark.None, err
+			}
+
+			return starlark.None, nil
+		})
+	} else {
+		return nil
+	}
+}
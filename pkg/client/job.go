@@ -0,0 +1,310 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Vbitz/raise/v2/pkg/proto"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// jobMessage sends a job message that describes a single job.
+func (r *Remote) jobMessage(ctx context.Context, req proto.SendMessageReq) (*proto.JobInfo, error) {
+	var resp proto.SendMessageResp
+
+	err := r.sendMessage(ctx, req, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Jobs) != 1 {
+		return nil, fmt.Errorf("worker returned %d jobs", len(resp.Jobs))
+	}
+
+	return &resp.Jobs[0], nil
+}
+
+// StartJob runs a script in the background on the remote. The job keeps running if the client
+// disconnects and its output is kept on the remote until the job is removed.
+func (r *Remote) StartJob(ctx context.Context, script string) (*proto.JobInfo, error) {
+	info, err := r.jobMessage(ctx, proto.SendMessageReq{
+		Kind:    proto.MessageStartJob,
+		Content: []byte(script),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to start job: %v", err)
+	}
+
+	return info, nil
+}
+
+// Jobs lists the jobs on the remote oldest first.
+func (r *Remote) Jobs(ctx context.Context) ([]proto.JobInfo, error) {
+	var resp proto.SendMessageResp
+
+	err := r.sendMessage(ctx, proto.SendMessageReq{
+		Kind: proto.MessageJobs,
+	}, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list jobs: %v", err)
+	}
+
+	return resp.Jobs, nil
+}
+
+func (r *Remote) JobStatus(ctx context.Context, id string) (*proto.JobInfo, error) {
+	info, err := r.jobMessage(ctx, proto.SendMessageReq{
+		Kind:  proto.MessageJobStatus,
+		JobID: id,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get status of job %s: %v", id, err)
+	}
+
+	return info, nil
+}
+
+// JobOutput reads up to a chunk of the output of a job starting at offset.
+// It also returns how much output there is in total so far.
+func (r *Remote) JobOutput(ctx context.Context, id string, stream proto.OutputStream, offset int64) ([]byte, int64, error) {
+	var resp proto.SendMessageResp
+
+	err := r.sendMessage(ctx, proto.SendMessageReq{
+		Kind:   proto.MessageJobOutput,
+		JobID:  id,
+		Stream: stream,
+		Offset: offset,
+	}, &resp)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read output of job %s: %v", id, err)
+	}
+
+	return resp.Content, resp.Size, nil
+}
+
+// WaitJob waits for a job to finish for up to timeout and returns its status either way.
+// A zero timeout waits as long as it takes.
+func (r *Remote) WaitJob(ctx context.Context, id string, timeout time.Duration) (*proto.JobInfo, error) {
+	info, err := r.jobMessage(ctx, proto.SendMessageReq{
+		Kind:    proto.MessageWaitJob,
+		JobID:   id,
+		Timeout: timeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to wait for job %s: %v", id, err)
+	}
+
+	return info, nil
+}
+
+// CancelJob kills a job and everything it started. Finished jobs are left as they are.
+func (r *Remote) CancelJob(ctx context.Context, id string) (*proto.JobInfo, error) {
+	info, err := r.jobMessage(ctx, proto.SendMessageReq{
+		Kind:  proto.MessageCancelJob,
+		JobID: id,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to cancel job %s: %v", id, err)
+	}
+
+	return info, nil
+}
+
+// RemoveJob deletes a finished job and its output from the remote.
+func (r *Remote) RemoveJob(ctx context.Context, id string) error {
+	var resp proto.SendMessageResp
+
+	err := r.sendMessage(ctx, proto.SendMessageReq{
+		Kind:  proto.MessageRemoveJob,
+		JobID: id,
+	}, &resp)
+	if err != nil {
+		return fmt.Errorf("failed to remove job %s: %v", id, err)
+	}
+
+	return nil
+}
+
+func jobInfoToStarlark(info proto.JobInfo) starlark.Value {
+	endTime := ""
+	if !info.EndTime.IsZero() {
+		endTime = info.EndTime.Format(time.RFC3339)
+	}
+
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"id":          starlark.String(info.ID),
+		"script":      starlark.String(info.Script),
+		"state":       starlark.String(info.State),
+		"finished":    starlark.Bool(info.Finished()),
+		"pid":         starlark.MakeInt(info.Pid),
+		"start_time":  starlark.String(info.StartTime.Format(time.RFC3339)),
+		"end_time":    starlark.String(endTime),
+		"exit_code":   starlark.MakeInt(info.ExitCode),
+		"stdout_size": starlark.MakeInt64(info.StdoutSize),
+		"stderr_size": starlark.MakeInt64(info.StderrSize),
+	})
+}
+
+var jobAttrNames = []string{"start_job", "jobs", "job", "job_output", "wait_job", "cancel_job", "remove_job"}
+
+// jobAttr returns the Starlark builtin for a job operation or nil.
+func (r *Remote) jobAttr(name string) starlark.Value {
+	if name == "start_job" {
+		return starlark.NewBuiltin("Remote.start_job", func(
+			thread *starlark.Thread,
+			fn *starlark.Builtin,
+			args starlark.Tuple,
+			kwargs []starlark.Tuple,
+		) (starlark.Value, error) {
+			var (
+				script string
+			)
+			if err := starlark.UnpackArgs("Remote.start_job", args, kwargs,
+				"script", &script,
+			); err != nil {
+				return starlark.None, err
+			}
+
+			info, err := r.StartJob(threadContext(thread), script)
+			if err != nil {
+				return starlark.None, err
+			}
+
+			return starlark.String(info.ID), nil
+		})
+	} else if name == "jobs" {
+		return starlark.NewBuiltin("Remote.jobs", func(
+			thread *starlark.Thread,
+			fn *starlark.Builtin,
+			args starlark.Tuple,
+			kwargs []starlark.Tuple,
+		) (starlark.Value, error) {
+			if err := starlark.UnpackArgs("Remote.jobs", args, kwargs); err != nil {
+				return starlark.None, err
+			}
+
+			jobs, err := r.Jobs(threadContext(thread))
+			if err != nil {
+				return starlark.None, err
+			}
+
+			var ret []starlark.Value
+
+			for _, info := range jobs {
+				ret = append(ret, jobInfoToStarlark(info))
+			}
+
+			return starlark.NewList(ret), nil
+		})
+	} else if name == "job" || name == "cancel_job" || name == "remove_job" {
+		return starlark.NewBuiltin("Remote."+name, func(
+			thread *starlark.Thread,
+			fn *starlark.Builtin,
+			args starlark.Tuple,
+			kwargs []starlark.Tuple,
+		) (starlark.Value, error) {
+			var (
+				id string
+			)
+			if err := starlark.UnpackArgs("Remote."+name, args, kwargs,
+				"id", &id,
+			); err != nil {
+				return starlark.None, err
+			}
+
+			ctx := threadContext(thread)
+
+			var (
+				info *proto.JobInfo
+				err  error
+			)
+			if name == "job" {
+				info, err = r.JobStatus(ctx, id)
+			} else if name == "cancel_job" {
+				info, err = r.CancelJob(ctx, id)
+			} else {
+				return starlark.None, r.RemoveJob(ctx, id)
+			}
+			if err != nil {
+				return starlark.None, err
+			}
+
+			return jobInfoToStarlark(*info), nil
+		})
+	} else if name == "job_output" {
+		return starlark.NewBuiltin("Remote.job_output", func(
+			thread *starlark.Thread,
+			fn *starlark.Builtin,
+			args starlark.Tuple,
+			kwargs []starlark.Tuple,
+		) (starlark.Value, error) {
+			var (
+				id     string
+				stream string = string(proto.StreamStdout)
+				offset int64
+			)
+			if err := starlark.UnpackArgs("Remote.job_output", args, kwargs,
+				"id", &id,
+				"stream?", &stream,
+				"offset?", &offset,
+			); err != nil {
+				return starlark.None, err
+			}
+
+			// Read everything written so far. Pass offset back in to only get what is new.
+			var content []byte
+			for {
+				chunk, size, err := r.JobOutput(threadContext(thread), id, proto.OutputStream(stream), offset)
+				if err != nil {
+					return starlark.None, err
+				}
+
+				content = append(content, chunk...)
+				offset += int64(len(chunk))
+
+				if len(chunk) == 0 || offset >= size {
+					break
+				}
+			}
+
+			return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+				"content": starlark.String(content),
+				"offset":  starlark.MakeInt64(offset),
+			}), nil
+		})
+	} else if name == "wait_job" {
+		return starlark.NewBuiltin("Remote.wait_job", func(
+			thread *starlark.Thread,
+			fn *starlark.Builtin,
+			args starlark.Tuple,
+			kwargs []starlark.Tuple,
+		) (starlark.Value, error) {
+			var (
+				id      string
+				timeout starlark.Value
+			)
+			if err := starlark.UnpackArgs("Remote.wait_job", args, kwargs,
+				"id", &id,
+				"timeout?", &timeout,
+			); err != nil {
+				return starlark.None, err
+			}
+
+			timeoutDuration, err := secondsToDuration(timeout)
+			if err != nil {
+				return starlark.None, fmt.Errorf("Remote.wait_job: timeout: %v", err)
+			}
+
+			info, err := r.WaitJob(threadContext(thread), id, timeoutDuration)
+			if err != nil {
+				return starlark.None, err
+			}
+
+			return jobInfoToStarlark(*info), nil
+		})
+	} else {
+		return nil
+	}
+}
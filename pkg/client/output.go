@@ -0,0 +1,132 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/Vbitz/raise/v2/pkg/proto"
+	"github.com/cenkalti/rpc2"
+	"go.starlark.net/starlark"
+)
+
+type OutputHandler func(chunk proto.OutputChunk)
+
+// Output implements proto.ClientCallbackService
+func (c *Client) Output(client *rpc2.Client, req proto.OutputChunk, resp *proto.OutputResp) error {
+	*resp = proto.OutputResp{}
+
+	c.outputMtx.Lock()
+	handler := c.outputHandlers[req.RequestID]
+	c.outputMtx.Unlock()
+
+	if handler != nil {
+		handler(req)
+	}
+
+	return nil
+}
+
+// SetOutputHandler sets the handler for streamed output of scripts that are run without their own handler.
+func (c *Client) SetOutputHandler(handler OutputHandler) {
+	c.outputMtx.Lock()
+	defer c.outputMtx.Unlock()
+
+	c.defaultOutput = handler
+}
+
+// addOutputHandler routes output for a request to handler, falling back to the default handler.
+// It returns false if there is no handler so the output does not need to be streamed.
+func (c *Client) addOutputHandler(requestID string, handler OutputHandler) bool {
+	c.outputMtx.Lock()
+	defer c.outputMtx.Unlock()
+
+	if handler == nil {
+		handler = c.defaultOutput
+	}
+	if handler == nil {
+		return false
+	}
+
+	if c.outputHandlers == nil {
+		c.outputHandlers = make(map[string]OutputHandler)
+	}
+	c.outputHandlers[requestID] = handler
+
+	return true
+}
+
+func (c *Client) removeOutputHandler(requestID string) {
+	c.outputMtx.Lock()
+	defer c.outputMtx.Unlock()
+
+	delete(c.outputHandlers, requestID)
+}
+
+// NewLinePrinter returns an OutputHandler that writes every line of output to w prefixed with the worker name.
+func NewLinePrinter(w io.Writer) OutputHandler {
+	var mtx sync.Mutex
+
+	return func(chunk proto.OutputChunk) {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		for _, line := range bytes.SplitAfter(chunk.Data, []byte("\n")) {
+			if len(line) == 0 {
+				continue
+			}
+
+			fmt.Fprintf(w, "[%s] %s", chunk.Target, line)
+			if line[len(line)-1] != '\n' {
+				fmt.Fprintln(w)
+			}
+		}
+	}
+}
+
+// runWithOutput runs fn and calls onOutput for each chunk of output passed to the handler fn is given.
+// Starlark values may only be used on the thread running the script so the chunks are handed
+// over to it while fn runs on another goroutine.
+func runWithOutput(thread *starlark.Thread, onOutput starlark.Callable, fn func(handler OutputHandler) error) error {
+	if onOutput == nil {
+		return fn(nil)
+	}
+
+	chunks := make(chan proto.OutputChunk)
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+
+	defer close(stop)
+
+	go func() {
+		done <- fn(func(chunk proto.OutputChunk) {
+			select {
+			case chunks <- chunk:
+			case <-stop:
+			}
+		})
+	}()
+
+	var callbackErr error
+
+	for {
+		select {
+		case chunk := <-chunks:
+			if callbackErr != nil {
+				continue
+			}
+
+			_, callbackErr = starlark.Call(thread, onOutput, starlark.Tuple{
+				starlark.String(chunk.Target),
+				starlark.String(chunk.Stream),
+				starlark.String(chunk.Data),
+			}, nil)
+		case err := <-done:
+			if err != nil {
+				return err
+			}
+			return callbackErr
+		}
+	}
+}
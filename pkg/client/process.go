@@ -0,0 +1,165 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Vbitz/raise/v2/pkg/proto"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// Processes lists the processes on the remote that match the filter.
+func (r *Remote) Processes(ctx context.Context, filter proto.ProcessFilter) ([]proto.ProcessInfo, error) {
+	var resp proto.SendMessageResp
+
+	err := r.sendMessage(ctx, proto.SendMessageReq{
+		Kind:   proto.MessageProcesses,
+		Filter: filter,
+	}, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list processes: %v", err)
+	}
+
+	return resp.Processes, nil
+}
+
+// Kill sends a signal such as "TERM" or "KILL" to a process on the remote.
+func (r *Remote) Kill(ctx context.Context, pid int, signal string) error {
+	if pid <= 0 {
+		return fmt.Errorf("invalid pid %d", pid)
+	}
+
+	var resp proto.SendMessageResp
+
+	err := r.sendMessage(ctx, proto.SendMessageReq{
+		Kind:   proto.MessageKill,
+		Pid:    pid,
+		Signal: signal,
+	}, &resp)
+	if err != nil {
+		return fmt.Errorf("failed to kill process %d: %v", pid, err)
+	}
+
+	return nil
+}
+
+// KillMatching sends a signal to every process on the remote that matches the filter
+// and returns the processes it was sent to. The filter can not be empty.
+func (r *Remote) KillMatching(ctx context.Context, filter proto.ProcessFilter, signal string) ([]proto.ProcessInfo, error) {
+	var resp proto.SendMessageResp
+
+	err := r.sendMessage(ctx, proto.SendMessageReq{
+		Kind:   proto.MessageKill,
+		Signal: signal,
+		Filter: filter,
+	}, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to kill processes: %v", err)
+	}
+
+	return resp.Processes, nil
+}
+
+func processInfoToStarlark(info proto.ProcessInfo) starlark.Value {
+	var commandLine []starlark.Value
+	for _, arg := range info.CommandLine {
+		commandLine = append(commandLine, starlark.String(arg))
+	}
+
+	startTime := ""
+	if !info.StartTime.IsZero() {
+		startTime = info.StartTime.Format(time.RFC3339)
+	}
+
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"pid":          starlark.MakeInt(info.Pid),
+		"ppid":         starlark.MakeInt(info.PPid),
+		"user":         starlark.String(info.User),
+		"uid":          starlark.MakeInt(info.Uid),
+		"command":      starlark.String(info.Command),
+		"command_line": starlark.NewList(commandLine),
+		"state":        starlark.String(info.State),
+		"cpu_time":     starlark.Float(info.CPUTime.Seconds()),
+		"rss":          starlark.MakeInt64(info.RSS),
+		"start_time":   starlark.String(startTime),
+	})
+}
+
+func processesToStarlark(processes []proto.ProcessInfo) starlark.Value {
+	var ret []starlark.Value
+
+	for _, info := range processes {
+		ret = append(ret, processInfoToStarlark(info))
+	}
+
+	return starlark.NewList(ret)
+}
+
+// processBuiltin returns Remote.processes or Remote.kill.
+func (r *Remote) processBuiltin(name string) starlark.Value {
+	return starlark.NewBuiltin("Remote."+name, func(
+		thread *starlark.Thread,
+		fn *starlark.Builtin,
+		args starlark.Tuple,
+		kwargs []starlark.Tuple,
+	) (starlark.Value, error) {
+		var (
+			pid    int
+			signal string = "TERM"
+			filter proto.ProcessFilter
+		)
+
+		var err error
+		if name == "kill" {
+			err = starlark.UnpackArgs("Remote.kill", args, kwargs,
+				"pid?", &pid,
+				"signal?", &signal,
+				"name?", &filter.Name,
+				"user?", &filter.User,
+				"command_line?", &filter.CommandLine,
+			)
+		} else {
+			err = starlark.UnpackArgs("Remote.processes", args, kwargs,
+				"name?", &filter.Name,
+				"user?", &filter.User,
+				"command_line?", &filter.CommandLine,
+			)
+		}
+		if err != nil {
+			return starlark.None, err
+		}
+
+		ctx := threadContext(thread)
+
+		if name == "processes" {
+			processes, err := r.Processes(ctx, filter)
+			if err != nil {
+				return starlark.None, err
+			}
+
+			return processesToStarlark(processes), nil
+		}
+
+		if pid != 0 {
+			if !filter.IsEmpty() {
+				return starlark.None, fmt.Errorf("Remote.kill: pass a pid or a filter, not both")
+			}
+
+			err := r.Kill(ctx, pid, signal)
+			if err != nil {
+				return starlark.None, err
+			}
+
+			return starlark.None, nil
+		}
+
+		processes, err := r.KillMatching(ctx, filter, signal)
+		if err != nil {
+			return starlark.None, err
+		}
+
+		return processesToStarlark(processes), nil
+	})
+}
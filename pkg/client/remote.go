@@ -1,12 +1,18 @@
 package client
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"os"
+	"time"
 
 	"github.com/Vbitz/raise/v2/pkg/proto"
+	"github.com/Vbitz/raise/v2/pkg/request"
 	"go.starlark.net/starlark"
 	"go.starlark.net/starlarkjson"
+	"go.starlark.net/starlarkstruct"
 )
 
 type Remote struct {
@@ -40,29 +46,59 @@ func (r *Remote) GetInfo() (*proto.GetInfoResp, error) {
 	return r.info, nil
 }
 
+// sendMessage sends a message to the remote with a fresh request ID so it can be cancelled through ctx.
+func (r *Remote) sendMessage(ctx context.Context, req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	req.Target = r.name
+	if req.RequestID == "" {
+		req.RequestID = request.NewID()
+	}
+
+	err := r.client.call(ctx, proto.Common_SendMessage, req.RequestID, req, resp)
+	if err != nil {
+		return err
+	}
+
+	return resp.FileErr()
+}
+
 func (r *Remote) ReadFile(filename string) ([]byte, error) {
-	var resp proto.SendMessageResp
+	return r.ReadFileContext(context.Background(), filename)
+}
 
-	err := r.client.rpcClient.Call(proto.Common_SendMessage, proto.SendMessageReq{
-		Target:   r.name,
-		Kind:     proto.MessageReadFile,
-		Filename: filename,
-	}, &resp)
+// ReadFileContext reads a file from the remote into memory. It is transferred in chunks
+// so it does not hold up the connection. Use Download for large files.
+func (r *Remote) ReadFileContext(ctx context.Context, filename string) ([]byte, error) {
+	var f memoryFile
+
+	err := r.download(ctx, filename, &f, TransferOptions{})
 	if err != nil {
-		return nil, fmt.Errorf("failed to call ReadFile: %v", err)
+		return nil, err
 	}
 
-	return resp.Content, nil
+	return f.data, nil
 }
 
 func (r *Remote) WriteFile(filename string, content []byte) error {
+	return r.WriteFileContext(context.Background(), filename, content, FileOptions{})
+}
+
+// WriteFileContext writes content to a file on the remote. Content larger than a single chunk
+// is transferred in chunks so it does not hold up the connection. Use Upload for large files.
+func (r *Remote) WriteFileContext(ctx context.Context, filename string, content []byte, opts FileOptions) error {
+	if len(content) > proto.TransferChunkSize {
+		return r.upload(ctx, bytes.NewReader(content), int64(len(content)), filename, TransferOptions{FileOptions: opts})
+	}
+
 	var resp proto.SendMessageResp
 
-	err := r.client.rpcClient.Call(proto.Common_SendMessage, proto.SendMessageReq{
-		Target:   r.name,
+	err := r.sendMessage(ctx, proto.SendMessageReq{
 		Kind:     proto.MessageWriteFile,
 		Filename: filename,
 		Content:  content,
+		Mode:     opts.Mode,
+		Owner:    opts.Owner,
+		Group:    opts.Group,
+		InPlace:  opts.InPlace,
 	}, &resp)
 	if err != nil {
 		return fmt.Errorf("failed to call WriteFile: %v", err)
@@ -71,19 +107,80 @@ func (r *Remote) WriteFile(filename string, content []byte) error {
 	return nil
 }
 
-func (r *Remote) RunScript(script string) ([]byte, error) {
+type RunScriptOptions struct {
+	// How long the worker lets the script run before killing it. Zero means no limit.
+	Timeout time.Duration
+	// Called with output as the script produces it. The client's default handler is used if nil.
+	OnOutput OutputHandler
+	// How long the server keeps the script for a worker that is offline. Only used by QueueScript and RunAll.
+	QueueFor time.Duration
+}
+
+// RunScript runs a script on the remote. A non-zero exit code is reported in the result, not as an error.
+func (r *Remote) RunScript(script string) (*proto.ScriptResult, error) {
+	return r.RunScriptContext(context.Background(), script, RunScriptOptions{})
+}
+
+// RunScriptContext is like RunScript but kills the script on the worker once ctx is cancelled.
+func (r *Remote) RunScriptContext(ctx context.Context, script string, opts RunScriptOptions) (*proto.ScriptResult, error) {
+	opts.QueueFor = 0
+
+	result, _, err := r.QueueScript(ctx, script, opts)
+	return result, err
+}
+
+// QueueScript is like RunScriptContext but if the remote is offline the server keeps the script for
+// opts.QueueFor and runs it once the remote connects. In that case the result is empty and the ID of the
+// queued message is returned instead. See Client.QueuedMessages for what became of it.
+func (r *Remote) QueueScript(ctx context.Context, script string, opts RunScriptOptions) (*proto.ScriptResult, string, error) {
 	var resp proto.SendMessageResp
 
-	err := r.client.rpcClient.Call(proto.Common_SendMessage, proto.SendMessageReq{
-		Target:  r.name,
-		Kind:    proto.MessageRunScript,
-		Content: []byte(script),
-	}, &resp)
+	req := proto.SendMessageReq{
+		Kind:      proto.MessageRunScript,
+		Content:   []byte(script),
+		Timeout:   opts.Timeout,
+		QueueFor:  opts.QueueFor,
+		RequestID: request.NewID(),
+	}
+
+	if r.client.addOutputHandler(req.RequestID, opts.OnOutput) {
+		defer r.client.removeOutputHandler(req.RequestID)
+
+		req.StreamOutput = true
+	}
+
+	err := r.sendMessage(ctx, req, &resp)
 	if err != nil {
-		return nil, fmt.Errorf("failed to call WriteFile: %v", err)
+		return nil, "", fmt.Errorf("failed to call RunScript: %v", err)
 	}
 
-	return resp.Content, nil
+	return &resp.ScriptResult, resp.QueuedID, nil
+}
+
+func scriptResultFields(result proto.ScriptResult) starlark.StringDict {
+	return starlark.StringDict{
+		"stdout":     starlark.String(result.Stdout),
+		"stderr":     starlark.String(result.Stderr),
+		"exit_code":  starlark.MakeInt(result.ExitCode),
+		"signal":     starlark.String(result.Signal),
+		"start_time": starlark.String(result.StartTime.Format(time.RFC3339Nano)),
+		"duration":   starlark.Float(result.Duration.Seconds()),
+		"timed_out":  starlark.Bool(result.TimedOut),
+	}
+}
+
+// checkScriptResult returns an error describing a script that did not exit cleanly.
+func checkScriptResult(name string, result proto.ScriptResult) error {
+	if result.TimedOut {
+		return fmt.Errorf("script on %s timed out after %s: %s", name, result.Duration, result.Stderr)
+	}
+	if result.Signal != "" {
+		return fmt.Errorf("script on %s killed by signal %s: %s", name, result.Signal, result.Stderr)
+	}
+	if result.ExitCode != 0 {
+		return fmt.Errorf("script on %s exited with code %d: %s", name, result.ExitCode, result.Stderr)
+	}
+	return nil
 }
 
 func (r *Remote) Attr(name string) (starlark.Value, error) {
@@ -145,7 +242,7 @@ func (r *Remote) Attr(name string) (starlark.Value, error) {
 				return starlark.None, err
 			}
 
-			content, err := r.ReadFile(filename)
+			content, err := r.ReadFileContext(threadContext(thread), filename)
 			if err != nil {
 				return starlark.None, err
 			}
@@ -162,15 +259,95 @@ func (r *Remote) Attr(name string) (starlark.Value, error) {
 			var (
 				filename string
 				content  string
+				mode     int
+				owner    string
+				group    string
+				atomic   = true
 			)
 			if err := starlark.UnpackArgs("Remote.write_file", args, kwargs,
 				"filename", &filename,
 				"content", &content,
+				"mode?", &mode,
+				"owner?", &owner,
+				"group?", &group,
+				"atomic?", &atomic,
 			); err != nil {
 				return starlark.None, err
 			}
 
-			err := r.WriteFile(filename, []byte(content))
+			err := r.WriteFileContext(threadContext(thread), filename, []byte(content), FileOptions{
+				Mode:    os.FileMode(mode),
+				Owner:   owner,
+				Group:   group,
+				InPlace: !atomic,
+			})
+			if err != nil {
+				return starlark.None, err
+			}
+
+			return starlark.None, nil
+		}), nil
+	} else if name == "upload" || name == "download" {
+		return starlark.NewBuiltin("Remote."+name, func(
+			thread *starlark.Thread,
+			fn *starlark.Builtin,
+			args starlark.Tuple,
+			kwargs []starlark.Tuple,
+		) (starlark.Value, error) {
+			var (
+				source      string
+				destination string
+				onProgress  starlark.Callable
+				chunkSize   int
+				retries     int
+				mode        int
+				owner       string
+				group       string
+			)
+			if err := starlark.UnpackArgs("Remote."+name, args, kwargs,
+				"source", &source,
+				"destination", &destination,
+				"on_progress?", &onProgress,
+				"chunk_size?", &chunkSize,
+				"retries?", &retries,
+				"mode?", &mode,
+				"owner?", &owner,
+				"group?", &group,
+			); err != nil {
+				return starlark.None, err
+			}
+
+			if name == "download" && (mode != 0 || owner != "" || group != "") {
+				return starlark.None, fmt.Errorf("Remote.download: mode, owner and group only apply to uploads")
+			}
+
+			opts := TransferOptions{
+				FileOptions: FileOptions{
+					Mode:  os.FileMode(mode),
+					Owner: owner,
+					Group: group,
+				},
+				ChunkSize: chunkSize,
+				Retries:   retries,
+			}
+
+			if onProgress != nil {
+				// Transfers run on the thread of the script so the callback can be called directly.
+				opts.Progress = func(transferred int64, total int64) error {
+					_, err := starlark.Call(thread, onProgress, starlark.Tuple{
+						starlark.MakeInt64(transferred),
+						starlark.MakeInt64(total),
+					}, nil)
+					return err
+				}
+			}
+
+			var err error
+			if name == "upload" {
+				err = r.Upload(threadContext(thread), source, destination, opts)
+			} else {
+				err = r.Download(threadContext(thread), source, destination, opts)
+			}
 			if err != nil {
 				return starlark.None, err
 			}
@@ -185,28 +362,78 @@ func (r *Remote) Attr(name string) (starlark.Value, error) {
 			kwargs []starlark.Tuple,
 		) (starlark.Value, error) {
 			var (
-				script string
+				script   string
+				check    bool
+				timeout  starlark.Value
+				onOutput starlark.Callable
+				queueFor starlark.Value
 			)
 			if err := starlark.UnpackArgs("Remote.run_script", args, kwargs,
 				"script", &script,
+				"check?", &check,
+				"timeout?", &timeout,
+				"on_output?", &onOutput,
+				"queue_for?", &queueFor,
 			); err != nil {
 				return starlark.None, err
 			}
 
-			result, err := r.RunScript(script)
+			timeoutDuration, err := secondsToDuration(timeout)
 			if err != nil {
 				return starlark.None, err
 			}
 
-			return starlark.String(result), nil
+			queueForDuration, err := secondsToDuration(queueFor)
+			if err != nil {
+				return starlark.None, err
+			}
+
+			var (
+				result   *proto.ScriptResult
+				queuedID string
+			)
+
+			err = runWithOutput(thread, onOutput, func(handler OutputHandler) error {
+				var err error
+				result, queuedID, err = r.QueueScript(threadContext(thread), script, RunScriptOptions{
+					Timeout:  timeoutDuration,
+					OnOutput: handler,
+					QueueFor: queueForDuration,
+				})
+				return err
+			})
+			if err != nil {
+				return starlark.None, err
+			}
+
+			if check && queuedID == "" {
+				if err := checkScriptResult(r.name, *result); err != nil {
+					return starlark.None, err
+				}
+			}
+
+			fields := scriptResultFields(*result)
+			fields["queued"] = starlark.String(queuedID)
+
+			return starlarkstruct.FromStringDict(starlarkstruct.Default, fields), nil
 		}), nil
+	} else if name == "sync" || name == "sync_from" {
+		return r.syncBuiltin(name), nil
+	} else if name == "extract" || name == "pack" {
+		return r.archiveBuiltin(name), nil
+	} else if name == "processes" || name == "kill" {
+		return r.processBuiltin(name), nil
+	} else if fn := r.fileAttr(name); fn != nil {
+		return fn, nil
+	} else if fn := r.jobAttr(name); fn != nil {
+		return fn, nil
 	} else {
 		return nil, nil
 	}
 }
 
 func (*Remote) AttrNames() []string {
-	return []string{"ping", "info", "read_file", "write_file", "run_script"}
+	return append([]string{"ping", "info", "read_file", "write_file", "upload", "download", "sync", "sync_from", "extract", "pack", "processes", "kill", "run_script"}, append(fileAttrNames, jobAttrNames...)...)
 }
 
 func (*Remote) String() string       { return "Remote" }
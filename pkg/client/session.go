@@ -0,0 +1,239 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/Vbitz/raise/v2/pkg/proto"
+	"github.com/Vbitz/raise/v2/pkg/request"
+	"github.com/cenkalti/rpc2"
+)
+
+// Session is a long lived session on a remote such as an interactive shell.
+// Reading from the session returns its output and writing to it sends input.
+type Session struct {
+	client *Client
+	id     string
+
+	output       *io.PipeReader
+	outputWriter *io.PipeWriter
+
+	once   sync.Once
+	done   chan struct{}
+	result proto.CloseSessionReq
+}
+
+func (s *Session) Read(p []byte) (int, error) {
+	return s.output.Read(p)
+}
+
+func (s *Session) Write(p []byte) (int, error) {
+	err := s.send(proto.SessionData{Data: p})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// CloseWrite tells the remote nothing more will be written. A forward session half-closes its connection.
+// Reading keeps returning what the remote sends until it is done as well.
+func (s *Session) CloseWrite() error {
+	return s.send(proto.SessionData{EOF: true})
+}
+
+// Resize tells the remote terminal about a new window size.
+func (s *Session) Resize(rows uint16, cols uint16) error {
+	return s.send(proto.SessionData{Rows: rows, Cols: cols})
+}
+
+// Signal sends a signal such as "SIGINT" to the foreground process of the session.
+func (s *Session) Signal(name string) error {
+	return s.send(proto.SessionData{Signal: name})
+}
+
+func (s *Session) send(event proto.SessionData) error {
+	event.SessionID = s.id
+
+	var resp proto.SessionDataResp
+	return s.client.rpcClient.Call(proto.Common_SessionData, event, &resp)
+}
+
+// Close ends the session and kills whatever is running in it.
+func (s *Session) Close() error {
+	select {
+	case <-s.done:
+		return nil
+	default:
+	}
+
+	var resp proto.CloseSessionResp
+	err := s.client.rpcClient.Call(proto.Common_CloseSession, proto.CloseSessionReq{
+		SessionID: s.id,
+	}, &resp)
+
+	s.finish(proto.CloseSessionReq{SessionID: s.id, ExitCode: -1, Error: "session closed"})
+
+	return err
+}
+
+// Done is closed once the session has ended.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Wait waits for the session to end and returns the exit code of the command running in it.
+func (s *Session) Wait() (int, error) {
+	<-s.done
+
+	if s.result.Error != "" {
+		return s.result.ExitCode, fmt.Errorf("%s", s.result.Error)
+	}
+
+	return s.result.ExitCode, nil
+}
+
+func (s *Session) finish(result proto.CloseSessionReq) {
+	s.once.Do(func() {
+		s.client.removeSession(s.id)
+
+		s.result = result
+		s.outputWriter.Close()
+		close(s.done)
+	})
+}
+
+type ShellOptions struct {
+	// The value of TERM for the shell.
+	Term string
+	// The initial window size.
+	Rows uint16
+	Cols uint16
+	// The command to run. The login shell of the worker user is used if empty.
+	Command string
+}
+
+// OpenShell starts an interactive shell in a pseudo-terminal on the remote.
+func (r *Remote) OpenShell(opts ShellOptions) (*Session, error) {
+	return r.openSession(proto.OpenSessionReq{
+		Kind:    proto.SessionShell,
+		Term:    opts.Term,
+		Rows:    opts.Rows,
+		Cols:    opts.Cols,
+		Command: opts.Command,
+	})
+}
+
+// OpenForward makes the remote connect to address, a host:port reachable from the remote.
+// Data written to the session is sent over the connection and reading returns what comes back.
+// The server only allows it if the forwarding policy for the client permits the address.
+func (r *Remote) OpenForward(address string) (*Session, error) {
+	return r.openSession(proto.OpenSessionReq{
+		Kind:    proto.SessionForward,
+		Address: address,
+	})
+}
+
+func (r *Remote) openSession(req proto.OpenSessionReq) (*Session, error) {
+	output, outputWriter := io.Pipe()
+
+	s := &Session{
+		client:       r.client,
+		id:           request.NewID(),
+		output:       output,
+		outputWriter: outputWriter,
+		done:         make(chan struct{}),
+	}
+
+	r.client.addSession(s)
+
+	req.Target = r.name
+	req.SessionID = s.id
+
+	var resp proto.OpenSessionResp
+	err := r.client.rpcClient.Call(proto.Common_OpenSession, req, &resp)
+	if err != nil {
+		r.client.removeSession(s.id)
+
+		return nil, fmt.Errorf("failed to call OpenSession: %v", err)
+	}
+
+	return s, nil
+}
+
+func (c *Client) addSession(s *Session) {
+	c.sessionMtx.Lock()
+	defer c.sessionMtx.Unlock()
+
+	if c.sessions == nil {
+		c.sessions = make(map[string]*Session)
+	}
+	c.sessions[s.id] = s
+}
+
+func (c *Client) removeSession(id string) {
+	c.sessionMtx.Lock()
+	defer c.sessionMtx.Unlock()
+
+	delete(c.sessions, id)
+}
+
+func (c *Client) getSession(id string) *Session {
+	c.sessionMtx.Lock()
+	defer c.sessionMtx.Unlock()
+
+	return c.sessions[id]
+}
+
+// closeSessions ends every open session when the connection to the server goes away.
+func (c *Client) closeSessions() {
+	c.sessionMtx.Lock()
+	var sessions []*Session
+	for _, s := range c.sessions {
+		sessions = append(sessions, s)
+	}
+	c.sessionMtx.Unlock()
+
+	for _, s := range sessions {
+		s.finish(proto.CloseSessionReq{SessionID: s.id, ExitCode: -1, Error: "connection to server lost"})
+	}
+}
+
+// SessionData implements proto.ClientCallbackService
+func (c *Client) SessionData(client *rpc2.Client, req proto.SessionData, resp *proto.SessionDataResp) error {
+	*resp = proto.SessionDataResp{}
+
+	s := c.getSession(req.SessionID)
+	if s == nil {
+		return fmt.Errorf("session %s does not exist", req.SessionID)
+	}
+
+	// Blocks until the output is read so a slow reader slows down the remote.
+	_, err := s.outputWriter.Write(req.Data)
+	if err == io.ErrClosedPipe {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// The remote is done sending. Reads return EOF while the session stays open for writing.
+	if req.EOF {
+		s.outputWriter.Close()
+	}
+
+	return nil
+}
+
+// CloseSession implements proto.ClientCallbackService
+func (c *Client) CloseSession(client *rpc2.Client, req proto.CloseSessionReq, resp *proto.CloseSessionResp) error {
+	*resp = proto.CloseSessionResp{}
+
+	s := c.getSession(req.SessionID)
+	if s == nil {
+		return nil
+	}
+
+	s.finish(req)
+
+	return nil
+}
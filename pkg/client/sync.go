@@ -0,0 +1,427 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/Vbitz/raise/v2/pkg/manifest"
+	"github.com/Vbitz/raise/v2/pkg/proto"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+type SyncAction string
+
+var (
+	SyncMkdir   SyncAction = "mkdir"
+	SyncCopy    SyncAction = "copy"
+	SyncChmod   SyncAction = "chmod"
+	SyncSymlink SyncAction = "symlink"
+	SyncDelete  SyncAction = "delete"
+)
+
+// SyncChange is one step of a sync. Path is relative to the destination directory.
+type SyncChange struct {
+	Action     SyncAction
+	Path       string
+	Type       proto.FileType
+	Size       int64
+	Mode       os.FileMode
+	LinkTarget string
+}
+
+type SyncOptions struct {
+	// Remove anything in the destination that is not in the source.
+	// Excluded paths are never removed.
+	Delete bool
+	// Patterns of paths to leave alone. See manifest.Excluded.
+	Exclude []string
+	// Only work out the changes without making them.
+	DryRun bool
+}
+
+// planSync works out the changes that make dst look like src. Both are manifests of the two trees.
+func planSync(src []proto.FileInfo, dst []proto.FileInfo, opts SyncOptions) []SyncChange {
+	existing := make(map[string]proto.FileInfo)
+	for _, info := range dst {
+		existing[info.Path] = info
+	}
+
+	wanted := make(map[string]bool)
+	// Directories that are removed as a whole so nothing inside them needs its own change.
+	var removed []string
+
+	var changes []SyncChange
+
+	for _, info := range src {
+		wanted[info.Path] = true
+
+		change := SyncChange{
+			Path:       info.Path,
+			Type:       info.Type,
+			Size:       info.Size,
+			Mode:       info.Mode.Perm(),
+			LinkTarget: info.LinkTarget,
+		}
+
+		old, ok := existing[info.Path]
+		if ok && old.Type != info.Type {
+			changes = append(changes, SyncChange{Action: SyncDelete, Path: old.Path, Type: old.Type})
+			removed = append(removed, old.Path)
+			ok = false
+		}
+
+		switch info.Type {
+		case proto.FileTypeDir:
+			if !ok {
+				change.Action = SyncMkdir
+			} else if old.Mode.Perm() != info.Mode.Perm() {
+				change.Action = SyncChmod
+			}
+		case proto.FileTypeFile:
+			if !ok || old.Size != info.Size || old.Checksum != info.Checksum {
+				change.Action = SyncCopy
+			} else if old.Mode.Perm() != info.Mode.Perm() {
+				change.Action = SyncChmod
+			}
+		case proto.FileTypeSymlink:
+			if ok && old.LinkTarget != info.LinkTarget {
+				changes = append(changes, SyncChange{Action: SyncDelete, Path: old.Path, Type: old.Type})
+				ok = false
+			}
+			if !ok {
+				change.Action = SyncSymlink
+			}
+		}
+
+		if change.Action != "" {
+			changes = append(changes, change)
+		}
+	}
+
+	if opts.Delete {
+		// dst is in lexical order so directories come before their contents.
+		for _, info := range dst {
+			if wanted[info.Path] || insideAny(info.Path, removed) {
+				continue
+			}
+
+			changes = append(changes, SyncChange{Action: SyncDelete, Path: info.Path, Type: info.Type})
+			if info.Type == proto.FileTypeDir {
+				removed = append(removed, info.Path)
+			}
+		}
+	}
+
+	return changes
+}
+
+// insideAny reports whether rel is inside one of the directories.
+func insideAny(rel string, dirs []string) bool {
+	for _, dir := range dirs {
+		if strings.HasPrefix(rel, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// syncDestination makes the changes of a sync on one end.
+type syncDestination interface {
+	prepare() error
+	apply(change SyncChange) error
+}
+
+// remoteDestination applies changes to the remote by copying from a local directory.
+type remoteDestination struct {
+	ctx    context.Context
+	remote *Remote
+	source string
+	root   string
+}
+
+func (d *remoteDestination) prepare() error {
+	return d.remote.Mkdir(d.ctx, d.root, 0, true)
+}
+
+func (d *remoteDestination) apply(change SyncChange) error {
+	filename := path.Join(d.root, change.Path)
+
+	switch change.Action {
+	case SyncMkdir:
+		return d.remote.Mkdir(d.ctx, filename, change.Mode, false)
+	case SyncCopy:
+		return d.remote.Upload(d.ctx, filepath.Join(d.source, filepath.FromSlash(change.Path)), filename, TransferOptions{
+			FileOptions: FileOptions{Mode: change.Mode},
+		})
+	case SyncChmod:
+		return d.remote.Chmod(d.ctx, filename, change.Mode)
+	case SyncSymlink:
+		return d.remote.Symlink(d.ctx, change.LinkTarget, filename)
+	case SyncDelete:
+		return d.remote.Remove(d.ctx, filename, true)
+	default:
+		return fmt.Errorf("unknown sync action: %s", change.Action)
+	}
+}
+
+// localDestination applies changes to a local directory by copying from the remote.
+type localDestination struct {
+	ctx    context.Context
+	remote *Remote
+	source string
+	root   string
+}
+
+func (d *localDestination) prepare() error {
+	return os.MkdirAll(d.root, 0755)
+}
+
+// localPath returns where the change to the slash separated path rel is made under root. The remote
+// picks the paths and the targets of the links it creates, so a path leaving root or inside a symbolic
+// link is refused. Otherwise an earlier change could create a link that a later one writes through.
+func localPath(root string, rel string) (string, error) {
+	if rel == "" || path.IsAbs(rel) || filepath.IsAbs(rel) {
+		return "", fmt.Errorf("invalid path %q", rel)
+	}
+
+	parts := strings.Split(rel, "/")
+	for _, part := range parts {
+		if part == "" || part == "." || part == ".." || strings.ContainsRune(part, filepath.Separator) {
+			return "", fmt.Errorf("invalid path %q", rel)
+		}
+	}
+
+	dir := root
+	for _, part := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, part)
+
+		fi, err := os.Lstat(dir)
+		if errors.Is(err, os.ErrNotExist) {
+			break
+		} else if err != nil {
+			return "", err
+		}
+
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("%s is inside the symbolic link %s", rel, dir)
+		}
+	}
+
+	return filepath.Join(root, filepath.FromSlash(rel)), nil
+}
+
+func (d *localDestination) apply(change SyncChange) error {
+	filename, err := localPath(d.root, change.Path)
+	if err != nil {
+		return err
+	}
+
+	switch change.Action {
+	case SyncMkdir:
+		if err := os.Mkdir(filename, change.Mode); err != nil {
+			return err
+		}
+		// Mkdir applies the umask.
+		return os.Chmod(filename, change.Mode)
+	case SyncCopy:
+		err := d.remote.Download(d.ctx, path.Join(d.source, change.Path), filename, TransferOptions{})
+		if err != nil {
+			return err
+		}
+		return os.Chmod(filename, change.Mode)
+	case SyncChmod:
+		return os.Chmod(filename, change.Mode)
+	case SyncSymlink:
+		return os.Symlink(change.LinkTarget, filename)
+	case SyncDelete:
+		return os.RemoveAll(filename)
+	default:
+		return fmt.Errorf("unknown sync action: %s", change.Action)
+	}
+}
+
+func runSync(src []proto.FileInfo, dst []proto.FileInfo, destination syncDestination, opts SyncOptions) ([]SyncChange, error) {
+	changes := planSync(src, dst, opts)
+
+	if opts.DryRun {
+		return changes, nil
+	}
+
+	if err := destination.prepare(); err != nil {
+		return nil, err
+	}
+
+	for i, change := range changes {
+		if err := destination.apply(change); err != nil {
+			return changes[:i], fmt.Errorf("failed to %s %s: %v", change.Action, change.Path, err)
+		}
+	}
+
+	return changes, nil
+}
+
+// remoteManifest describes a directory on the remote. A missing directory is empty.
+func (r *Remote) remoteManifest(ctx context.Context, dirname string, exclude []string) ([]proto.FileInfo, error) {
+	var resp proto.SendMessageResp
+
+	err := r.fileOperation(ctx, "manifest", proto.SendMessageReq{
+		Kind:     proto.MessageManifest,
+		Filename: dirname,
+		Exclude:  exclude,
+	}, &resp)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return resp.Files, nil
+}
+
+// Sync makes remoteDir on the remote look like localDir. Only files whose content differs are transferred.
+// It returns the changes that were made, or would be made for a dry run.
+func (r *Remote) Sync(ctx context.Context, localDir string, remoteDir string, opts SyncOptions) ([]SyncChange, error) {
+	src, err := manifest.Build(localDir, opts.Exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	dst, err := r.remoteManifest(ctx, remoteDir, opts.Exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	return runSync(src, dst, &remoteDestination{
+		ctx:    ctx,
+		remote: r,
+		source: localDir,
+		root:   remoteDir,
+	}, opts)
+}
+
+// SyncFrom makes localDir look like remoteDir on the remote. It is the reverse of Sync.
+func (r *Remote) SyncFrom(ctx context.Context, remoteDir string, localDir string, opts SyncOptions) ([]SyncChange, error) {
+	src, err := r.remoteManifest(ctx, remoteDir, opts.Exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	if src == nil {
+		if _, err := r.Stat(ctx, remoteDir); err != nil {
+			return nil, err
+		}
+	}
+
+	dst, err := manifest.Build(localDir, opts.Exclude)
+	if errors.Is(err, os.ErrNotExist) {
+		dst = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return runSync(src, dst, &localDestination{
+		ctx:    ctx,
+		remote: r,
+		source: remoteDir,
+		root:   localDir,
+	}, opts)
+}
+
+// stringList converts a Starlark list or tuple of strings.
+func stringList(value starlark.Value) ([]string, error) {
+	if value == nil || value == starlark.None {
+		return nil, nil
+	}
+
+	iterable, ok := value.(starlark.Iterable)
+	if !ok {
+		return nil, fmt.Errorf("got %s, want list of strings", value.Type())
+	}
+
+	var ret []string
+
+	iter := iterable.Iterate()
+	defer iter.Done()
+
+	var item starlark.Value
+	for iter.Next(&item) {
+		str, ok := starlark.AsString(item)
+		if !ok {
+			return nil, fmt.Errorf("got %s, want string", item.Type())
+		}
+		ret = append(ret, str)
+	}
+
+	return ret, nil
+}
+
+func syncChangeToStarlark(change SyncChange) starlark.Value {
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"action": starlark.String(change.Action),
+		"path":   starlark.String(change.Path),
+		"type":   starlark.String(change.Type),
+		"size":   starlark.MakeInt64(change.Size),
+	})
+}
+
+// syncBuiltin returns Remote.sync or Remote.sync_from.
+func (r *Remote) syncBuiltin(name string) starlark.Value {
+	return starlark.NewBuiltin("Remote."+name, func(
+		thread *starlark.Thread,
+		fn *starlark.Builtin,
+		args starlark.Tuple,
+		kwargs []starlark.Tuple,
+	) (starlark.Value, error) {
+		var (
+			source      string
+			destination string
+			delete      bool
+			exclude     starlark.Value
+			dryRun      bool
+		)
+		if err := starlark.UnpackArgs("Remote."+name, args, kwargs,
+			"source", &source,
+			"destination", &destination,
+			"delete?", &delete,
+			"exclude?", &exclude,
+			"dry_run?", &dryRun,
+		); err != nil {
+			return starlark.None, err
+		}
+
+		patterns, err := stringList(exclude)
+		if err != nil {
+			return starlark.None, fmt.Errorf("Remote.%s: exclude: %v", name, err)
+		}
+
+		opts := SyncOptions{
+			Delete:  delete,
+			Exclude: patterns,
+			DryRun:  dryRun,
+		}
+
+		var changes []SyncChange
+		if name == "sync" {
+			changes, err = r.Sync(threadContext(thread), source, destination, opts)
+		} else {
+			changes, err = r.SyncFrom(threadContext(thread), source, destination, opts)
+		}
+		if err != nil {
+			return starlark.None, err
+		}
+
+		var ret []starlark.Value
+
+		for _, change := range changes {
+			ret = append(ret, syncChangeToStarlark(change))
+		}
+
+		return starlark.NewList(ret), nil
+	})
+}
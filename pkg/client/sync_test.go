@@ -0,0 +1,197 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Vbitz/raise/v2/pkg/proto"
+)
+
+func TestLocalSyncStaysInside(t *testing.T) {
+	tests := []struct {
+		name string
+		// Applied in order. Only the last one is expected to fail.
+		changes []SyncChange
+	}{
+		{"directory through link", []SyncChange{
+			{Action: SyncSymlink, Path: "link", LinkTarget: "OUTSIDE"},
+			{Action: SyncMkdir, Path: "link/dir", Mode: 0755},
+		}},
+		{"delete through link", []SyncChange{
+			{Action: SyncSymlink, Path: "link", LinkTarget: "OUTSIDE"},
+			{Action: SyncDelete, Path: "link/victim"},
+		}},
+		{"chmod through link", []SyncChange{
+			{Action: SyncSymlink, Path: "link", LinkTarget: "OUTSIDE"},
+			{Action: SyncChmod, Path: "link/victim", Mode: 0777},
+		}},
+		{"copy through nested link", []SyncChange{
+			{Action: SyncMkdir, Path: "a", Mode: 0755},
+			{Action: SyncSymlink, Path: "a/link", LinkTarget: "OUTSIDE"},
+			{Action: SyncCopy, Path: "a/link/victim", Mode: 0644},
+		}},
+		{"parent directory", []SyncChange{
+			{Action: SyncDelete, Path: "../victim"},
+		}},
+		{"parent directory inside", []SyncChange{
+			{Action: SyncMkdir, Path: "a", Mode: 0755},
+			{Action: SyncDelete, Path: "a/../../victim"},
+		}},
+		{"absolute", []SyncChange{
+			{Action: SyncDelete, Path: "/victim"},
+		}},
+		{"empty", []SyncChange{
+			{Action: SyncDelete, Path: ""},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := t.TempDir()
+
+			outside := filepath.Join(base, "outside")
+			if err := os.Mkdir(outside, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			victim := filepath.Join(outside, "victim")
+			if err := os.WriteFile(victim, []byte("keep"), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			root := filepath.Join(base, "root")
+			d := &localDestination{root: root}
+
+			if err := d.prepare(); err != nil {
+				t.Fatal(err)
+			}
+
+			last := len(tt.changes) - 1
+			for i, change := range tt.changes {
+				if change.LinkTarget == "OUTSIDE" {
+					change.LinkTarget = outside
+				}
+
+				err := d.apply(change)
+				if i < last && err != nil {
+					t.Fatalf("%s %s: %v", change.Action, change.Path, err)
+				} else if i == last && err == nil {
+					t.Fatalf("%s %s was allowed", change.Action, change.Path)
+				}
+			}
+
+			fi, err := os.Stat(victim)
+			if err != nil {
+				t.Fatalf("file outside the destination was removed: %v", err)
+			}
+
+			if fi.Mode().Perm() != 0600 {
+				t.Fatalf("mode of file outside the destination changed to %o", fi.Mode().Perm())
+			}
+
+			entries, err := os.ReadDir(outside)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(entries) != 1 {
+				t.Fatalf("files were created outside the destination: %v", entries)
+			}
+		})
+	}
+}
+
+func TestLocalSyncKeepsLinks(t *testing.T) {
+	root := t.TempDir()
+	d := &localDestination{root: root}
+
+	changes := []SyncChange{
+		{Action: SyncMkdir, Path: "lib", Mode: 0755, Type: proto.FileTypeDir},
+		{Action: SyncSymlink, Path: "lib/current", LinkTarget: "../versions/1", Type: proto.FileTypeSymlink},
+		{Action: SyncSymlink, Path: "etc", LinkTarget: "/etc", Type: proto.FileTypeSymlink},
+		{Action: SyncDelete, Path: "etc", Type: proto.FileTypeSymlink},
+	}
+
+	for _, change := range changes {
+		if err := d.apply(change); err != nil {
+			t.Fatalf("%s %s: %v", change.Action, change.Path, err)
+		}
+	}
+
+	target, err := os.Readlink(filepath.Join(root, "lib", "current"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if target != "../versions/1" {
+		t.Fatalf("link points to %s, want ../versions/1", target)
+	}
+
+	if _, err := os.Stat("/etc"); err != nil {
+		t.Fatalf("deleting a link removed what it points to: %v", err)
+	}
+}
+
+func TestPlanSync(t *testing.T) {
+	file := func(path string, checksum string, mode os.FileMode) proto.FileInfo {
+		return proto.FileInfo{Path: path, Type: proto.FileTypeFile, Size: int64(len(checksum)), Checksum: checksum, Mode: mode}
+	}
+	dir := func(path string, mode os.FileMode) proto.FileInfo {
+		return proto.FileInfo{Path: path, Type: proto.FileTypeDir, Mode: os.ModeDir | mode}
+	}
+	link := func(path string, target string) proto.FileInfo {
+		return proto.FileInfo{Path: path, Type: proto.FileTypeSymlink, LinkTarget: target, Mode: os.ModeSymlink | 0777}
+	}
+
+	tests := []struct {
+		name   string
+		src    []proto.FileInfo
+		dst    []proto.FileInfo
+		delete bool
+		want   []string
+	}{
+		{"empty destination",
+			[]proto.FileInfo{dir("a", 0755), file("a/x", "1", 0644), link("l", "a")},
+			nil, false,
+			[]string{"mkdir a", "copy a/x", "symlink l"}},
+		{"unchanged",
+			[]proto.FileInfo{dir("a", 0755), file("a/x", "1", 0644), link("l", "a")},
+			[]proto.FileInfo{dir("a", 0755), file("a/x", "1", 0644), link("l", "a")}, true,
+			nil},
+		{"content and mode",
+			[]proto.FileInfo{file("x", "2", 0644), file("y", "1", 0600), dir("d", 0700)},
+			[]proto.FileInfo{dir("d", 0755), file("x", "1", 0644), file("y", "1", 0644)}, false,
+			[]string{"copy x", "chmod y", "chmod d"}},
+		{"link target",
+			[]proto.FileInfo{link("l", "b")},
+			[]proto.FileInfo{link("l", "a")}, false,
+			[]string{"delete l", "symlink l"}},
+		{"type changed",
+			[]proto.FileInfo{file("a", "1", 0644)},
+			[]proto.FileInfo{dir("a", 0755), file("a/x", "1", 0644)}, true,
+			[]string{"delete a", "copy a"}},
+		{"extra files kept",
+			[]proto.FileInfo{file("x", "1", 0644)},
+			[]proto.FileInfo{dir("d", 0755), file("d/y", "1", 0644), file("x", "1", 0644)}, false,
+			nil},
+		{"extra files deleted",
+			[]proto.FileInfo{file("x", "1", 0644)},
+			[]proto.FileInfo{dir("d", 0755), file("d/y", "1", 0644), file("x", "1", 0644), file("z", "1", 0644)}, true,
+			[]string{"delete d", "delete z"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, change := range planSync(tt.src, tt.dst, SyncOptions{Delete: tt.delete}) {
+				got = append(got, string(change.Action)+" "+change.Path)
+			}
+
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,377 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/Vbitz/raise/v2/pkg/proto"
+)
+
+// ProgressFunc is called after every chunk of a transfer. Returning an error aborts the transfer.
+type ProgressFunc func(transferred int64, total int64) error
+
+// FileOptions controls how a file is written on the remote.
+type FileOptions struct {
+	// The permission bits of the file. Zero keeps the mode of the file being replaced or uses 0644 for a new file.
+	Mode os.FileMode
+	// The user and group that own the file as names or numeric ids. Empty keeps the worker default.
+	Owner string
+	Group string
+	// Write the file directly instead of to a temporary file that is renamed into place so the
+	// file is never left half written. Uploads always use a temporary file.
+	InPlace bool
+}
+
+type TransferOptions struct {
+	FileOptions
+
+	// The size of each chunk. proto.TransferChunkSize is used if zero and larger sizes are lowered to
+	// proto.MaxTransferChunkSize.
+	ChunkSize int
+	// How many times the transfer is resumed after failing before giving up.
+	Retries int
+	// Called with the number of bytes transferred so far.
+	Progress ProgressFunc
+}
+
+// transferFile is the destination of a download.
+type transferFile interface {
+	io.ReaderAt
+	io.WriterAt
+
+	Size() (int64, error)
+	Truncate(size int64) error
+}
+
+type diskFile struct {
+	*os.File
+}
+
+func (f diskFile) Size() (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// memoryFile is a transferFile used to download straight into memory.
+type memoryFile struct {
+	data []byte
+}
+
+func (f *memoryFile) ReadAt(p []byte, off int64) (int, error) {
+	return bytes.NewReader(f.data).ReadAt(p, off)
+}
+
+func (f *memoryFile) WriteAt(p []byte, off int64) (int, error) {
+	if end := off + int64(len(p)); end > int64(len(f.data)) {
+		f.data = append(f.data, make([]byte, end-int64(len(f.data)))...)
+	}
+	return copy(f.data[off:], p), nil
+}
+
+func (f *memoryFile) Size() (int64, error) {
+	return int64(len(f.data)), nil
+}
+
+func (f *memoryFile) Truncate(size int64) error {
+	f.data = f.data[:size]
+	return nil
+}
+
+// checksumReader returns the hex encoded SHA-256 of the first size bytes of r.
+func checksumReader(r io.ReaderAt, size int64) (string, error) {
+	h := sha256.New()
+
+	_, err := io.Copy(h, io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func checksumBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// retryTransfer calls fn until it succeeds, asks not to be retried or runs out of retries.
+// Every attempt picks up from where the last one stopped.
+func retryTransfer(ctx context.Context, retries int, fn func() (retry bool, err error)) error {
+	for attempt := 0; ; attempt++ {
+		retry, err := fn()
+		if err == nil || !retry || attempt >= retries || ctx.Err() != nil {
+			return err
+		}
+
+		select {
+		case <-time.After(time.Duration(attempt+1) * time.Second):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+func (opts TransferOptions) chunkSize() int {
+	if opts.ChunkSize <= 0 {
+		return proto.TransferChunkSize
+	} else if opts.ChunkSize > proto.MaxTransferChunkSize {
+		// The worker refuses larger chunks.
+		return proto.MaxTransferChunkSize
+	}
+	return opts.ChunkSize
+}
+
+// Upload copies a local file to filename on the remote one chunk at a time.
+// The file is only replaced once every chunk has arrived. An upload that fails part way
+// through is resumed by uploading the same file again.
+func (r *Remote) Upload(ctx context.Context, localFilename string, filename string, opts TransferOptions) error {
+	f, err := os.Open(localFilename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	return r.upload(ctx, f, info.Size(), filename, opts)
+}
+
+func (r *Remote) upload(ctx context.Context, src io.ReaderAt, size int64, filename string, opts TransferOptions) error {
+	checksum, err := checksumReader(src, size)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, opts.chunkSize())
+
+	return retryTransfer(ctx, opts.Retries, func() (bool, error) {
+		id, offset, err := r.resumeUpload(ctx, src, size, checksum, filename)
+		if err != nil {
+			return true, err
+		}
+
+		for offset < size {
+			chunk := buf
+			if remaining := size - offset; remaining < int64(len(chunk)) {
+				chunk = chunk[:remaining]
+			}
+
+			n, err := src.ReadAt(chunk, offset)
+			if n < len(chunk) {
+				return false, err
+			}
+
+			var resp proto.SendMessageResp
+			err = r.sendMessage(ctx, proto.SendMessageReq{
+				Kind:     proto.MessageWriteChunk,
+				Filename: filename,
+				Offset:   offset,
+				Content:  chunk,
+				Checksum: checksumBytes(chunk),
+				UploadID: id,
+			}, &resp)
+			if err != nil {
+				return true, fmt.Errorf("failed to upload %s: %v", filename, err)
+			}
+
+			offset += int64(n)
+
+			if opts.Progress != nil {
+				if err := opts.Progress(offset, size); err != nil {
+					return false, err
+				}
+			}
+		}
+
+		var resp proto.SendMessageResp
+		err = r.sendMessage(ctx, proto.SendMessageReq{
+			Kind:     proto.MessageFinishWrite,
+			Filename: filename,
+			Length:   size,
+			Checksum: checksum,
+			UploadID: id,
+			Mode:     opts.Mode,
+			Owner:    opts.Owner,
+			Group:    opts.Group,
+		}, &resp)
+		if err != nil {
+			return true, fmt.Errorf("failed to finish upload of %s: %v", filename, err)
+		}
+
+		return false, nil
+	})
+}
+
+// resumeUpload returns the ID of the upload on the remote and the offset to continue it from.
+// It only continues an earlier upload if what the remote has matches the start of src.
+func (r *Remote) resumeUpload(ctx context.Context, src io.ReaderAt, size int64, checksum string, filename string) (string, int64, error) {
+	var resp proto.SendMessageResp
+
+	err := r.sendMessage(ctx, proto.SendMessageReq{
+		Kind:     proto.MessageStatUpload,
+		Filename: filename,
+		Length:   size,
+		Checksum: checksum,
+	}, &resp)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to check upload of %s: %v", filename, err)
+	}
+
+	if resp.Size == 0 || resp.Size > size {
+		return resp.UploadID, 0, nil
+	}
+
+	prefix, err := checksumReader(src, resp.Size)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if prefix != resp.Checksum {
+		return resp.UploadID, 0, nil
+	}
+
+	return resp.UploadID, resp.Size, nil
+}
+
+// Download copies filename on the remote to a local file one chunk at a time.
+// The data is written to localFilename with a .part suffix and renamed once it is complete.
+// A download that fails part way through is resumed by downloading the same file again.
+func (r *Remote) Download(ctx context.Context, filename string, localFilename string, opts TransferOptions) error {
+	partial := localFilename + ".part"
+
+	f, err := os.OpenFile(partial, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = r.download(ctx, filename, diskFile{f}, opts)
+	if err != nil {
+		// Keep what was downloaded so the next attempt can resume from it.
+		if size, sizeErr := (diskFile{f}).Size(); sizeErr == nil && size == 0 {
+			os.Remove(partial)
+		}
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(partial, localFilename)
+}
+
+func (r *Remote) download(ctx context.Context, filename string, dst transferFile, opts TransferOptions) error {
+	return retryTransfer(ctx, opts.Retries, func() (bool, error) {
+		offset, err := r.resumeDownload(ctx, filename, dst)
+		if err != nil {
+			return true, err
+		}
+
+		for {
+			var resp proto.SendMessageResp
+			err := r.sendMessage(ctx, proto.SendMessageReq{
+				Kind:     proto.MessageReadChunk,
+				Filename: filename,
+				Offset:   offset,
+				Length:   int64(opts.chunkSize()),
+			}, &resp)
+			if err != nil {
+				return true, fmt.Errorf("failed to download %s: %v", filename, err)
+			}
+
+			if checksumBytes(resp.Content) != resp.Checksum {
+				return true, fmt.Errorf("chunk at offset %d of %s is corrupt", offset, filename)
+			}
+
+			_, err = dst.WriteAt(resp.Content, offset)
+			if err != nil {
+				return false, err
+			}
+
+			offset += int64(len(resp.Content))
+
+			if opts.Progress != nil {
+				if err := opts.Progress(offset, resp.Size); err != nil {
+					return false, err
+				}
+			}
+
+			if len(resp.Content) == 0 || offset >= resp.Size {
+				break
+			}
+		}
+
+		// Make sure the chunks add up to the file as it is now.
+		var resp proto.SendMessageResp
+		err = r.sendMessage(ctx, proto.SendMessageReq{
+			Kind:     proto.MessageStatFile,
+			Filename: filename,
+		}, &resp)
+		if err != nil {
+			return true, fmt.Errorf("failed to check download of %s: %v", filename, err)
+		}
+
+		checksum, err := checksumReader(dst, offset)
+		if err != nil {
+			return false, err
+		}
+
+		if resp.Size != offset || resp.Checksum != checksum {
+			if err := dst.Truncate(0); err != nil {
+				return false, err
+			}
+
+			return true, fmt.Errorf("%s changed while it was downloaded", filename)
+		}
+
+		return false, nil
+	})
+}
+
+// resumeDownload returns the offset to continue a download from.
+// It only keeps what was downloaded earlier if it matches the start of the remote file.
+func (r *Remote) resumeDownload(ctx context.Context, filename string, dst transferFile) (int64, error) {
+	size, err := dst.Size()
+	if err != nil {
+		return 0, err
+	}
+
+	if size > 0 {
+		var resp proto.SendMessageResp
+		err := r.sendMessage(ctx, proto.SendMessageReq{
+			Kind:     proto.MessageStatFile,
+			Filename: filename,
+			Length:   size,
+		}, &resp)
+		if err != nil {
+			return 0, fmt.Errorf("failed to check download of %s: %v", filename, err)
+		}
+
+		checksum, err := checksumReader(dst, size)
+		if err != nil {
+			return 0, err
+		}
+
+		if checksum == resp.Checksum {
+			return size, nil
+		}
+
+		// The remote file is shorter now or it changed. Start over.
+	}
+
+	return 0, dst.Truncate(0)
+}
@@ -0,0 +1,115 @@
+// Package facts collects facts about the host a worker runs on for GetInfo.
+//
+// Each group of facts comes from a named Collector so they can be turned off one at a time.
+// Collectors that do not work on the current platform report ErrUnsupported and are left out.
+package facts
+
+import (
+	"errors"
+	"net"
+	"runtime"
+	"sort"
+
+	"github.com/Vbitz/raise/v2/pkg/proto"
+)
+
+// ErrUnsupported is returned by collectors that have nothing to report on this platform.
+var ErrUnsupported = errors.New("not supported on this platform")
+
+// Collector fills in one group of facts.
+type Collector struct {
+	Name    string
+	Collect func(info *proto.GetInfoResp) error
+}
+
+var collectors []Collector
+
+// Register adds a collector. Collectors run in the order they were registered.
+func Register(c Collector) {
+	collectors = append(collectors, c)
+}
+
+// Names returns the names of every registered collector.
+func Names() []string {
+	var ret []string
+	for _, c := range collectors {
+		ret = append(ret, c.Name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Collect runs every collector that is not disabled. A collector that fails is recorded
+// in info.FactErrors without stopping the others.
+func Collect(info *proto.GetInfoResp, disabled map[string]bool) {
+	for _, c := range collectors {
+		if disabled[c.Name] {
+			continue
+		}
+
+		err := c.Collect(info)
+		if err == nil || errors.Is(err, ErrUnsupported) {
+			continue
+		}
+
+		if info.FactErrors == nil {
+			info.FactErrors = make(map[string]string)
+		}
+		info.FactErrors[c.Name] = err.Error()
+	}
+}
+
+func collectCPU(info *proto.GetInfoResp) error {
+	model, err := cpuModel()
+	if err != nil && !errors.Is(err, ErrUnsupported) {
+		return err
+	}
+
+	info.CPU = &proto.CPUInfo{
+		Count: runtime.NumCPU(),
+		Model: model,
+	}
+
+	return nil
+}
+
+func collectNetwork(info *proto.GetInfoResp) error {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return err
+	}
+
+	for _, iface := range interfaces {
+		record := proto.InterfaceInfo{
+			Name:         iface.Name,
+			MTU:          iface.MTU,
+			HardwareAddr: iface.HardwareAddr.String(),
+			Up:           iface.Flags&net.FlagUp != 0,
+			Loopback:     iface.Flags&net.FlagLoopback != 0,
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return err
+		}
+
+		for _, addr := range addrs {
+			record.Addresses = append(record.Addresses, addr.String())
+		}
+
+		info.Network = append(info.Network, record)
+	}
+
+	return nil
+}
+
+func init() {
+	Register(Collector{Name: "cpu", Collect: collectCPU})
+	Register(Collector{Name: "memory", Collect: collectMemory})
+	Register(Collector{Name: "filesystems", Collect: collectFilesystems})
+	Register(Collector{Name: "network", Collect: collectNetwork})
+	Register(Collector{Name: "kernel", Collect: collectKernel})
+	Register(Collector{Name: "distribution", Collect: collectDistribution})
+	Register(Collector{Name: "uptime", Collect: collectUptime})
+	Register(Collector{Name: "load", Collect: collectLoad})
+}
@@ -0,0 +1,241 @@
+//go:build linux
+
+package facts
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Vbitz/raise/v2/pkg/proto"
+	"golang.org/x/sys/unix"
+)
+
+// readFields calls fn with the fields of every line in a file under /proc or /sys.
+func readFields(filename string, fn func(fields []string)) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fn(strings.Fields(scanner.Text()))
+	}
+
+	return scanner.Err()
+}
+
+func cpuModel() (string, error) {
+	var model string
+
+	err := readFields("/proc/cpuinfo", func(fields []string) {
+		// "model name : Intel(R) ..."
+		if model == "" && len(fields) > 3 && fields[0] == "model" && fields[1] == "name" {
+			model = strings.Join(fields[3:], " ")
+		}
+	})
+
+	return model, err
+}
+
+func collectMemory(info *proto.GetInfoResp) error {
+	values := make(map[string]uint64)
+
+	err := readFields("/proc/meminfo", func(fields []string) {
+		// "MemTotal:       16318452 kB"
+		if len(fields) < 2 {
+			return
+		}
+
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return
+		}
+
+		if len(fields) > 2 && fields[2] == "kB" {
+			value *= 1024
+		}
+
+		values[strings.TrimSuffix(fields[0], ":")] = value
+	})
+	if err != nil {
+		return err
+	}
+
+	info.Memory = &proto.MemoryInfo{
+		Total:     values["MemTotal"],
+		Available: values["MemAvailable"],
+		SwapTotal: values["SwapTotal"],
+		SwapFree:  values["SwapFree"],
+	}
+
+	return nil
+}
+
+func collectFilesystems(info *proto.GetInfoResp) error {
+	seen := make(map[string]bool)
+
+	var statErr error
+
+	err := readFields("/proc/mounts", func(fields []string) {
+		if len(fields) < 3 || seen[fields[1]] {
+			return
+		}
+
+		// Mount points with spaces are escaped as \040.
+		mountPoint, err := strconv.Unquote(`"` + fields[1] + `"`)
+		if err != nil {
+			mountPoint = fields[1]
+		}
+
+		var stat unix.Statfs_t
+		if err := unix.Statfs(mountPoint, &stat); err != nil {
+			if statErr == nil && !os.IsPermission(err) {
+				statErr = fmt.Errorf("statfs %s: %v", mountPoint, err)
+			}
+			return
+		}
+
+		// Skip pseudo filesystems such as proc and cgroup which have no blocks.
+		if stat.Blocks == 0 {
+			return
+		}
+
+		seen[fields[1]] = true
+
+		blockSize := uint64(stat.Bsize)
+
+		info.Filesystems = append(info.Filesystems, proto.FilesystemInfo{
+			Device:     fields[0],
+			MountPoint: mountPoint,
+			Type:       fields[2],
+			Total:      stat.Blocks * blockSize,
+			Used:       (stat.Blocks - stat.Bfree) * blockSize,
+			Available:  stat.Bavail * blockSize,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	return statErr
+}
+
+func collectKernel(info *proto.GetInfoResp) error {
+	release, err := os.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return err
+	}
+
+	info.Kernel = strings.TrimSpace(string(release))
+
+	return nil
+}
+
+func collectDistribution(info *proto.GetInfoResp) error {
+	content, err := os.ReadFile("/etc/os-release")
+	if os.IsNotExist(err) {
+		content, err = os.ReadFile("/usr/lib/os-release")
+	}
+	if err != nil {
+		return err
+	}
+
+	values := parseOSRelease(string(content))
+
+	info.Distribution = &proto.DistributionInfo{
+		ID:         values["ID"],
+		Name:       values["NAME"],
+		Version:    values["VERSION_ID"],
+		PrettyName: values["PRETTY_NAME"],
+	}
+
+	return nil
+}
+
+// parseOSRelease parses the KEY=value lines of os-release(5).
+func parseOSRelease(content string) map[string]string {
+	values := make(map[string]string)
+
+	for _, line := range strings.Split(content, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok || strings.HasPrefix(key, "#") {
+			continue
+		}
+
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else {
+			value = strings.Trim(value, `'"`)
+		}
+
+		values[key] = value
+	}
+
+	return values
+}
+
+func collectUptime(info *proto.GetInfoResp) error {
+	content, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return err
+	}
+
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return fmt.Errorf("unexpected /proc/uptime: %q", content)
+	}
+
+	uptime, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return err
+	}
+
+	info.Uptime = uptime
+
+	var bootTime time.Time
+
+	err = readFields("/proc/stat", func(fields []string) {
+		if len(fields) == 2 && fields[0] == "btime" {
+			if seconds, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+				bootTime = time.Unix(seconds, 0).UTC()
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if !bootTime.IsZero() {
+		info.BootTime = &bootTime
+	}
+
+	return nil
+}
+
+func collectLoad(info *proto.GetInfoResp) error {
+	content, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return err
+	}
+
+	fields := strings.Fields(string(content))
+	if len(fields) < 3 {
+		return fmt.Errorf("unexpected /proc/loadavg: %q", content)
+	}
+
+	for _, field := range fields[:3] {
+		load, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return err
+		}
+		info.LoadAverage = append(info.LoadAverage, load)
+	}
+
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package facts
+
+import "github.com/Vbitz/raise/v2/pkg/proto"
+
+func cpuModel() (string, error) { return "", ErrUnsupported }
+
+func collectMemory(info *proto.GetInfoResp) error       { return ErrUnsupported }
+func collectFilesystems(info *proto.GetInfoResp) error  { return ErrUnsupported }
+func collectKernel(info *proto.GetInfoResp) error       { return ErrUnsupported }
+func collectDistribution(info *proto.GetInfoResp) error { return ErrUnsupported }
+func collectUptime(info *proto.GetInfoResp) error       { return ErrUnsupported }
+func collectLoad(info *proto.GetInfoResp) error         { return ErrUnsupported }
@@ -0,0 +1,18 @@
+//go:build windows
+
+package facts
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// killProcessGroup only kills the top level process. Windows has no equivalent of killing a process group
+// without job objects.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
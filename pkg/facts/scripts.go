@@ -0,0 +1,265 @@
+package facts
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Vbitz/raise/v2/pkg/proto"
+)
+
+// CustomName is the name used to disable custom fact scripts and to report their errors.
+var CustomName = "custom"
+
+// ScriptTimeout is how long a fact script may run before it is killed.
+var ScriptTimeout = 30 * time.Second
+
+type scriptResult struct {
+	value   json.RawMessage
+	err     error
+	expires time.Time
+}
+
+// ScriptCollector runs the executables in a directory and reports their output as custom facts.
+// Each script prints either a JSON object or key=value lines. Results are cached for a while
+// so GetInfo does not wait on the scripts every time. Expired results are refreshed in the background
+// and reported until the new ones are in.
+type ScriptCollector struct {
+	dir string
+	ttl time.Duration
+
+	mtx   sync.Mutex
+	cache map[string]scriptResult
+	// running holds a channel for each script being run that is closed once it is done.
+	running map[string]chan struct{}
+}
+
+// scripts returns the executables in the directory by name.
+func (c *ScriptCollector) scripts() (map[string]string, error) {
+	entries, err := os.ReadDir(c.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	ret := make(map[string]string)
+
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		if runtime.GOOS != "windows" && info.Mode().Perm()&0111 == 0 {
+			continue
+		}
+
+		name := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+		ret[name] = filepath.Join(c.dir, entry.Name())
+	}
+
+	return ret, nil
+}
+
+// parseScriptOutput turns the output of a fact script into JSON.
+func parseScriptOutput(output []byte) (json.RawMessage, error) {
+	output = bytes.TrimSpace(output)
+
+	if bytes.HasPrefix(output, []byte("{")) {
+		var value map[string]interface{}
+		if err := json.Unmarshal(output, &value); err != nil {
+			return nil, fmt.Errorf("invalid JSON output: %v", err)
+		}
+		return json.RawMessage(output), nil
+	}
+
+	values := make(map[string]string)
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid output line %q: want key=value or a JSON object", line)
+		}
+
+		value = strings.TrimSpace(value)
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+
+		values[strings.TrimSpace(key)] = value
+	}
+
+	return json.Marshal(values)
+}
+
+// runScript runs a fact script in its own process group. The whole group is killed on timeout
+// so a child holding on to the output can not keep it running.
+func runScript(filename string) (json.RawMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ScriptTimeout)
+	defer cancel()
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	cmd := exec.Command(filename)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	setProcessGroup(cmd)
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(cmd)
+		case <-done:
+		}
+	}()
+
+	err := cmd.Wait()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("timed out after %s", ScriptTimeout)
+	} else if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	return parseScriptOutput(stdout.Bytes())
+}
+
+// refresh runs a script in the background unless it is already running and returns a channel
+// that is closed once its result is in the cache.
+func (c *ScriptCollector) refresh(name string, filename string) chan struct{} {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if running, ok := c.running[name]; ok {
+		return running
+	}
+
+	running := make(chan struct{})
+	c.running[name] = running
+
+	go func() {
+		value, err := runScript(filename)
+
+		c.mtx.Lock()
+		c.cache[name] = scriptResult{
+			value:   value,
+			err:     err,
+			expires: time.Now().Add(c.ttl),
+		}
+		delete(c.running, name)
+		c.mtx.Unlock()
+
+		close(running)
+	}()
+
+	return running
+}
+
+// update returns the cached result of a script and starts running it again if it expired.
+// A script that never finished has no result yet and the returned channel is closed once it does.
+func (c *ScriptCollector) update(name string, filename string) (scriptResult, chan struct{}) {
+	c.mtx.Lock()
+	cached, ok := c.cache[name]
+	c.mtx.Unlock()
+
+	if ok {
+		if !time.Now().Before(cached.expires) {
+			c.refresh(name, filename)
+		}
+		return cached, nil
+	}
+
+	return scriptResult{}, c.refresh(name, filename)
+}
+
+// Collect runs the fact scripts, or uses their cached results, and adds them to info.Custom by
+// script name. A failing script is recorded in info.FactErrors as custom/<name>.
+func (c *ScriptCollector) Collect(info *proto.GetInfoResp) {
+	scripts, err := c.scripts()
+	if err != nil {
+		if info.FactErrors == nil {
+			info.FactErrors = make(map[string]string)
+		}
+		info.FactErrors[CustomName] = err.Error()
+		return
+	}
+
+	var names []string
+	for name := range scripts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Start every script that is due first so the ones without a result yet run at the same time.
+	results := make(map[string]scriptResult)
+	pending := make(map[string]chan struct{})
+
+	for _, name := range names {
+		results[name], pending[name] = c.update(name, scripts[name])
+	}
+
+	for _, name := range names {
+		if pending[name] != nil {
+			<-pending[name]
+
+			c.mtx.Lock()
+			results[name] = c.cache[name]
+			c.mtx.Unlock()
+		}
+
+		result := results[name]
+
+		if result.err != nil {
+			if info.FactErrors == nil {
+				info.FactErrors = make(map[string]string)
+			}
+			info.FactErrors[CustomName+"/"+name] = result.err.Error()
+			continue
+		}
+
+		if info.Custom == nil {
+			info.Custom = make(map[string]json.RawMessage)
+		}
+		info.Custom[name] = result.value
+	}
+}
+
+// NewScriptCollector returns a collector for the executables in dir whose results are kept for ttl.
+func NewScriptCollector(dir string, ttl time.Duration) *ScriptCollector {
+	return &ScriptCollector{
+		dir:     dir,
+		ttl:     ttl,
+		cache:   make(map[string]scriptResult),
+		running: make(map[string]chan struct{}),
+	}
+}
@@ -0,0 +1,94 @@
+// Package heartbeat tracks the liveness of a peer by periodically sending it heartbeats.
+package heartbeat
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Vbitz/raise/v2/pkg/proto"
+)
+
+type Config struct {
+	// Interval between heartbeats. Each heartbeat has to be answered within one interval.
+	Interval time.Duration
+	// Timeout after the last answered heartbeat before the peer is considered lost.
+	Timeout time.Duration
+}
+
+var DefaultConfig = Config{
+	Interval: 10 * time.Second,
+	Timeout:  45 * time.Second,
+}
+
+type Monitor struct {
+	config Config
+
+	mtx      sync.Mutex
+	state    proto.WorkerState
+	lastBeat time.Time
+}
+
+func (m *Monitor) State() proto.WorkerState {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	return m.state
+}
+
+// LastBeat returns the time of the last answered heartbeat.
+func (m *Monitor) LastBeat() time.Time {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	return m.lastBeat
+}
+
+func (m *Monitor) record(err error) proto.WorkerState {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	now := time.Now()
+
+	if err == nil {
+		m.lastBeat = now
+		m.state = proto.WorkerHealthy
+	} else if now.Sub(m.lastBeat) >= m.config.Timeout {
+		m.state = proto.WorkerLost
+	} else {
+		m.state = proto.WorkerDegraded
+	}
+
+	return m.state
+}
+
+// Run calls beat every interval until done is closed or the peer is lost.
+// It returns true if the peer was lost.
+func (m *Monitor) Run(done <-chan struct{}, beat func(ctx context.Context) error) bool {
+	ticker := time.NewTicker(m.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return false
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), m.config.Interval)
+		err := beat(ctx)
+		cancel()
+
+		if m.record(err) == proto.WorkerLost {
+			return true
+		}
+	}
+}
+
+func NewMonitor(config Config) *Monitor {
+	return &Monitor{
+		config:   config,
+		state:    proto.WorkerHealthy,
+		lastBeat: time.Now(),
+	}
+}
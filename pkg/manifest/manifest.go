@@ -0,0 +1,142 @@
+// Package manifest describes a directory tree so two copies of it can be compared.
+// It is used on both ends of a sync so the client and worker agree on what a tree looks like.
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/Vbitz/raise/v2/pkg/proto"
+)
+
+// Excluded reports whether rel, a slash separated path relative to the root, matches one of the patterns.
+// Patterns containing a slash match the whole path. Other patterns match the last element so "*.log"
+// excludes log files in every directory.
+func Excluded(rel string, patterns []string) (bool, error) {
+	for _, pattern := range patterns {
+		name := rel
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(rel)
+		}
+
+		ok, err := path.Match(strings.TrimSuffix(pattern, "/"), name)
+		if err != nil {
+			return false, err
+		}
+
+		if ok {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func checksumFile(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Build describes every file, directory and symbolic link under root in lexical order. Paths are
+// relative to root and use forward slashes. Regular files have a checksum. Anything matching
+// one of the exclude patterns is skipped along with everything inside it.
+func Build(root string, exclude []string) ([]proto.FileInfo, error) {
+	var ret []proto.FileInfo
+
+	err := filepath.WalkDir(root, func(filename string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if filename == root {
+			if !entry.IsDir() {
+				return &fs.PathError{Op: "sync", Path: root, Err: fmt.Errorf("not a directory")}
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, filename)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		excluded, err := Excluded(rel, exclude)
+		if err != nil {
+			return err
+		}
+
+		if excluded {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		fi, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		info := proto.FileInfo{
+			Name:    entry.Name(),
+			Path:    rel,
+			Size:    fi.Size(),
+			Mode:    fi.Mode(),
+			ModTime: fi.ModTime(),
+			Uid:     -1,
+			Gid:     -1,
+		}
+
+		switch {
+		case fi.Mode().IsRegular():
+			info.Type = proto.FileTypeFile
+
+			info.Checksum, err = checksumFile(filename)
+			if err != nil {
+				return err
+			}
+		case fi.IsDir():
+			info.Type = proto.FileTypeDir
+			info.Size = 0
+		case fi.Mode()&os.ModeSymlink != 0:
+			info.Type = proto.FileTypeSymlink
+
+			info.LinkTarget, err = os.Readlink(filename)
+			if err != nil {
+				return err
+			}
+		default:
+			// Devices, sockets and pipes can not be copied.
+			return nil
+		}
+
+		ret = append(ret, info)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
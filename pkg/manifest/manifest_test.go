@@ -0,0 +1,105 @@
+package manifest
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Vbitz/raise/v2/pkg/proto"
+)
+
+func TestExcluded(t *testing.T) {
+	tests := []struct {
+		rel      string
+		patterns []string
+		want     bool
+	}{
+		{"app.log", []string{"*.log"}, true},
+		{"logs/app.log", []string{"*.log"}, true},
+		{"logs/app.log.1", []string{"*.log"}, false},
+		{"node_modules", []string{"node_modules"}, true},
+		{"web/node_modules", []string{"node_modules"}, true},
+		{"build", []string{"build/"}, true},
+		{"src/build.go", []string{"build/"}, false},
+		{"docs/a.md", []string{"docs/*.md"}, true},
+		{"other/docs/a.md", []string{"docs/*.md"}, false},
+		{"main.go", []string{"*.log", "*.tmp"}, false},
+		{"main.go", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rel+" "+strings.Join(tt.patterns, ","), func(t *testing.T) {
+			got, err := Excluded(tt.rel, tt.patterns)
+			if err != nil || got != tt.want {
+				t.Fatalf("got %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+
+	if _, err := Excluded("a", []string{"["}); err == nil {
+		t.Fatalf("invalid pattern was accepted")
+	}
+}
+
+func TestBuild(t *testing.T) {
+	root := t.TempDir()
+
+	for filename, content := range map[string]string{
+		"b.txt":         "b",
+		"a/x.txt":       "x",
+		"a/skip.log":    "log",
+		"cache/ignored": "",
+	} {
+		filename = filepath.Join(root, filepath.FromSlash(filename))
+
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.Symlink("../outside", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := Build(root, []string{"*.log", "cache"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		path string
+		typ  proto.FileType
+	}{
+		{"a", proto.FileTypeDir},
+		{"a/x.txt", proto.FileTypeFile},
+		{"b.txt", proto.FileTypeFile},
+		{"link", proto.FileTypeSymlink},
+	}
+
+	if len(files) != len(want) {
+		t.Fatalf("got %d entries, want %d: %+v", len(files), len(want), files)
+	}
+
+	for i, w := range want {
+		if files[i].Path != w.path || files[i].Type != w.typ {
+			t.Errorf("entry %d is %s %s, want %s %s", i, files[i].Type, files[i].Path, w.typ, w.path)
+		}
+	}
+
+	if files[1].Checksum == "" || files[1].Checksum == files[2].Checksum {
+		t.Errorf("checksums of different files are %q and %q", files[1].Checksum, files[2].Checksum)
+	}
+
+	if files[3].LinkTarget != "../outside" {
+		t.Errorf("link target is %q", files[3].LinkTarget)
+	}
+
+	if _, err := Build(filepath.Join(root, "b.txt"), nil); err == nil {
+		t.Errorf("building a manifest of a file succeeded")
+	}
+}
@@ -0,0 +1,61 @@
+package proto
+
+import (
+	"errors"
+	"os"
+)
+
+// FileErrorCode classifies a filesystem error on a worker. The worker reports it in
+// SendMessageResp.ErrorCode so the client can tell the cause apart from the message.
+type FileErrorCode string
+
+var (
+	FileErrorNotFound         FileErrorCode = "not_found"
+	FileErrorPermissionDenied FileErrorCode = "permission_denied"
+	FileErrorExists           FileErrorCode = "already_exists"
+)
+
+// FileErrorCodeFor returns the FileErrorCode of err or an empty string if its cause is not known.
+func FileErrorCodeFor(err error) FileErrorCode {
+	if errors.Is(err, os.ErrNotExist) {
+		return FileErrorNotFound
+	} else if errors.Is(err, os.ErrPermission) {
+		return FileErrorPermissionDenied
+	} else if errors.Is(err, os.ErrExist) {
+		return FileErrorExists
+	}
+	return ""
+}
+
+// FileError is a filesystem error with a known cause reported by a worker.
+// It matches os.ErrNotExist, os.ErrPermission or os.ErrExist with errors.Is.
+type FileError struct {
+	Code    FileErrorCode
+	Message string
+}
+
+func (e *FileError) Error() string {
+	return e.Message
+}
+
+func (e *FileError) Is(target error) bool {
+	switch e.Code {
+	case FileErrorNotFound:
+		return target == os.ErrNotExist
+	case FileErrorPermissionDenied:
+		return target == os.ErrPermission
+	case FileErrorExists:
+		return target == os.ErrExist
+	default:
+		return false
+	}
+}
+
+// FileErr returns the filesystem error the worker reported in the response, if any.
+func (r *SendMessageResp) FileErr() error {
+	if r.ErrorCode == "" {
+		return nil
+	}
+
+	return &FileError{Code: r.ErrorCode, Message: r.ErrorMessage}
+}
@@ -1,6 +1,10 @@
 package proto
 
 import (
+	"encoding/json"
+	"os"
+	"time"
+
 	"github.com/cenkalti/rpc2"
 )
 
@@ -10,6 +14,19 @@ var (
 	Common_SendMessage = "Common_SendMessage"
 	Client_GetWorkers  = "Client_GetWorkers"
 	Common_GetInfo     = "Common_GetInfo"
+	Common_Heartbeat   = "Common_Heartbeat"
+	Common_Cancel      = "Common_Cancel"
+
+	Client_SendMessageAll = "Client_SendMessageAll"
+	Control_Output        = "Control_Output"
+	Client_Output         = "Client_Output"
+
+	Common_OpenSession  = "Common_OpenSession"
+	Common_SessionData  = "Common_SessionData"
+	Common_CloseSession = "Common_CloseSession"
+
+	Client_QueuedMessages = "Client_QueuedMessages"
+	Client_AuditEvents    = "Client_AuditEvents"
 )
 
 type MessageKind string
@@ -18,6 +35,63 @@ var (
 	MessageReadFile  MessageKind = "Msg_ReadFile"
 	MessageWriteFile MessageKind = "Msg_WriteFile"
 	MessageRunScript MessageKind = "Msg_RunScript"
+
+	// Chunked file transfer. See TransferChunkSize.
+	MessageStatFile    MessageKind = "Msg_StatFile"
+	MessageReadChunk   MessageKind = "Msg_ReadChunk"
+	MessageWriteChunk  MessageKind = "Msg_WriteChunk"
+	MessageStatUpload  MessageKind = "Msg_StatUpload"
+	MessageFinishWrite MessageKind = "Msg_FinishWrite"
+
+	// Filesystem operations. Errors with a known cause are reported in SendMessageResp.ErrorCode.
+	MessageStat     MessageKind = "Msg_Stat"
+	MessageListDir  MessageKind = "Msg_ListDir"
+	MessageMkdir    MessageKind = "Msg_Mkdir"
+	MessageRemove   MessageKind = "Msg_Remove"
+	MessageRename   MessageKind = "Msg_Rename"
+	MessageSymlink  MessageKind = "Msg_Symlink"
+	MessageReadlink MessageKind = "Msg_Readlink"
+	MessageChmod    MessageKind = "Msg_Chmod"
+	MessageChown    MessageKind = "Msg_Chown"
+
+	// Describes a directory tree for a sync. See pkg/manifest.
+	MessageManifest MessageKind = "Msg_Manifest"
+
+	// Extract a tar archive already on the worker into Destination, or pack the directory
+	// Filename into a new archive on the worker whose name is returned in Content.
+	MessageExtract MessageKind = "Msg_Extract"
+	MessagePack    MessageKind = "Msg_Pack"
+
+	// List the processes on the worker or send a signal to some of them.
+	// Both take a ProcessFilter and MessageKill also takes a Pid instead.
+	MessageProcesses MessageKind = "Msg_Processes"
+	MessageKill      MessageKind = "Msg_Kill"
+
+	// Detached jobs. MessageStartJob runs the script in Content in the background and returns
+	// its JobInfo. The others take a JobID. MessageWaitJob returns once the job is finished
+	// or the Timeout of the message is up.
+	MessageStartJob  MessageKind = "Msg_StartJob"
+	MessageJobs      MessageKind = "Msg_Jobs"
+	MessageJobStatus MessageKind = "Msg_JobStatus"
+	MessageJobOutput MessageKind = "Msg_JobOutput"
+	MessageWaitJob   MessageKind = "Msg_WaitJob"
+	MessageCancelJob MessageKind = "Msg_CancelJob"
+	MessageRemoveJob MessageKind = "Msg_RemoveJob"
+)
+
+var (
+	// The default size of a chunk in a file transfer.
+	TransferChunkSize = 1024 * 1024
+	// Workers reject chunks larger than this.
+	MaxTransferChunkSize = 16 * 1024 * 1024
+)
+
+type WorkerState string
+
+var (
+	WorkerHealthy  WorkerState = "healthy"
+	WorkerDegraded WorkerState = "degraded"
+	WorkerLost     WorkerState = "lost"
 )
 
 type PingReq struct {
@@ -32,19 +106,440 @@ type SendMessageReq struct {
 	Target string
 	Kind   MessageKind
 
+	// Identifies the request so it can be cancelled with Common_Cancel.
+	RequestID string
+	// How long the worker lets the message run before killing it. Zero means no limit.
+	Timeout time.Duration
+	// Stream script output back as OutputChunks while it runs.
+	StreamOutput bool
+	// If the worker is offline the server keeps the message for this long and delivers it once the
+	// worker connects instead of failing. The response only has QueuedID set. Zero never queues.
+	QueueFor time.Duration
+
 	Filename string
 	Content  []byte
+
+	// For MessageWriteFile and MessageFinishWrite. A zero Mode keeps the mode of the file
+	// being replaced or uses 0644 for a new file. Owner and Group are names or numeric ids.
+	Mode  os.FileMode
+	Owner string
+	Group string
+	// Write the file directly instead of to a temporary file that is renamed into place, which
+	// keeps hard links and the inode but can leave the file half written. Chunked uploads are
+	// always written to a temporary file.
+	InPlace bool
+
+	// The second path of MessageRename (the new name) and MessageSymlink (what the link points to).
+	Destination string
+	// Create parents for MessageMkdir or remove everything inside a directory for MessageRemove.
+	Recursive bool
+	// Patterns of paths to leave out of MessageManifest and MessagePack.
+	Exclude []string
+	// The number of leading path elements to remove from entries for MessageExtract.
+	StripComponents int
+	// Compress the archive created by MessagePack.
+	Gzip bool
+
+	// For chunked transfers. Offset is where the chunk starts in the file.
+	// Length is the size of the chunk to read, the prefix to checksum for MessageStatFile
+	// (zero for the whole file) or the size of the whole file for MessageStatUpload and MessageFinishWrite.
+	// Checksum is of the chunk for MessageWriteChunk and of the whole file otherwise.
+	Offset   int64
+	Length   int64
+	Checksum string
+	// The upload MessageStatUpload returned, for MessageWriteChunk and MessageFinishWrite.
+	UploadID string
+
+	// For MessageProcesses and MessageKill. A non-zero Pid signals only that process.
+	Pid    int
+	Signal string
+	Filter ProcessFilter
+
+	// For the job messages. MessageJobOutput reads Length bytes of Stream from Offset.
+	JobID  string
+	Stream OutputStream
+}
+
+// ScriptResult is the outcome of a MessageRunScript message.
+// A script exiting with a non-zero code is still a successful message.
+type ScriptResult struct {
+	Stdout   []byte
+	Stderr   []byte
+	ExitCode int
+	// The name of the signal that killed the script. Empty if it exited normally.
+	Signal    string
+	StartTime time.Time
+	Duration  time.Duration
+	// Set if the script was killed because it ran past the timeout.
+	TimedOut bool
 }
 
 type SendMessageResp struct {
 	Content []byte
+
+	// For chunked transfers. Size is the size of the whole file and Checksum the
+	// hex encoded SHA-256 of Content or of the part of the file that was asked for.
+	Size     int64
+	Checksum string
+	// Set by MessageStatUpload. The same file uploaded to the same place gets the same ID so it can resume.
+	UploadID string
+
+	// For MessageStat and MessageListDir.
+	Files []FileInfo
+
+	// The processes listed by MessageProcesses or signalled by MessageKill.
+	Processes []ProcessInfo
+
+	// The jobs described by the job messages.
+	Jobs []JobInfo
+
+	// Set by the server instead of a response from the worker if the message was queued.
+	QueuedID string
+
+	// Set for MessageRunScript.
+	ScriptResult
+
+	// Set with the message of a filesystem error with a known cause, which is returned this way
+	// instead of as the error of the call since the response to a failed call never arrives.
+	// See FileErr.
+	ErrorCode    FileErrorCode
+	ErrorMessage string
+}
+
+type FileType string
+
+var (
+	FileTypeFile    FileType = "file"
+	FileTypeDir     FileType = "dir"
+	FileTypeSymlink FileType = "symlink"
+	FileTypeOther   FileType = "other"
+)
+
+// FileInfo describes a file on a worker. Symbolic links are described themselves, not what they point to.
+type FileInfo struct {
+	Name    string
+	Path    string
+	Type    FileType
+	Size    int64
+	Mode    os.FileMode
+	ModTime time.Time
+
+	// Empty or -1 where the operating system has no equivalent.
+	Owner string
+	Group string
+	Uid   int
+	Gid   int
+
+	// Set for symbolic links.
+	LinkTarget string
+	// The hex encoded SHA-256 of a regular file. Only set by MessageManifest.
+	Checksum string
+}
+
+// ProcessFilter selects processes on a worker. Empty fields match everything.
+type ProcessFilter struct {
+	// A glob pattern matched against the command name.
+	Name string
+	// A user name or numeric id.
+	User string
+	// A regular expression matched against the command line joined with spaces.
+	CommandLine string
+}
+
+// IsEmpty reports whether the filter matches every process.
+func (f ProcessFilter) IsEmpty() bool {
+	return f == ProcessFilter{}
+}
+
+// ProcessInfo describes a process running on a worker.
+type ProcessInfo struct {
+	Pid  int
+	PPid int
+	// Empty or -1 where the operating system has no equivalent.
+	User string
+	Uid  int
+	// The name of the command and its arguments. CommandLine is empty for kernel threads.
+	Command     string
+	CommandLine []string
+	// The state letter from /proc such as R for running or S for sleeping.
+	State     string
+	CPUTime   time.Duration
+	RSS       int64
+	StartTime time.Time
+}
+
+type JobState string
+
+var (
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+	JobCancelled JobState = "cancelled"
+	// The job stopped without recording how while the worker was not running.
+	JobLost JobState = "lost"
+)
+
+// JobInfo describes a detached job on a worker.
+type JobInfo struct {
+	ID     string
+	Script string
+	State  JobState
+	Pid    int
+
+	StartTime time.Time
+	// Zero while the job is running.
+	EndTime time.Time
+	// -1 unless the job exited by itself.
+	ExitCode int
+
+	// How much output the job has written so far.
+	StdoutSize int64
+	StderrSize int64
+}
+
+// Finished reports whether the job is no longer running.
+func (j JobInfo) Finished() bool {
+	return j.State != JobRunning
+}
+
+// SendMessageAllReq sends the same message to many workers at once.
+type SendMessageAllReq struct {
+	Targets []string
+	// Message is sent to every target. The Target field is ignored.
+	Message SendMessageReq
+	// The maximum number of workers the server talks to at once. Zero uses the server default.
+	Parallelism int
+}
+
+type SendMessageResult struct {
+	Target   string
+	Response SendMessageResp
+	// Empty on success.
+	Error string
+}
+
+type SendMessageAllResp struct {
+	// Results in the same order as the targets in the request.
+	Results []SendMessageResult
+}
+
+type OutputStream string
+
+var (
+	StreamStdout OutputStream = "stdout"
+	StreamStderr OutputStream = "stderr"
+)
+
+// OutputChunk is a piece of output from a running script.
+// Chunks are split on line boundaries unless a single line is very long.
+type OutputChunk struct {
+	RequestID string
+	// Filled in by the server with the name of the worker that produced the chunk.
+	Target string
+	Stream OutputStream
+	Data   []byte
+}
+
+type OutputResp struct{}
+
+type SessionKind string
+
+var (
+	// An interactive shell running in a pseudo-terminal on the worker.
+	SessionShell SessionKind = "shell"
+	// A TCP connection the worker makes to Address on behalf of the client.
+	SessionForward SessionKind = "forward"
+)
+
+// OpenSessionReq opens a long lived session on a worker. Unlike SendMessage the session stays
+// open and carries SessionData in both directions until either side sends CloseSession.
+type OpenSessionReq struct {
+	Target string
+	// Chosen by the client. All later messages for the session refer to it.
+	SessionID string
+	Kind      SessionKind
+
+	// For SessionShell.
+	Term    string
+	Rows    uint16
+	Cols    uint16
+	Command string
+
+	// For SessionForward. The host:port the worker connects to.
+	Address string
+}
+
+type OpenSessionResp struct{}
+
+// SessionData carries one event of an open session.
+// For shells Data is terminal input going to the worker and terminal output coming from it.
+type SessionData struct {
+	SessionID string
+	Data      []byte
+
+	// A new terminal size. Ignored if zero.
+	Rows uint16
+	Cols uint16
+	// A signal to send to the foreground process of the session, such as "SIGINT".
+	Signal string
+	// The sender has nothing more to send. Forward sessions half-close the connection on the worker
+	// when the client sends it and send it to the client when the remote end half-closes.
+	EOF bool
+}
+
+type SessionDataResp struct{}
+
+type CloseSessionReq struct {
+	SessionID string
+	// Set by the worker when the session ended by itself.
+	ExitCode int
+	Error    string
+}
+
+type CloseSessionResp struct{}
+
+type QueuedState string
+
+var (
+	QueuedPending   QueuedState = "pending"
+	QueuedDelivered QueuedState = "delivered"
+	QueuedFailed    QueuedState = "failed"
+	QueuedExpired   QueuedState = "expired"
+)
+
+// QueuedMessage is a message the server kept for an offline worker and what became of it.
+type QueuedMessage struct {
+	ID string
+	// The client that sent the message.
+	Client string
+	// The certificate the client sent the message with as Base64 encoded DER. The client has to still
+	// be trusted with it when the message is delivered.
+	Certificate string
+	Target      string
+	Message     SendMessageReq
+
+	State     QueuedState
+	QueuedAt  time.Time
+	ExpiresAt time.Time
+	// When the message was delivered or failed.
+	DeliveredAt time.Time
+
+	// The response from the worker once delivered, or why delivery failed.
+	Response SendMessageResp
+	Error    string
+}
+
+type QueuedMessagesReq struct {
+	// Only return messages for this worker or with this ID if set.
+	Target string
+	ID     string
+}
+
+type QueuedMessagesResp struct {
+	// Oldest first.
+	Messages []QueuedMessage
+}
+
+type AuditOutcome string
+
+var (
+	AuditOK     AuditOutcome = "ok"
+	AuditError  AuditOutcome = "error"
+	AuditDenied AuditOutcome = "denied"
+	AuditQueued AuditOutcome = "queued"
+)
+
+// AuditEvent records a call a client made through the server. It is written as one line of JSON.
+type AuditEvent struct {
+	Time time.Time `json:"time"`
+	// The client name and the hex encoded SHA-256 of its certificate.
+	Client      string `json:"client"`
+	Fingerprint string `json:"fingerprint"`
+	Address     string `json:"address,omitempty"`
+
+	// The RPC method such as Common_SendMessage and the message or session kind.
+	Method    string `json:"method"`
+	Worker    string `json:"worker,omitempty"`
+	Kind      string `json:"kind,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+
+	Filename    string `json:"filename,omitempty"`
+	Destination string `json:"destination,omitempty"`
+	// The hex encoded SHA-256 and size of the script or file content sent.
+	ContentSHA256 string `json:"content_sha256,omitempty"`
+	ContentSize   int    `json:"content_size,omitempty"`
+	// The content itself. Only recorded if the server is set up to.
+	Content []byte `json:"content,omitempty"`
+
+	Outcome    AuditOutcome `json:"outcome"`
+	Error      string       `json:"error,omitempty"`
+	DurationMS int64        `json:"duration_ms"`
 }
 
+type AuditEventsReq struct {
+	// Empty fields match every event.
+	Client string
+	Worker string
+	Since  time.Time
+	Until  time.Time
+	// Only return the most recent events. Zero, or more than the server allows, returns as many as it allows.
+	Limit int
+}
+
+type AuditEventsResp struct {
+	// Oldest first.
+	Events []AuditEvent
+}
+
+// EnrollReq is posted as JSON to /enroll on the server to get a certificate signed by its CA.
+type EnrollReq struct {
+	// The one-time token the certificate is issued for.
+	Token string
+	// A DER encoded certificate request for the key of the client or worker.
+	CSR []byte
+}
+
+// RenewReq is posted as JSON to /renew on the server using a certificate issued by its CA that is still valid.
+type RenewReq struct {
+	CSR []byte
+}
+
+type EnrollResp struct {
+	// DER encoded.
+	Certificate []byte
+	// client or worker.
+	Role string
+	Name string
+}
+
+type CancelReq struct {
+	RequestID string
+}
+
+type CancelResp struct{}
+
 type GetWorkersReq struct {
+	// Optional label selector. See pkg/selector for the syntax.
+	Selector string
+}
+
+// WorkerRecord describes a live worker session.
+type WorkerRecord struct {
+	Name          string
+	Address       string
+	State         WorkerState
+	ConnectedAt   time.Time
+	LastHeartbeat time.Time
+
+	// Reported by the worker when it registers.
+	Commit          string
+	OperatingSystem string
+	Architecture    string
+	Labels          map[string]string
 }
 
 type GetWorkersResp struct {
-	Workers []string
+	Workers []WorkerRecord
 }
 
 type GetInfoReq struct {
@@ -56,14 +551,82 @@ type GetInfoResp struct {
 	HomeDir         string `json:"home"`
 	OperatingSystem string `json:"os"`
 	Architecture    string `json:"arch"`
+	// The commit the worker was built from.
+	Version string `json:"version"`
+
+	// Host facts. Each group is left empty if its collector is disabled or not supported on the worker.
+	CPU          *CPUInfo          `json:"cpu,omitempty"`
+	Memory       *MemoryInfo       `json:"memory,omitempty"`
+	Filesystems  []FilesystemInfo  `json:"filesystems,omitempty"`
+	Network      []InterfaceInfo   `json:"network,omitempty"`
+	Kernel       string            `json:"kernel,omitempty"`
+	Distribution *DistributionInfo `json:"distribution,omitempty"`
+	// Seconds since boot.
+	Uptime      float64    `json:"uptime,omitempty"`
+	BootTime    *time.Time `json:"boot_time,omitempty"`
+	LoadAverage []float64  `json:"load_average,omitempty"`
+	// The output of custom fact scripts keyed by script name as JSON.
+	Custom map[string]json.RawMessage `json:"custom,omitempty"`
+
+	// Errors from collectors that failed keyed by collector name.
+	FactErrors map[string]string `json:"fact_errors,omitempty"`
+}
+
+type CPUInfo struct {
+	Count int    `json:"count"`
+	Model string `json:"model"`
+}
+
+// MemoryInfo sizes are in bytes.
+type MemoryInfo struct {
+	Total     uint64 `json:"total"`
+	Available uint64 `json:"available"`
+	SwapTotal uint64 `json:"swap_total"`
+	SwapFree  uint64 `json:"swap_free"`
+}
+
+// FilesystemInfo sizes are in bytes.
+type FilesystemInfo struct {
+	Device     string `json:"device"`
+	MountPoint string `json:"mount_point"`
+	Type       string `json:"type"`
+	Total      uint64 `json:"total"`
+	Used       uint64 `json:"used"`
+	Available  uint64 `json:"available"`
+}
+
+type InterfaceInfo struct {
+	Name         string `json:"name"`
+	MTU          int    `json:"mtu"`
+	HardwareAddr string `json:"hardware_addr"`
+	Up           bool   `json:"up"`
+	Loopback     bool   `json:"loopback"`
+	// Addresses in CIDR notation.
+	Addresses []string `json:"addresses"`
+}
+
+// DistributionInfo comes from os-release(5).
+type DistributionInfo struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Version    string `json:"version"`
+	PrettyName string `json:"pretty_name"`
 }
 
 type HelloReq struct {
-	Name string
+	Name            string
+	Commit          string
+	OperatingSystem string
+	Architecture    string
+	Labels          map[string]string
 }
 
 type HelloResp struct{}
 
+type HeartbeatReq struct{}
+
+type HeartbeatResp struct{}
+
 type CommonService interface {
 	Ping(client *rpc2.Client, req PingReq, resp *PingResp) error
 }
@@ -73,8 +636,15 @@ type ClientService interface {
 	CommonService
 
 	SendMessage(client *rpc2.Client, req SendMessageReq, resp *SendMessageResp) error
+	SendMessageAll(client *rpc2.Client, req SendMessageAllReq, resp *SendMessageAllResp) error
 	GetWorkers(client *rpc2.Client, req GetWorkersReq, resp *GetWorkersResp) error
 	GetInfo(client *rpc2.Client, req GetInfoReq, resp *GetInfoResp) error
+	Cancel(client *rpc2.Client, req CancelReq, resp *CancelResp) error
+	OpenSession(client *rpc2.Client, req OpenSessionReq, resp *OpenSessionResp) error
+	SessionData(client *rpc2.Client, req SessionData, resp *SessionDataResp) error
+	CloseSession(client *rpc2.Client, req CloseSessionReq, resp *CloseSessionResp) error
+	QueuedMessages(client *rpc2.Client, req QueuedMessagesReq, resp *QueuedMessagesResp) error
+	AuditEvents(client *rpc2.Client, req AuditEventsReq, resp *AuditEventsResp) error
 }
 
 // Worker -> Server Communication
@@ -82,6 +652,19 @@ type ControlService interface {
 	CommonService
 
 	Hello(client *rpc2.Client, req HelloReq, resp *HelloResp) error
+	Heartbeat(client *rpc2.Client, req HeartbeatReq, resp *HeartbeatResp) error
+	Output(client *rpc2.Client, req OutputChunk, resp *OutputResp) error
+	SessionData(client *rpc2.Client, req SessionData, resp *SessionDataResp) error
+	CloseSession(client *rpc2.Client, req CloseSessionReq, resp *CloseSessionResp) error
+}
+
+// Server -> Client Communication
+type ClientCallbackService interface {
+	CommonService
+
+	Output(client *rpc2.Client, req OutputChunk, resp *OutputResp) error
+	SessionData(client *rpc2.Client, req SessionData, resp *SessionDataResp) error
+	CloseSession(client *rpc2.Client, req CloseSessionReq, resp *CloseSessionResp) error
 }
 
 // Server -> Worker Communication
@@ -90,4 +673,9 @@ type WorkerService interface {
 
 	SendMessage(client *rpc2.Client, req SendMessageReq, resp *SendMessageResp) error
 	GetInfo(client *rpc2.Client, req GetInfoReq, resp *GetInfoResp) error
+	Heartbeat(client *rpc2.Client, req HeartbeatReq, resp *HeartbeatResp) error
+	Cancel(client *rpc2.Client, req CancelReq, resp *CancelResp) error
+	OpenSession(client *rpc2.Client, req OpenSessionReq, resp *OpenSessionResp) error
+	SessionData(client *rpc2.Client, req SessionData, resp *SessionDataResp) error
+	CloseSession(client *rpc2.Client, req CloseSessionReq, resp *CloseSessionResp) error
 }
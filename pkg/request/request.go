@@ -0,0 +1,114 @@
+// Package request tracks in-flight requests so they can be cancelled by ID.
+package request
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNotOwner is returned when cancelling requests that were started by someone else.
+var ErrNotOwner = errors.New("request belongs to someone else")
+
+// NewID returns a random request ID.
+func NewID() string {
+	var buf [16]byte
+
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(buf[:])
+}
+
+type entry struct {
+	owner  string
+	cancel context.CancelFunc
+}
+
+type Tracker struct {
+	mtx     sync.Mutex
+	cancels map[string][]*entry
+}
+
+// Start returns a context for a request that is cancelled when Cancel is called with the same ID
+// and owner or after timeout. A zero timeout means no timeout. The returned function must be called
+// once the request is finished.
+func (t *Tracker) Start(parent context.Context, id string, owner string, timeout time.Duration) (context.Context, context.CancelFunc) {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(parent)
+	}
+
+	if id == "" {
+		return ctx, cancel
+	}
+
+	e := &entry{owner: owner, cancel: cancel}
+
+	t.mtx.Lock()
+	t.cancels[id] = append(t.cancels[id], e)
+	t.mtx.Unlock()
+
+	return ctx, func() {
+		cancel()
+
+		t.mtx.Lock()
+		defer t.mtx.Unlock()
+
+		entries := t.cancels[id]
+		for i, other := range entries {
+			if other == e {
+				entries = append(entries[:i], entries[i+1:]...)
+				break
+			}
+		}
+
+		if len(entries) == 0 {
+			delete(t.cancels, id)
+		} else {
+			t.cancels[id] = entries
+		}
+	}
+}
+
+// Cancel cancels every running request with the ID that owner started. It returns false if there
+// were none and ErrNotOwner if the only ones were started by someone else.
+func (t *Tracker) Cancel(id string, owner string) (bool, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	entries := t.cancels[id]
+
+	cancelled := false
+	for _, e := range entries {
+		if e.owner != owner {
+			continue
+		}
+
+		e.cancel()
+		cancelled = true
+	}
+
+	if !cancelled && len(entries) > 0 {
+		return false, ErrNotOwner
+	}
+
+	return cancelled, nil
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{
+		cancels: make(map[string][]*entry),
+	}
+}
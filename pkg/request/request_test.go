@@ -0,0 +1,98 @@
+package request
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCancelOwners(t *testing.T) {
+	tests := []struct {
+		name string
+		// The owners of the running requests with the ID "id".
+		owners []string
+		// Who cancels and what Cancel returns.
+		canceller string
+		cancelled bool
+		err       error
+		// Which of the requests are cancelled afterwards.
+		done []bool
+	}{
+		{"owner", []string{"a"}, "a", true, nil, []bool{true}},
+		{"someone else", []string{"a"}, "b", false, ErrNotOwner, []bool{false}},
+		{"nothing running", nil, "a", false, nil, nil},
+		{"only own requests", []string{"a", "b", "a"}, "a", true, nil, []bool{true, false, true}},
+		{"worker without owners", []string{"", ""}, "", true, nil, []bool{true, true}},
+		{"empty owner is not a wildcard", []string{"a"}, "", false, ErrNotOwner, []bool{false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := NewTracker()
+
+			var contexts []context.Context
+			for _, owner := range tt.owners {
+				ctx, finish := tracker.Start(context.Background(), "id", owner, 0)
+				defer finish()
+
+				contexts = append(contexts, ctx)
+			}
+
+			cancelled, err := tracker.Cancel("id", tt.canceller)
+			if cancelled != tt.cancelled || !errors.Is(err, tt.err) {
+				t.Fatalf("Cancel returned %v, %v, want %v, %v", cancelled, err, tt.cancelled, tt.err)
+			}
+
+			for i, ctx := range contexts {
+				if done := ctx.Err() != nil; done != tt.done[i] {
+					t.Errorf("request %d of %s: cancelled is %v, want %v", i, tt.owners[i], done, tt.done[i])
+				}
+			}
+		})
+	}
+}
+
+func TestFinishedRequestsAreForgotten(t *testing.T) {
+	tracker := NewTracker()
+
+	_, finish := tracker.Start(context.Background(), "id", "a", 0)
+	finish()
+
+	// A later request with the same ID from someone else is not blocked by the finished one.
+	ctx, finish := tracker.Start(context.Background(), "id", "b", 0)
+	defer finish()
+
+	if cancelled, err := tracker.Cancel("id", "a"); cancelled || !errors.Is(err, ErrNotOwner) {
+		t.Fatalf("Cancel by the owner of the finished request returned %v, %v", cancelled, err)
+	}
+
+	if cancelled, err := tracker.Cancel("id", "b"); !cancelled || err != nil {
+		t.Fatalf("Cancel by the owner returned %v, %v", cancelled, err)
+	}
+
+	if ctx.Err() == nil {
+		t.Fatalf("request was not cancelled")
+	}
+
+	if len(tracker.cancels) != 1 {
+		t.Fatalf("tracker holds %d IDs, want 1", len(tracker.cancels))
+	}
+}
+
+func TestStartTimeout(t *testing.T) {
+	tracker := NewTracker()
+
+	ctx, finish := tracker.Start(context.Background(), "", "a", time.Millisecond)
+	defer finish()
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("request did not time out")
+	}
+
+	if cancelled, err := tracker.Cancel("", "a"); cancelled || err != nil {
+		t.Fatalf("requests without an ID can be cancelled: %v, %v", cancelled, err)
+	}
+}
@@ -0,0 +1,193 @@
+package security
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Vbitz/raise/v2/pkg/proto"
+)
+
+// httpAddress turns the websocket address of the server into the base of its HTTPS address.
+func httpAddress(serverAddress string) string {
+	if strings.HasPrefix(serverAddress, "wss://") {
+		return "https://" + strings.TrimPrefix(serverAddress, "wss://")
+	} else if strings.HasPrefix(serverAddress, "ws://") {
+		return "http://" + strings.TrimPrefix(serverAddress, "ws://")
+	}
+	return serverAddress
+}
+
+// post sends req as JSON to path on the server and decodes the certificate it answers with.
+// crt is presented to the server if it is not nil.
+func post(serverAddress string, serverCertificate string, path string, req interface{}, crt *tls.Certificate) (proto.EnrollResp, error) {
+	pemBytes, err := base64.StdEncoding.DecodeString(serverCertificate)
+	if err != nil {
+		return proto.EnrollResp{}, fmt.Errorf("failed to decode server certificate: %v", err)
+	}
+
+	certPool := x509.NewCertPool()
+	if !certPool.AppendCertsFromPEM(pemBytes) {
+		return proto.EnrollResp{}, fmt.Errorf("failed to add server certificate")
+	}
+
+	config := &tls.Config{
+		ServerName: "localhost",
+		RootCAs:    certPool,
+	}
+
+	if crt != nil {
+		config.Certificates = []tls.Certificate{*crt}
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return proto.EnrollResp{}, err
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: config},
+		Timeout:   30 * time.Second,
+	}
+
+	httpResp, err := client.Post(httpAddress(serverAddress)+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return proto.EnrollResp{}, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(httpResp.Body, 4096))
+		return proto.EnrollResp{}, fmt.Errorf("server refused to issue a certificate: %s", strings.TrimSpace(string(msg)))
+	}
+
+	var resp proto.EnrollResp
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return proto.EnrollResp{}, fmt.Errorf("failed to decode response: %v", err)
+	}
+
+	return resp, nil
+}
+
+// newRequest generates a key and a DER encoded certificate request for it.
+func newRequest() (*rsa.PrivateKey, []byte, error) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{
+			Organization: []string{"Raise"},
+		},
+	}, priv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return priv, csr, nil
+}
+
+// Enroll generates a key and has the CA of the server sign a certificate for it using a one-time token.
+// It returns what the server issued along with the PKCS1 DER encoded key.
+func Enroll(serverAddress string, serverCertificate string, token string) (proto.EnrollResp, []byte, error) {
+	priv, csr, err := newRequest()
+	if err != nil {
+		return proto.EnrollResp{}, nil, err
+	}
+
+	resp, err := post(serverAddress, serverCertificate, "/enroll", proto.EnrollReq{
+		Token: token,
+		CSR:   csr,
+	}, nil)
+	if err != nil {
+		return proto.EnrollResp{}, nil, err
+	}
+
+	return resp, x509.MarshalPKCS1PrivateKey(priv), nil
+}
+
+// Renew has the CA of the server issue a certificate with a new key in place of crt, which must still be valid.
+func Renew(serverAddress string, serverCertificate string, crt tls.Certificate) (proto.EnrollResp, []byte, error) {
+	priv, csr, err := newRequest()
+	if err != nil {
+		return proto.EnrollResp{}, nil, err
+	}
+
+	resp, err := post(serverAddress, serverCertificate, "/renew", proto.RenewReq{
+		CSR: csr,
+	}, &crt)
+	if err != nil {
+		return proto.EnrollResp{}, nil, err
+	}
+
+	return resp, x509.MarshalPKCS1PrivateKey(priv), nil
+}
+
+// RenewalDue reports whether crt was issued by a CA and less than a third of its lifetime is left.
+// Self-signed certificates are never due since they can not be renewed.
+func RenewalDue(crt tls.Certificate) (bool, time.Time, error) {
+	if len(crt.Certificate) == 0 {
+		return false, time.Time{}, fmt.Errorf("no certificate")
+	}
+
+	leaf, err := x509.ParseCertificate(crt.Certificate[0])
+	if err != nil {
+		return false, time.Time{}, err
+	}
+
+	if bytes.Equal(leaf.RawIssuer, leaf.RawSubject) {
+		return false, leaf.NotAfter, nil
+	}
+
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+
+	return time.Until(leaf.NotAfter) < lifetime/3, leaf.NotAfter, nil
+}
+
+// writeFile replaces a file so that readers see either the old or the new content.
+func writeFile(filename string, content []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), filename)
+}
+
+// SaveCertificatePair writes a DER encoded certificate and a PKCS1 DER encoded key in the format
+// read by LoadCertificatePair. Existing files are replaced.
+func SaveCertificatePair(certFile string, keyFile string, certBytes []byte, privBytes []byte) error {
+	if err := writeFile(keyFile, privBytes, 0600); err != nil {
+		return err
+	}
+
+	return writeFile(certFile, certBytes, 0644)
+}
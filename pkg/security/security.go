@@ -7,8 +7,10 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"fmt"
 	"math/big"
 	"net"
+	"os"
 	"time"
 )
 
@@ -58,3 +60,27 @@ func GenerateCertificatePair() (tls.Certificate, []byte, error) {
 
 	return cert, derBytes, nil
 }
+
+// LoadCertificatePair loads a DER encoded certificate and a PKCS1 DER encoded private key
+// as written by GenerateCertificatePair.
+func LoadCertificatePair(certFile string, keyFile string) (tls.Certificate, error) {
+	certContent, err := os.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to read certificate: %v", err)
+	}
+
+	keyContent, err := os.ReadFile(keyFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to read key: %v", err)
+	}
+
+	priv, err := x509.ParsePKCS1PrivateKey(keyContent)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to parse key: %v", err)
+	}
+
+	return tls.Certificate{
+		PrivateKey:  priv,
+		Certificate: [][]byte{certContent},
+	}, nil
+}
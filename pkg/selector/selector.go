@@ -0,0 +1,229 @@
+// Package selector implements label selectors for picking workers.
+//
+// A selector is a comma separated list of requirements which all have to match:
+//
+//	env=prod            label env equals prod (== is also accepted)
+//	env!=prod           label env is missing or not prod
+//	role in (web,api)   label role is one of the listed values
+//	role notin (db)     label role is missing or none of the listed values
+//	role                label role is present
+//	!role               label role is missing
+package selector
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+type operator string
+
+const (
+	opEquals    operator = "="
+	opNotEquals operator = "!="
+	opIn        operator = "in"
+	opNotIn     operator = "notin"
+	opExists    operator = "exists"
+	opNotExists operator = "!exists"
+)
+
+type requirement struct {
+	key    string
+	op     operator
+	values []string
+}
+
+func (r requirement) matches(labels map[string]string) bool {
+	value, ok := labels[r.key]
+
+	switch r.op {
+	case opExists:
+		return ok
+	case opNotExists:
+		return !ok
+	case opEquals, opIn:
+		return ok && r.hasValue(value)
+	case opNotEquals, opNotIn:
+		return !ok || !r.hasValue(value)
+	default:
+		return false
+	}
+}
+
+func (r requirement) hasValue(value string) bool {
+	for _, v := range r.values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Selector matches a set of labels. The zero value matches everything.
+type Selector struct {
+	requirements []requirement
+}
+
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, req := range s.requirements {
+		if !req.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s Selector) Empty() bool {
+	return len(s.requirements) == 0
+}
+
+var (
+	validName = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._/-]*[A-Za-z0-9])?$`)
+	setSyntax = regexp.MustCompile(`^(\S+)\s+(in|notin)\s*\((.*)\)$`)
+)
+
+func checkName(kind string, name string, term string) error {
+	if !validName.MatchString(name) {
+		return fmt.Errorf("invalid %s %q in selector term %q", kind, name, term)
+	}
+	return nil
+}
+
+func parseRequirement(term string) (requirement, error) {
+	if match := setSyntax.FindStringSubmatch(term); match != nil {
+		req := requirement{key: match[1], op: operator(match[2])}
+		if err := checkName("key", req.key, term); err != nil {
+			return requirement{}, err
+		}
+
+		for _, value := range strings.Split(match[3], ",") {
+			value = strings.TrimSpace(value)
+			if err := checkName("value", value, term); err != nil {
+				return requirement{}, err
+			}
+			req.values = append(req.values, value)
+		}
+
+		return req, nil
+	}
+
+	var req requirement
+
+	if strings.HasPrefix(term, "!") && !strings.Contains(term, "=") {
+		req = requirement{key: strings.TrimSpace(term[1:]), op: opNotExists}
+	} else if key, value, ok := strings.Cut(term, "!="); ok {
+		req = requirement{key: key, op: opNotEquals, values: []string{value}}
+	} else if key, value, ok := strings.Cut(term, "=="); ok {
+		req = requirement{key: key, op: opEquals, values: []string{value}}
+	} else if key, value, ok := strings.Cut(term, "="); ok {
+		req = requirement{key: key, op: opEquals, values: []string{value}}
+	} else {
+		req = requirement{key: term, op: opExists}
+	}
+
+	req.key = strings.TrimSpace(req.key)
+	if err := checkName("key", req.key, term); err != nil {
+		return requirement{}, err
+	}
+
+	for i, value := range req.values {
+		req.values[i] = strings.TrimSpace(value)
+		if err := checkName("value", req.values[i], term); err != nil {
+			return requirement{}, err
+		}
+	}
+
+	return req, nil
+}
+
+// splitTerms splits the selector on commas that are not inside a value list.
+func splitTerms(s string) ([]string, error) {
+	var (
+		terms []string
+		depth int
+		start int
+	)
+
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth < 0 {
+				return nil, fmt.Errorf("unbalanced parentheses in selector %q", s)
+			}
+		case ',':
+			if depth == 0 {
+				terms = append(terms, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	if depth != 0 {
+		return nil, fmt.Errorf("unbalanced parentheses in selector %q", s)
+	}
+
+	return append(terms, s[start:]), nil
+}
+
+// Parse parses a selector. An empty string parses to a selector that matches everything.
+func Parse(s string) (Selector, error) {
+	if strings.TrimSpace(s) == "" {
+		return Selector{}, nil
+	}
+
+	terms, err := splitTerms(s)
+	if err != nil {
+		return Selector{}, err
+	}
+
+	var ret Selector
+
+	for _, term := range terms {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			return Selector{}, fmt.Errorf("empty term in selector %q", s)
+		}
+
+		req, err := parseRequirement(term)
+		if err != nil {
+			return Selector{}, err
+		}
+
+		ret.requirements = append(ret.requirements, req)
+	}
+
+	return ret, nil
+}
+
+// ParseLabels parses a comma separated list of key=value pairs.
+func ParseLabels(s string) (map[string]string, error) {
+	ret := make(map[string]string)
+
+	if strings.TrimSpace(s) == "" {
+		return ret, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("label %q is not in key=value format", pair)
+		}
+
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+
+		if err := checkName("key", key, pair); err != nil {
+			return nil, err
+		}
+		if err := checkName("value", value, pair); err != nil {
+			return nil, err
+		}
+
+		ret[key] = value
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,99 @@
+package selector
+
+import "testing"
+
+func TestParseAndMatch(t *testing.T) {
+	web := map[string]string{"env": "prod", "role": "web", "zone": "eu-1"}
+	db := map[string]string{"env": "prod", "role": "db"}
+	dev := map[string]string{"env": "dev"}
+
+	tests := []struct {
+		selector string
+		matches  []bool // web, db, dev
+	}{
+		{"", []bool{true, true, true}},
+		{"env=prod", []bool{true, true, false}},
+		{"env==prod", []bool{true, true, false}},
+		{" env = prod ", []bool{true, true, false}},
+		{"env!=prod", []bool{false, false, true}},
+		{"role", []bool{true, true, false}},
+		{"!role", []bool{false, false, true}},
+		{"role in (web, api)", []bool{true, false, false}},
+		{"role notin (db)", []bool{true, false, true}},
+		{"env=prod,role in (web,db),!zone", []bool{false, true, false}},
+		{"zone=eu-1", []bool{true, false, false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			sel, err := Parse(tt.selector)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, labels := range []map[string]string{web, db, dev} {
+				if got := sel.Matches(labels); got != tt.matches[i] {
+					t.Errorf("Matches(%v) = %v, want %v", labels, got, tt.matches[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, s := range []string{
+		"env=prod,",
+		",env=prod",
+		"env=",
+		"=prod",
+		"role in (web",
+		"role in web)",
+		"role in (web,)",
+		"env=pr od",
+		"-env",
+		"env=prod!",
+	} {
+		t.Run(s, func(t *testing.T) {
+			if _, err := Parse(s); err == nil {
+				t.Fatalf("selector was accepted")
+			}
+		})
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	tests := []struct {
+		labels string
+		want   map[string]string
+		err    bool
+	}{
+		{"", map[string]string{}, false},
+		{"env=prod", map[string]string{"env": "prod"}, false},
+		{"env=prod, role=web", map[string]string{"env": "prod", "role": "web"}, false},
+		{"env", nil, true},
+		{"env=", nil, true},
+		{"env=a b", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.labels, func(t *testing.T) {
+			got, err := ParseLabels(tt.labels)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("got %v, want an error", got)
+				}
+				return
+			}
+
+			if err != nil || len(got) != len(tt.want) {
+				t.Fatalf("got %v, %v, want %v", got, err, tt.want)
+			}
+
+			for key, value := range tt.want {
+				if got[key] != value {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Vbitz/raise/v2/pkg/audit"
+	"github.com/Vbitz/raise/v2/pkg/proto"
+	"github.com/cenkalti/rpc2"
+)
+
+// KindAudit lets a role query the audit log. Only roles without a worker selector can grant it.
+const KindAudit = "audit"
+
+// The key of the remote address in the rpc2 state of a client connection.
+const addressStateKey = "address"
+
+// fingerprint returns the hex encoded SHA-256 of the client certificate.
+func (c *Client) fingerprint() string {
+	sum := sha256.Sum256(c.certificate.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// SetAuditLog records every call clients make through the server in logger.
+// The content of scripts and files is only recorded if logContent is set. Otherwise only its hash is.
+func (s *Server) SetAuditLog(logger *audit.Logger, logContent bool) {
+	s.auditLog = logger
+	s.auditContent = logContent
+}
+
+// ReopenAuditLog reopens the audit log file after it was rotated by another program.
+func (s *Server) ReopenAuditLog() error {
+	if s.auditLog == nil {
+		return nil
+	}
+
+	return s.auditLog.Reopen()
+}
+
+// auditEvent starts an event for a call from a client connection.
+func (c *Client) auditEvent(client *rpc2.Client, method string, worker string) proto.AuditEvent {
+	event := proto.AuditEvent{
+		Time:        time.Now(),
+		Client:      c.Name,
+		Fingerprint: c.fingerprint(),
+		Method:      method,
+		Worker:      worker,
+	}
+
+	if client != nil && client.State != nil {
+		if address, ok := client.State.Get(addressStateKey); ok {
+			event.Address, _ = address.(string)
+		}
+	}
+
+	return event
+}
+
+// auditMessage fills in the details of a message.
+func (c *Client) auditMessage(event *proto.AuditEvent, req proto.SendMessageReq) {
+	event.Kind = string(req.Kind)
+	event.RequestID = req.RequestID
+	event.Filename = req.Filename
+	event.Destination = req.Destination
+
+	if len(req.Content) > 0 {
+		sum := sha256.Sum256(req.Content)
+		event.ContentSHA256 = hex.EncodeToString(sum[:])
+		event.ContentSize = len(req.Content)
+
+		if c.server.auditContent {
+			event.Content = req.Content
+		}
+	}
+}
+
+// finishAudit records the outcome of a call and writes the event.
+func (c *Client) finishAudit(event proto.AuditEvent, err error) {
+	if c.server.auditLog == nil {
+		return
+	}
+
+	event.DurationMS = time.Since(event.Time).Milliseconds()
+
+	var denied *policyError
+	if errors.As(err, &denied) {
+		event.Outcome = proto.AuditDenied
+		event.Error = err.Error()
+	} else if err != nil {
+		event.Outcome = proto.AuditError
+		event.Error = err.Error()
+	} else if event.Outcome == "" {
+		event.Outcome = proto.AuditOK
+	}
+
+	if err := c.server.auditLog.Log(event); err != nil {
+		log.Printf("failed to write audit event: %v", err)
+	}
+}
+
+// forwardAudited forwards a message to a worker and records it in the audit log.
+func (c *Client) forwardAudited(client *rpc2.Client, ctx context.Context, req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	event := c.auditEvent(client, proto.Common_SendMessage, req.Target)
+	c.auditMessage(&event, req)
+
+	err := c.forwardMessage(ctx, req, resp)
+	if err == nil && resp.QueuedID != "" {
+		event.Outcome = proto.AuditQueued
+	}
+
+	// Filesystem errors arrive in the response so the client can see their cause, but still failed.
+	if err == nil {
+		c.finishAudit(event, resp.FileErr())
+	} else {
+		c.finishAudit(event, err)
+	}
+
+	return err
+}
+
+// AuditEvents implements proto.ClientService
+func (c *Client) AuditEvents(client *rpc2.Client, req proto.AuditEventsReq, resp *proto.AuditEventsResp) error {
+	*resp = proto.AuditEventsResp{}
+
+	if err := c.server.authorize(c, "", nil, KindAudit, nil); err != nil {
+		return err
+	}
+
+	if c.server.auditLog == nil {
+		return fmt.Errorf("the server does not keep an audit log")
+	}
+
+	events, err := c.server.auditLog.Query(req)
+	if err != nil {
+		return err
+	}
+
+	resp.Events = events
+
+	return nil
+}
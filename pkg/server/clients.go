@@ -0,0 +1,271 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ParseClientList parses a list of trusted clients. Each line holds a base64 encoded DER certificate
+// and the name of the client separated by a space. Empty lines and lines starting with # are skipped.
+func ParseClientList(content []byte) ([]Client, error) {
+	var ret []Client
+
+	names := make(map[string]bool)
+
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		tokens := strings.Split(line, " ")
+		if len(tokens) != 2 {
+			return nil, fmt.Errorf("line %d: want <certificate> <name>", i+1)
+		}
+
+		if names[tokens[1]] {
+			return nil, fmt.Errorf("line %d: client %s is listed twice", i+1, tokens[1])
+		}
+		names[tokens[1]] = true
+
+		client := Client{
+			Name:              tokens[1],
+			CertificateString: tokens[0],
+		}
+
+		if _, err := client.parseCertificate(); err != nil {
+			return nil, fmt.Errorf("line %d: invalid certificate for client %s: %v", i+1, client.Name, err)
+		}
+
+		ret = append(ret, client)
+	}
+
+	return ret, nil
+}
+
+func (c *Client) parseCertificate() (*x509.Certificate, error) {
+	bytes, err := base64.StdEncoding.DecodeString(c.CertificateString)
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(bytes)
+}
+
+func (s *Server) AddClient(client Client) error {
+	cert, err := client.parseCertificate()
+	if err != nil {
+		return err
+	}
+
+	s.clientsMtx.Lock()
+	defer s.clientsMtx.Unlock()
+
+	s.permittedClients = append(s.permittedClients, &Client{
+		Name:              client.Name,
+		CertificateString: client.CertificateString,
+		server:            s,
+		certificate:       cert,
+	})
+
+	return nil
+}
+
+// SetClients replaces the permitted clients. Clients that were removed or whose certificate changed
+// are disconnected, which closes their sessions. Clients that are unchanged stay connected.
+func (s *Server) SetClients(clients []Client) error {
+	permitted := make([]*Client, 0, len(clients))
+
+	for _, client := range clients {
+		cert, err := client.parseCertificate()
+		if err != nil {
+			return fmt.Errorf("invalid certificate for client %s: %v", client.Name, err)
+		}
+
+		permitted = append(permitted, &Client{
+			Name:              client.Name,
+			CertificateString: client.CertificateString,
+			server:            s,
+			certificate:       cert,
+		})
+	}
+
+	s.clientsMtx.Lock()
+
+	existing := make(map[string]*Client)
+	for _, client := range s.permittedClients {
+		existing[client.Name] = client
+	}
+
+	var added, removed, changed []string
+	var dropped []*Client
+
+	for i, client := range permitted {
+		old, ok := existing[client.Name]
+		delete(existing, client.Name)
+
+		if !ok {
+			added = append(added, client.Name)
+		} else if !old.certificate.Equal(client.certificate) {
+			changed = append(changed, client.Name)
+			dropped = append(dropped, old)
+		} else {
+			// Keep the same client so its connections are still tracked.
+			permitted[i] = old
+		}
+	}
+
+	for name, old := range existing {
+		removed = append(removed, name)
+		dropped = append(dropped, old)
+	}
+
+	s.permittedClients = permitted
+
+	var conns []net.Conn
+	for _, client := range dropped {
+		for conn := range s.clientConns[client] {
+			conns = append(conns, conn)
+		}
+		delete(s.clientConns, client)
+	}
+
+	s.clientsMtx.Unlock()
+
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+
+	log.Printf("client list updated: %d clients, added %v, removed %v, certificate changed %v, closing %d connections",
+		len(permitted), added, removed, changed, len(conns))
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	return nil
+}
+
+// clientConnected tracks a connection from a client so it can be closed if the client is removed.
+// It returns false if the client was removed since it authenticated. Clients with a certificate
+// from the CA are not in the client list. They are disconnected by CloseRevoked instead.
+func (s *Server) clientConnected(client *Client, conn net.Conn) bool {
+	s.clientsMtx.Lock()
+	defer s.clientsMtx.Unlock()
+
+	found := client.issued
+	for _, permitted := range s.permittedClients {
+		if permitted == client {
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		return false
+	}
+
+	if s.clientConns[client] == nil {
+		s.clientConns[client] = make(map[net.Conn]bool)
+	}
+	s.clientConns[client][conn] = true
+
+	return true
+}
+
+func (s *Server) clientDisconnected(client *Client, conn net.Conn) {
+	s.clientsMtx.Lock()
+	defer s.clientsMtx.Unlock()
+
+	delete(s.clientConns[client], conn)
+
+	if len(s.clientConns[client]) == 0 {
+		delete(s.clientConns, client)
+	}
+}
+
+// LoadClientList reads the permitted clients from a file written as described by ParseClientList.
+// The file is remembered for ReloadClientList and WatchClientList. A file that fails to parse is
+// rejected and the current clients are kept.
+func (s *Server) LoadClientList(filename string) error {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	clients, err := ParseClientList(content)
+	if err != nil {
+		return fmt.Errorf("invalid client list %s: %v", filename, err)
+	}
+
+	if err := s.SetClients(clients); err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(content)
+
+	s.clientsMtx.Lock()
+	s.clientListFile = filename
+	s.clientListSum = sum[:]
+	s.clientsMtx.Unlock()
+
+	return nil
+}
+
+// ReloadClientList loads the file last passed to LoadClientList again.
+func (s *Server) ReloadClientList() error {
+	s.clientsMtx.RLock()
+	filename := s.clientListFile
+	s.clientsMtx.RUnlock()
+
+	if filename == "" {
+		return fmt.Errorf("no client list loaded")
+	}
+
+	return s.LoadClientList(filename)
+}
+
+// WatchClientList checks the client list file every interval and reloads it once its content changes.
+// It runs until the process exits.
+func (s *Server) WatchClientList(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.clientsMtx.RLock()
+		filename, previous := s.clientListFile, s.clientListSum
+		s.clientsMtx.RUnlock()
+
+		if filename == "" {
+			continue
+		}
+
+		content, err := os.ReadFile(filename)
+		if err != nil {
+			log.Printf("failed to check client list: %v", err)
+			continue
+		}
+
+		sum := sha256.Sum256(content)
+		if bytes.Equal(sum[:], previous) {
+			continue
+		}
+
+		log.Printf("client list %s changed, reloading", filename)
+
+		if err := s.LoadClientList(filename); err != nil {
+			log.Printf("failed to reload client list: %v", err)
+
+			// Do not retry the same broken file until it changes again.
+			s.clientsMtx.Lock()
+			s.clientListSum = sum[:]
+			s.clientsMtx.Unlock()
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseClientList(t *testing.T) {
+	alice := testClient(t, "alice")
+	bob := testClient(t, "bob")
+
+	tests := []struct {
+		name  string
+		lines []string
+		want  []string
+		err   bool
+	}{
+		{"clients", []string{alice.CertificateString + " alice", bob.CertificateString + " bob"}, []string{"alice", "bob"}, false},
+		{"comments and blank lines", []string{"# trusted", "", "  " + alice.CertificateString + " alice  ", "\r"}, []string{"alice"}, false},
+		{"empty", nil, nil, false},
+		{"missing name", []string{alice.CertificateString}, nil, true},
+		{"extra field", []string{alice.CertificateString + " alice admin"}, nil, true},
+		{"listed twice", []string{alice.CertificateString + " alice", bob.CertificateString + " alice"}, nil, true},
+		{"invalid base64", []string{"!!! alice"}, nil, true},
+		{"not a certificate", []string{"aGVsbG8= alice"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clients, err := ParseClientList([]byte(strings.Join(tt.lines, "\n")))
+			if tt.err {
+				if err == nil {
+					t.Fatalf("got %v, want an error", clients)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var names []string
+			for _, client := range clients {
+				names = append(names, client.Name)
+			}
+
+			if strings.Join(names, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("got %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetClientsKeepsUnchanged(t *testing.T) {
+	alice := testClient(t, "alice")
+	bob := testClient(t, "bob")
+
+	s := NewServer("", "", "")
+	if err := s.SetClients([]Client{alice, bob}); err != nil {
+		t.Fatal(err)
+	}
+
+	kept := s.permittedClients[0]
+
+	if err := s.SetClients([]Client{alice, testClient(t, "bob")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.permittedClients[0] != kept {
+		t.Errorf("unchanged client was replaced, which loses track of its connections")
+	}
+
+	if s.permittedClients[1].CertificateString == bob.CertificateString {
+		t.Errorf("client with a new certificate still has the old one")
+	}
+
+	if err := s.SetClients([]Client{{Name: "broken", CertificateString: "!!!"}}); err == nil {
+		t.Fatalf("invalid client was accepted")
+	}
+
+	if len(s.permittedClients) != 2 {
+		t.Fatalf("a rejected client list replaced the clients")
+	}
+}
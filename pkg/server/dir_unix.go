@@ -0,0 +1,16 @@
+//go:build !windows
+
+package server
+
+import "os"
+
+// syncDir flushes the entries of a directory to disk so a file renamed into it survives a crash.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
@@ -0,0 +1,8 @@
+//go:build windows
+
+package server
+
+// syncDir does nothing. Windows can not open a directory to flush it.
+func syncDir(dir string) error {
+	return nil
+}
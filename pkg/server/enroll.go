@@ -0,0 +1,161 @@
+package server
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Vbitz/raise/v2/pkg/ca"
+	"github.com/Vbitz/raise/v2/pkg/proto"
+)
+
+// The largest enrollment request accepted.
+const maxEnrollSize = 64 * 1024
+
+// SetAuthority trusts clients and workers presenting a certificate issued by authority
+// in addition to the ones in the client and worker lists, and serves /enroll and /renew.
+func (s *Server) SetAuthority(authority *ca.Authority) {
+	s.ca = authority
+}
+
+// issuedClient returns a client for a certificate issued by the CA.
+func (s *Server) issuedClient(certs []*x509.Certificate) *Client {
+	if s.ca == nil {
+		return nil
+	}
+
+	name, err := s.ca.Verify(certs, ca.RoleClient)
+	if err != nil {
+		return nil
+	}
+
+	return &Client{
+		Name:        name,
+		server:      s,
+		certificate: certs[0],
+		issued:      true,
+	}
+}
+
+// issuedWorker returns the identity of a worker for a certificate issued by the CA.
+func (s *Server) issuedWorker(certs []*x509.Certificate) *WorkerIdentity {
+	if s.ca == nil {
+		return nil
+	}
+
+	name, err := s.ca.Verify(certs, ca.RoleWorker)
+	if err != nil {
+		return nil
+	}
+
+	return &WorkerIdentity{
+		Name:        name,
+		certificate: certs[0],
+		issued:      true,
+	}
+}
+
+// CloseRevoked disconnects clients and workers whose certificate from the CA was revoked since they connected.
+func (s *Server) CloseRevoked() {
+	if s.ca == nil {
+		return
+	}
+
+	var conns []net.Conn
+
+	s.clientsMtx.Lock()
+	for client, clientConns := range s.clientConns {
+		if !client.issued || !s.ca.Revoked(client.certificate) {
+			continue
+		}
+
+		log.Printf("certificate of client %s was revoked, closing %d connections", client.Name, len(clientConns))
+
+		for conn := range clientConns {
+			conns = append(conns, conn)
+		}
+		delete(s.clientConns, client)
+	}
+	s.clientsMtx.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	for _, worker := range s.workers.list() {
+		if !worker.identity.issued || !s.ca.Revoked(worker.identity.certificate) {
+			continue
+		}
+
+		log.Printf("certificate of worker %s was revoked, disconnecting it", worker.name)
+
+		worker.rpcClient.Close()
+	}
+}
+
+// WatchRevocations calls CloseRevoked every interval. It runs until the process exits.
+func (s *Server) WatchRevocations(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.CloseRevoked()
+	}
+}
+
+func (s *Server) handleEnroll(w http.ResponseWriter, r *http.Request) {
+	var req proto.EnrollReq
+
+	s.handleSign(w, r, &req, func() ([]byte, ca.Token, error) {
+		return s.ca.Enroll(req.Token, req.CSR)
+	})
+}
+
+func (s *Server) handleRenew(w http.ResponseWriter, r *http.Request) {
+	var req proto.RenewReq
+
+	s.handleSign(w, r, &req, func() ([]byte, ca.Token, error) {
+		return s.ca.Renew(r.TLS.PeerCertificates, req.CSR)
+	})
+}
+
+// handleSign decodes a JSON request into req and answers with the certificate sign issues.
+func (s *Server) handleSign(w http.ResponseWriter, r *http.Request, req interface{}, sign func() ([]byte, ca.Token, error)) {
+	if s.ca == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxEnrollSize)).Decode(req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	cert, identity, err := sign()
+	if err != nil {
+		log.Printf("failed to issue certificate for %s at %s: %v", r.RemoteAddr, r.URL.Path, err)
+
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	serial := "unknown"
+	if parsed, err := x509.ParseCertificate(cert); err == nil {
+		serial = ca.SerialString(parsed.SerialNumber)
+	}
+
+	log.Printf("issued %s certificate %s for %s to %s at %s", identity.Role, serial, identity.Name, r.RemoteAddr, r.URL.Path)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(proto.EnrollResp{
+		Certificate: cert,
+		Role:        identity.Role,
+		Name:        identity.Name,
+	})
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/Vbitz/raise/v2/pkg/selector"
+)
+
+// ForwardRule lets a client forward TCP connections through workers.
+type ForwardRule struct {
+	// A label selector for the workers the rule applies to. Empty matches every worker.
+	Workers string
+	// A pattern for the host:port the worker connects to such as "localhost:*". See path.Match for the syntax.
+	Address string
+}
+
+type forwardRule struct {
+	workers selector.Selector
+	address string
+}
+
+// SetForwardPolicy sets where each client may forward connections to, keyed by client name.
+// Clients without any rules can not forward at all.
+func (s *Server) SetForwardPolicy(policy map[string][]ForwardRule) error {
+	rules := make(map[string][]forwardRule)
+
+	for client, clientRules := range policy {
+		for _, rule := range clientRules {
+			sel, err := selector.Parse(rule.Workers)
+			if err != nil {
+				return fmt.Errorf("invalid forward rule for client %s: %v", client, err)
+			}
+
+			if _, err := path.Match(rule.Address, ""); err != nil {
+				return fmt.Errorf("invalid forward rule for client %s: bad address pattern %s", client, rule.Address)
+			}
+
+			rules[client] = append(rules[client], forwardRule{
+				workers: sel,
+				address: rule.Address,
+			})
+		}
+	}
+
+	s.forwardPolicy = rules
+
+	return nil
+}
+
+func (s *Server) allowForward(client *Client, worker *Worker, address string) bool {
+	for _, rule := range s.forwardPolicy[client.Name] {
+		if !rule.workers.Matches(worker.labels) {
+			continue
+		}
+
+		if ok, _ := path.Match(rule.address, address); ok {
+			return true
+		}
+	}
+
+	return false
+}
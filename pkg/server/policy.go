@@ -0,0 +1,332 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Vbitz/raise/v2/pkg/proto"
+	"github.com/Vbitz/raise/v2/pkg/selector"
+)
+
+// Kinds used in roles for requests that are not messages.
+const (
+	KindPing    = "ping"
+	KindInfo    = "info"
+	KindShell   = "shell"
+	KindForward = "forward"
+)
+
+// kindGroups are names for sets of kinds that can be used in roles.
+var kindGroups = map[string][]string{
+	// Everything that only looks at the worker.
+	"read": {
+		KindPing,
+		KindInfo,
+		string(proto.MessageReadFile),
+		string(proto.MessageStatFile),
+		string(proto.MessageReadChunk),
+		string(proto.MessageStat),
+		string(proto.MessageListDir),
+		string(proto.MessageReadlink),
+		string(proto.MessageManifest),
+		string(proto.MessageProcesses),
+		string(proto.MessageJobs),
+		string(proto.MessageJobStatus),
+		string(proto.MessageJobOutput),
+		string(proto.MessageWaitJob),
+	},
+	// Everything that changes files.
+	"write": {
+		string(proto.MessageWriteFile),
+		string(proto.MessageWriteChunk),
+		string(proto.MessageStatUpload),
+		string(proto.MessageFinishWrite),
+		string(proto.MessageMkdir),
+		string(proto.MessageRemove),
+		string(proto.MessageRename),
+		string(proto.MessageSymlink),
+		string(proto.MessageChmod),
+		string(proto.MessageChown),
+		string(proto.MessageExtract),
+	},
+}
+
+// knownKinds are the kinds a role may name.
+var knownKinds = map[string]bool{
+	KindShell:   true,
+	KindForward: true,
+	KindAudit:   true,
+
+	string(proto.MessageRunScript): true,
+	string(proto.MessagePack):      true,
+	string(proto.MessageKill):      true,
+	string(proto.MessageStartJob):  true,
+	string(proto.MessageCancelJob): true,
+	string(proto.MessageRemoveJob): true,
+}
+
+func init() {
+	for _, kinds := range kindGroups {
+		for _, kind := range kinds {
+			knownKinds[kind] = true
+		}
+	}
+}
+
+// Role is a set of things a client may do on some workers.
+type Role struct {
+	// The kinds of message the role allows such as "Msg_ReadFile", the groups "read" and "write",
+	// "ping", "info", "shell", "forward" or "*" for everything. Forwarding also needs a forward rule.
+	Kinds []string
+	// A label selector for the workers the role applies to. Empty matches every worker.
+	Workers string
+	// Absolute path prefixes file messages are limited to such as "/var/log". Empty allows every path.
+	// Paths are compared as written so they do not limit scripts, shells or where symbolic links lead.
+	Paths []string
+}
+
+// Policy controls what each client may do. Clients without a role can not do anything.
+type Policy struct {
+	Roles map[string]Role
+	// The names of the roles of each client by client name.
+	Clients map[string][]string
+}
+
+type role struct {
+	name    string
+	kinds   map[string]bool
+	workers selector.Selector
+	source  string
+	paths   []string
+}
+
+func (r *role) allowsPath(filename string) bool {
+	if len(r.paths) == 0 {
+		return true
+	}
+
+	if !path.IsAbs(filename) {
+		return false
+	}
+
+	filename = path.Clean(filename)
+
+	for _, prefix := range r.paths {
+		if prefix == "/" || filename == prefix || strings.HasPrefix(filename, prefix+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// check returns why the role does not allow an action or nil if it does.
+func (r *role) check(worker string, labels map[string]string, kind string, paths []string) error {
+	if worker == "" && !r.workers.Empty() {
+		return fmt.Errorf("role %s is limited to workers %s", r.name, r.source)
+	} else if !r.workers.Matches(labels) {
+		return fmt.Errorf("role %s does not apply to %s (workers %s)", r.name, worker, r.source)
+	}
+
+	if !r.kinds["*"] && !r.kinds[kind] {
+		return fmt.Errorf("role %s does not allow %s", r.name, kind)
+	}
+
+	for _, filename := range paths {
+		if !r.allowsPath(filename) {
+			return fmt.Errorf("role %s does not allow %s (paths %s)", r.name, filename, strings.Join(r.paths, ", "))
+		}
+	}
+
+	return nil
+}
+
+// policyError is returned when the policy denies a request.
+type policyError struct {
+	msg string
+}
+
+func (e *policyError) Error() string {
+	return e.msg
+}
+
+type policy struct {
+	clients map[string][]*role
+}
+
+// SetPolicy limits what clients may do. A nil policy lets every client do everything.
+func (s *Server) SetPolicy(p *Policy) error {
+	if p == nil {
+		s.policy = nil
+		return nil
+	}
+
+	roles := make(map[string]*role)
+
+	for name, r := range p.Roles {
+		sel, err := selector.Parse(r.Workers)
+		if err != nil {
+			return fmt.Errorf("invalid role %s: %v", name, err)
+		}
+
+		parsed := &role{
+			name:    name,
+			kinds:   make(map[string]bool),
+			workers: sel,
+			source:  r.Workers,
+		}
+
+		for _, kind := range r.Kinds {
+			if group, ok := kindGroups[kind]; ok {
+				for _, kind := range group {
+					parsed.kinds[kind] = true
+				}
+			} else if kind == "*" || knownKinds[kind] {
+				parsed.kinds[kind] = true
+			} else {
+				return fmt.Errorf("invalid role %s: unknown kind %s", name, kind)
+			}
+		}
+
+		for _, prefix := range r.Paths {
+			if !path.IsAbs(prefix) {
+				return fmt.Errorf("invalid role %s: path %s is not absolute", name, prefix)
+			}
+			parsed.paths = append(parsed.paths, path.Clean(prefix))
+		}
+
+		roles[name] = parsed
+	}
+
+	clients := make(map[string][]*role)
+
+	for client, names := range p.Clients {
+		for _, name := range names {
+			r, ok := roles[name]
+			if !ok {
+				return fmt.Errorf("client %s has unknown role %s", client, name)
+			}
+			clients[client] = append(clients[client], r)
+		}
+	}
+
+	s.policy = &policy{clients: clients}
+
+	return nil
+}
+
+// messagePaths returns the paths on the worker a message touches.
+func messagePaths(req proto.SendMessageReq) []string {
+	var ret []string
+
+	if req.Filename != "" {
+		ret = append(ret, req.Filename)
+	}
+
+	switch req.Kind {
+	case proto.MessageRename, proto.MessageSymlink, proto.MessageExtract:
+		ret = append(ret, req.Destination)
+	}
+
+	return ret
+}
+
+// packGrantTTL is how long a client may fetch an archive a pack message staged on a worker.
+const packGrantTTL = time.Hour
+
+// packGrantKinds are what a client may do with an archive a pack message staged. The archive is
+// outside the paths of the client, so its roles were checked against the packed directory instead.
+var packGrantKinds = map[proto.MessageKind]bool{
+	proto.MessageStatFile:  true,
+	proto.MessageReadChunk: true,
+	proto.MessageRemove:    true,
+}
+
+type packGrant struct {
+	client   string
+	worker   string
+	filename string
+}
+
+// packGrants remembers the archives pack messages staged for each client.
+type packGrants struct {
+	mtx    sync.Mutex
+	grants map[packGrant]time.Time
+}
+
+func newPackGrants() *packGrants {
+	return &packGrants{grants: make(map[packGrant]time.Time)}
+}
+
+func (g *packGrants) add(client string, worker string, filename string) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	now := time.Now()
+	for grant, expires := range g.grants {
+		if now.After(expires) {
+			delete(g.grants, grant)
+		}
+	}
+
+	g.grants[packGrant{client, worker, filename}] = now.Add(packGrantTTL)
+}
+
+// allows reports whether a message only fetches or removes an archive staged for the client.
+// Removing the archive ends the grant.
+func (g *packGrants) allows(client string, req proto.SendMessageReq) bool {
+	if !packGrantKinds[req.Kind] {
+		return false
+	}
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	grant := packGrant{client, req.Target, req.Filename}
+
+	expires, ok := g.grants[grant]
+	if !ok || time.Now().After(expires) {
+		return false
+	}
+
+	if req.Kind == proto.MessageRemove {
+		delete(g.grants, grant)
+	}
+
+	return true
+}
+
+// authorize returns an error naming the rules that stop a client from doing something to a worker.
+func (s *Server) authorize(client *Client, worker string, labels map[string]string, kind string, paths []string) error {
+	if s.policy == nil {
+		return nil
+	}
+
+	roles := s.policy.clients[client.Name]
+
+	var reasons []string
+
+	for _, r := range roles {
+		err := r.check(worker, labels, kind, paths)
+		if err == nil {
+			return nil
+		}
+		reasons = append(reasons, err.Error())
+	}
+
+	if len(reasons) == 0 {
+		reasons = append(reasons, "client has no roles")
+	}
+
+	log.Printf("denied %s from client %s to %s: %s", kind, client.Name, worker, strings.Join(reasons, "; "))
+
+	if worker == "" {
+		return &policyError{fmt.Sprintf("client %s is not allowed to use %s: %s", client.Name, kind, strings.Join(reasons, "; "))}
+	}
+
+	return &policyError{fmt.Sprintf("client %s is not allowed to send %s to %s: %s", client.Name, kind, worker, strings.Join(reasons, "; "))}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Vbitz/raise/v2/pkg/proto"
+)
+
+func TestAuthorize(t *testing.T) {
+	policy := &Policy{
+		Roles: map[string]Role{
+			"reader": {Kinds: []string{"read"}},
+			"deployer": {
+				Kinds:   []string{"write", string(proto.MessageRunScript)},
+				Workers: "env=staging",
+				Paths:   []string{"/srv/app/"},
+			},
+			"admin":   {Kinds: []string{"*"}},
+			"auditor": {Kinds: []string{KindAudit}},
+		},
+		Clients: map[string][]string{
+			"alice":  {"reader", "deployer"},
+			"root":   {"admin"},
+			"eve":    {"auditor"},
+			"nobody": {},
+		},
+	}
+
+	staging := map[string]string{"env": "staging"}
+	prod := map[string]string{"env": "prod"}
+
+	tests := []struct {
+		name   string
+		client string
+		worker string
+		labels map[string]string
+		kind   string
+		paths  []string
+		ok     bool
+	}{
+		{"kind in group", "alice", "web1", prod, string(proto.MessageReadFile), []string{"/etc/passwd"}, true},
+		{"group does not cover kind", "alice", "web1", prod, string(proto.MessageRunScript), nil, false},
+		{"second role", "alice", "web1", staging, string(proto.MessageRunScript), nil, true},
+		{"worker selector", "alice", "web1", prod, string(proto.MessageWriteFile), []string{"/srv/app/x"}, false},
+		{"offline worker without labels", "alice", "web1", nil, string(proto.MessageWriteFile), []string{"/srv/app/x"}, false},
+		{"path prefix", "alice", "web1", staging, string(proto.MessageWriteFile), []string{"/srv/app/x"}, true},
+		{"path prefix itself", "alice", "web1", staging, string(proto.MessageMkdir), []string{"/srv/app"}, true},
+		{"path outside prefix", "alice", "web1", staging, string(proto.MessageWriteFile), []string{"/srv/application"}, false},
+		{"path leaving prefix", "alice", "web1", staging, string(proto.MessageWriteFile), []string{"/srv/app/../../etc/passwd"}, false},
+		{"relative path", "alice", "web1", staging, string(proto.MessageWriteFile), []string{"srv/app/x"}, false},
+		{"every path checked", "alice", "web1", staging, string(proto.MessageRename), []string{"/srv/app/x", "/etc/x"}, false},
+		{"wildcard", "root", "web1", prod, KindShell, nil, true},
+		{"server wide kind", "eve", "", nil, KindAudit, nil, true},
+		{"server wide kind without role", "alice", "", nil, KindAudit, nil, false},
+		{"role limited to workers", "alice", "", nil, string(proto.MessageWriteFile), nil, false},
+		{"no roles", "nobody", "web1", prod, KindPing, nil, false},
+		{"unknown client", "mallory", "web1", prod, KindPing, nil, false},
+	}
+
+	s := NewServer("", "", "")
+	if err := s.SetPolicy(policy); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.authorize(&Client{Name: tt.client}, tt.worker, tt.labels, tt.kind, tt.paths)
+			if tt.ok && err != nil {
+				t.Fatalf("denied: %v", err)
+			} else if !tt.ok {
+				var denied *policyError
+				if !errors.As(err, &denied) {
+					t.Fatalf("got %v, want a policy error", err)
+				}
+			}
+		})
+	}
+
+	if err := s.SetPolicy(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.authorize(&Client{Name: "mallory"}, "web1", prod, KindShell, nil); err != nil {
+		t.Fatalf("without a policy: %v", err)
+	}
+}
+
+func TestSetPolicyErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+	}{
+		{"unknown kind", Policy{Roles: map[string]Role{"r": {Kinds: []string{"Msg_Nope"}}}}},
+		{"invalid selector", Policy{Roles: map[string]Role{"r": {Kinds: []string{"read"}, Workers: "env in prod"}}}},
+		{"relative path", Policy{Roles: map[string]Role{"r": {Kinds: []string{"read"}, Paths: []string{"srv"}}}}},
+		{"unknown role", Policy{Clients: map[string][]string{"alice": {"r"}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer("", "", "")
+
+			if err := s.SetPolicy(&tt.policy); err == nil {
+				t.Fatalf("policy was accepted")
+			}
+		})
+	}
+}
+
+func TestKindGroups(t *testing.T) {
+	for group, kinds := range kindGroups {
+		if knownKinds[group] {
+			t.Errorf("group %s has the name of a kind", group)
+		}
+
+		for _, kind := range kinds {
+			if !knownKinds[kind] {
+				t.Errorf("kind %s of group %s is not known", kind, group)
+			}
+		}
+	}
+
+	// Groups are what operators hand out without thinking twice, so nothing that runs code or
+	// opens a shell may be in them.
+	for _, kind := range []string{KindShell, KindForward, KindAudit, string(proto.MessageRunScript), string(proto.MessageStartJob), string(proto.MessageKill)} {
+		for group, kinds := range kindGroups {
+			for _, other := range kinds {
+				if other == kind {
+					t.Errorf("group %s includes %s", group, kind)
+				}
+			}
+		}
+	}
+
+	// The basic file operations have to be in a group so roles limited by path can use them.
+	for _, kind := range []proto.MessageKind{proto.MessageReadFile, proto.MessageWriteFile, proto.MessageRemove, proto.MessageRename, proto.MessageSymlink} {
+		found := false
+		for _, kinds := range kindGroups {
+			for _, other := range kinds {
+				found = found || other == string(kind)
+			}
+		}
+
+		if !found {
+			t.Errorf("%s is in no group", kind)
+		}
+	}
+}
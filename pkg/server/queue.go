@@ -0,0 +1,440 @@
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Vbitz/raise/v2/pkg/proto"
+	"github.com/Vbitz/raise/v2/pkg/request"
+	"github.com/cenkalti/rpc2"
+)
+
+// How long the outcome of a queued message is kept after it was delivered, failed or expired.
+var queueRetention = 7 * 24 * time.Hour
+
+// messageQueue holds messages for offline workers until they connect.
+// Every message is written to its own file in dir so the queue survives a server restart.
+// Without a dir the queue is only kept in memory.
+type messageQueue struct {
+	dir string
+
+	mtx      sync.Mutex
+	messages map[string]*proto.QueuedMessage
+	// Messages being delivered right now so they are not delivered twice.
+	inFlight map[string]bool
+	// Workers messages are being delivered to so they arrive one at a time in order.
+	delivering map[string]bool
+}
+
+func newMessageQueue() *messageQueue {
+	return &messageQueue{
+		messages:   make(map[string]*proto.QueuedMessage),
+		inFlight:   make(map[string]bool),
+		delivering: make(map[string]bool),
+	}
+}
+
+// load reads the queue from dir and keeps it there from now on.
+func (q *messageQueue) load(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	messages := make(map[string]*proto.QueuedMessage)
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+
+		var msg proto.QueuedMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return fmt.Errorf("failed to load queued message %s: %v", entry.Name(), err)
+		}
+
+		messages[msg.ID] = &msg
+	}
+
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	q.dir = dir
+	q.messages = messages
+
+	return nil
+}
+
+// saveLocked writes a message to disk. It replaces the old file in one step so a crash never leaves half of one.
+func (q *messageQueue) saveLocked(msg *proto.QueuedMessage) error {
+	if q.dir == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	filename := filepath.Join(q.dir, msg.ID+".json")
+
+	f, err := os.OpenFile(filename+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+
+	// The content has to be on disk before the rename or a crash can leave an empty message behind.
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(filename+".tmp", filename); err != nil {
+		return err
+	}
+
+	return syncDir(q.dir)
+}
+
+func (q *messageQueue) removeLocked(id string) {
+	delete(q.messages, id)
+
+	if q.dir != "" {
+		if err := os.Remove(filepath.Join(q.dir, id+".json")); err != nil && !os.IsNotExist(err) {
+			log.Printf("failed to remove queued message %s: %v", id, err)
+		}
+	}
+}
+
+// expireLocked marks pending messages past their expiry and forgets finished ones past the retention.
+func (q *messageQueue) expireLocked(now time.Time) {
+	for id, msg := range q.messages {
+		if msg.State == proto.QueuedPending && !q.inFlight[id] && now.After(msg.ExpiresAt) {
+			msg.State = proto.QueuedExpired
+			msg.DeliveredAt = msg.ExpiresAt
+
+			if err := q.saveLocked(msg); err != nil {
+				log.Printf("failed to save queued message %s: %v", id, err)
+			}
+		}
+
+		if msg.State != proto.QueuedPending && now.Sub(msg.DeliveredAt) > queueRetention {
+			q.removeLocked(id)
+		}
+	}
+}
+
+func (q *messageQueue) add(client *Client, req proto.SendMessageReq) (*proto.QueuedMessage, error) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	now := time.Now()
+
+	q.expireLocked(now)
+
+	msg := &proto.QueuedMessage{
+		ID:          request.NewID(),
+		Client:      client.Name,
+		Certificate: base64.StdEncoding.EncodeToString(client.certificate.Raw),
+		Target:      req.Target,
+		State:       proto.QueuedPending,
+		QueuedAt:    now,
+		ExpiresAt:   now.Add(req.QueueFor),
+	}
+
+	// Nobody is listening for output or able to cancel by the original request ID once the client is gone.
+	req.RequestID = msg.ID
+	req.StreamOutput = false
+	req.QueueFor = 0
+
+	msg.Message = req
+
+	if err := q.saveLocked(msg); err != nil {
+		return nil, fmt.Errorf("failed to queue message: %v", err)
+	}
+
+	q.messages[msg.ID] = msg
+
+	ret := *msg
+	return &ret, nil
+}
+
+// startDelivery claims a worker for delivering its messages. It returns false if that is already happening.
+func (q *messageQueue) startDelivery(target string) bool {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if q.delivering[target] {
+		return false
+	}
+
+	q.delivering[target] = true
+
+	return true
+}
+
+func (q *messageQueue) stopDelivery(target string) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	delete(q.delivering, target)
+}
+
+// next claims the oldest pending message for a worker. ok is false if there are none left,
+// in which case the delivery to the worker is over.
+func (q *messageQueue) next(target string) (proto.QueuedMessage, bool) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	q.expireLocked(time.Now())
+
+	var oldest *proto.QueuedMessage
+
+	for id, msg := range q.messages {
+		if msg.Target != target || msg.State != proto.QueuedPending || q.inFlight[id] {
+			continue
+		}
+
+		if oldest == nil || msg.QueuedAt.Before(oldest.QueuedAt) {
+			oldest = msg
+		}
+	}
+
+	if oldest == nil {
+		// Done under the same lock as the check so a message added right now is not missed.
+		delete(q.delivering, target)
+		return proto.QueuedMessage{}, false
+	}
+
+	q.inFlight[oldest.ID] = true
+
+	return *oldest, true
+}
+
+// finish records the outcome of delivering a message claimed with next.
+// A nil resp puts the message back in the queue for the next time the worker connects.
+func (q *messageQueue) finish(id string, resp *proto.SendMessageResp, err error) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	delete(q.inFlight, id)
+
+	msg, ok := q.messages[id]
+	if !ok || resp == nil {
+		return
+	}
+
+	msg.DeliveredAt = time.Now()
+
+	if err == nil {
+		err = resp.FileErr()
+	}
+
+	if err != nil {
+		msg.State = proto.QueuedFailed
+		msg.Error = err.Error()
+	} else {
+		msg.State = proto.QueuedDelivered
+		msg.Response = *resp
+	}
+
+	if err := q.saveLocked(msg); err != nil {
+		log.Printf("failed to save queued message %s: %v", id, err)
+	}
+}
+
+// list returns the messages matching the request oldest first.
+func (q *messageQueue) list(req proto.QueuedMessagesReq) []proto.QueuedMessage {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	q.expireLocked(time.Now())
+
+	var ret []proto.QueuedMessage
+
+	for _, msg := range q.messages {
+		if req.Target != "" && msg.Target != req.Target {
+			continue
+		}
+		if req.ID != "" && msg.ID != req.ID {
+			continue
+		}
+
+		ret = append(ret, *msg)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].QueuedAt.Before(ret[j].QueuedAt)
+	})
+
+	return ret
+}
+
+// deliverQueued sends the messages queued for a worker that just connected one at a time in the order they were queued.
+// A message is kept for next time if the worker goes away again before answering, so it may be delivered more than once.
+func (s *Server) deliverQueued(worker *Worker) {
+	if !s.queue.startDelivery(worker.name) {
+		return
+	}
+
+	for {
+		msg, ok := s.queue.next(worker.name)
+		if !ok {
+			return
+		}
+
+		// The client may have lost access while the message waited so it is checked again.
+		if err := s.authorizeQueued(msg, worker); err != nil {
+			log.Printf("refused to deliver queued message %s from %s to %s: %v", msg.ID, msg.Client, worker.name, err)
+
+			s.queue.finish(msg.ID, &proto.SendMessageResp{}, err)
+			continue
+		}
+
+		ctx := context.Background()
+		cancel := func() {}
+		if msg.Message.Timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, msg.Message.Timeout+timeoutGrace)
+		}
+
+		var resp proto.SendMessageResp
+		err := worker.rpcClient.CallWithContext(ctx, proto.Common_SendMessage, msg.Message, &resp)
+		cancel()
+
+		select {
+		case <-worker.rpcClient.DisconnectNotify():
+			log.Printf("worker %s disconnected while delivering queued message %s", worker.name, msg.ID)
+
+			s.queue.finish(msg.ID, nil, nil)
+			s.queue.stopDelivery(worker.name)
+
+			// The worker may already be back on a new connection that found the delivery still going.
+			if current := s.getWorker(worker.name); current != nil && current != worker {
+				go s.deliverQueued(current)
+			}
+
+			return
+		default:
+		}
+
+		if err != nil {
+			log.Printf("failed to deliver queued message %s to %s: %v", msg.ID, worker.name, err)
+		} else {
+			log.Printf("delivered queued message %s from %s to %s", msg.ID, msg.Client, worker.name)
+		}
+
+		s.queue.finish(msg.ID, &resp, err)
+	}
+}
+
+// queuedClient returns the client that queued msg if it is still trusted with the same certificate,
+// either by the client list or by the CA without its certificate being revoked.
+func (s *Server) queuedClient(msg proto.QueuedMessage) (*Client, error) {
+	queued := Client{Name: msg.Client, CertificateString: msg.Certificate}
+
+	cert, err := queued.parseCertificate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate for client %s: %v", msg.Client, err)
+	}
+
+	s.clientsMtx.RLock()
+	for _, permitted := range s.permittedClients {
+		if permitted.Name == msg.Client && permitted.certificate.Equal(cert) {
+			s.clientsMtx.RUnlock()
+			return permitted, nil
+		}
+	}
+	s.clientsMtx.RUnlock()
+
+	if client := s.issuedClient([]*x509.Certificate{cert}); client != nil && client.Name == msg.Client {
+		return client, nil
+	}
+
+	return nil, fmt.Errorf("client %s is no longer permitted", msg.Client)
+}
+
+// authorizeQueued checks that the client that queued msg may still send it to worker.
+func (s *Server) authorizeQueued(msg proto.QueuedMessage, worker *Worker) error {
+	client, err := s.queuedClient(msg)
+	if err != nil {
+		return err
+	}
+
+	if s.packGrants.allows(client.Name, msg.Message) {
+		return nil
+	}
+
+	return s.authorize(client, worker.name, worker.labels, string(msg.Message.Kind), messagePaths(msg.Message))
+}
+
+// queueMessage keeps a message for a worker that is not connected.
+func (c *Client) queueMessage(req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	if !c.server.knownWorker(req.Target) {
+		return fmt.Errorf("worker %s not connected or non existing", req.Target)
+	}
+
+	msg, err := c.server.queue.add(c, req)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("client %s queued message %s for offline worker %s until %s", c.Name, msg.ID, req.Target, msg.ExpiresAt.Format(time.RFC3339))
+
+	*resp = proto.SendMessageResp{QueuedID: msg.ID}
+
+	// The worker may have connected since it was looked up.
+	if worker := c.server.getWorker(req.Target); worker != nil {
+		go c.server.deliverQueued(worker)
+	}
+
+	return nil
+}
+
+// QueuedMessages implements proto.ClientService
+func (c *Client) QueuedMessages(client *rpc2.Client, req proto.QueuedMessagesReq, resp *proto.QueuedMessagesResp) error {
+	*resp = proto.QueuedMessagesResp{}
+
+	for _, msg := range c.server.queue.list(req) {
+		// Responses can hold file contents so with a policy in place clients only see their own messages.
+		if c.server.policy != nil && msg.Client != c.Name {
+			continue
+		}
+
+		resp.Messages = append(resp.Messages, msg)
+	}
+
+	return nil
+}
+
+// SetQueueDir keeps messages queued for offline workers in dir so they survive a restart.
+// Messages already in dir are loaded.
+func (s *Server) SetQueueDir(dir string) error {
+	return s.queue.load(dir)
+}
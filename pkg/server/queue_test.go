@@ -0,0 +1,195 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Vbitz/raise/v2/pkg/ca"
+	"github.com/Vbitz/raise/v2/pkg/proto"
+)
+
+// testClient returns a client list entry with a new self signed certificate.
+func testClient(t *testing.T, name string) Client {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return Client{Name: name, CertificateString: base64.StdEncoding.EncodeToString(der)}
+}
+
+// issueClient enrolls a client with authority and returns its certificate.
+func issueClient(t *testing.T, authority *ca.Authority, name string) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := authority.CreateToken(ca.RoleClient, name, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, _, err := authority.Enroll(token, csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+func TestDeliveryRechecksClient(t *testing.T) {
+	authority, err := ca.Open(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listed := testClient(t, "alice")
+	replaced := testClient(t, "alice")
+	other := testClient(t, "bob")
+	issued := issueClient(t, authority, "carol")
+	revoked := issueClient(t, authority, "dave")
+
+	if err := authority.Revoke([]string{ca.SerialString(revoked.SerialNumber)}); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := &Policy{
+		Roles: map[string]Role{
+			"reader": {Kinds: []string{"read"}},
+		},
+		Clients: map[string][]string{
+			"alice": {"reader"},
+			"carol": {"reader"},
+			"dave":  {"reader"},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		client      string
+		certificate string
+		kind        proto.MessageKind
+		ok          bool
+	}{
+		{"listed", "alice", listed.CertificateString, proto.MessageReadFile, true},
+		{"denied by policy", "alice", listed.CertificateString, proto.MessageWriteFile, false},
+		{"removed from list", "alice", replaced.CertificateString, proto.MessageReadFile, false},
+		{"certificate of another client", "alice", other.CertificateString, proto.MessageReadFile, false},
+		{"issued", "carol", base64.StdEncoding.EncodeToString(issued.Raw), proto.MessageReadFile, true},
+		{"issued to another name", "alice", base64.StdEncoding.EncodeToString(issued.Raw), proto.MessageReadFile, false},
+		{"revoked", "dave", base64.StdEncoding.EncodeToString(revoked.Raw), proto.MessageReadFile, false},
+		{"no certificate", "alice", "", proto.MessageReadFile, false},
+	}
+
+	s := NewServer("", "", "")
+	s.SetAuthority(authority)
+
+	if err := s.SetClients([]Client{listed, other}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.SetPolicy(policy); err != nil {
+		t.Fatal(err)
+	}
+
+	worker := &Worker{server: s, name: "web1"}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := proto.QueuedMessage{
+				Client:      tt.client,
+				Certificate: tt.certificate,
+				Target:      worker.name,
+				Message:     proto.SendMessageReq{Kind: tt.kind, Target: worker.name, Filename: "/etc/hostname"},
+			}
+
+			err := s.authorizeQueued(msg, worker)
+			if tt.ok && err != nil {
+				t.Fatalf("delivery refused: %v", err)
+			} else if !tt.ok && err == nil {
+				t.Fatalf("delivery allowed")
+			}
+		})
+	}
+}
+
+func TestQueueSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	entry := testClient(t, "alice")
+
+	cert, err := entry.parseCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &Client{Name: entry.Name, certificate: cert}
+
+	q := newMessageQueue()
+	if err := q.load(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := q.add(client, proto.SendMessageReq{Kind: proto.MessageReadFile, Target: "web1", QueueFor: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 || entries[0].Name() != msg.ID+".json" {
+		t.Fatalf("queue directory holds %v, want only %s.json", entries, msg.ID)
+	}
+
+	restarted := newMessageQueue()
+	if err := restarted.load(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	next, ok := restarted.next("web1")
+	if !ok {
+		t.Fatalf("queued message was lost")
+	}
+
+	if next.ID != msg.ID || next.Certificate != entry.CertificateString || next.Message.Kind != proto.MessageReadFile {
+		t.Fatalf("loaded %+v, want %+v", next, msg)
+	}
+}
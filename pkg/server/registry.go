@@ -0,0 +1,143 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/rpc2"
+)
+
+// workerRegistry tracks the live worker sessions by name.
+// It is accessed from every connection goroutine so all access goes through the lock.
+type workerRegistry struct {
+	mtx     sync.RWMutex
+	workers map[string]*Worker
+	// The labels each worker last registered with, kept after it disconnects.
+	labels map[string]map[string]string
+}
+
+// register adds a worker under its name and returns any previous session it replaced.
+func (r *workerRegistry) register(worker *Worker) *Worker {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	previous := r.workers[worker.name]
+
+	r.workers[worker.name] = worker
+	r.labels[worker.name] = worker.labels
+
+	return previous
+}
+
+// unregister marks the worker as disconnected and removes it if it is still the current session for its name.
+func (r *workerRegistry) unregister(worker *Worker) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	worker.disconnectedAt = time.Now()
+
+	if current, ok := r.workers[worker.name]; ok && current == worker {
+		delete(r.workers, worker.name)
+	}
+}
+
+func (r *workerRegistry) get(name string) *Worker {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	return r.workers[name]
+}
+
+// lastLabels returns the labels a worker registered with most recently, even if it is offline now.
+func (r *workerRegistry) lastLabels(name string) map[string]string {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	return r.labels[name]
+}
+
+// list returns the live workers sorted by name.
+func (r *workerRegistry) list() []*Worker {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	var ret []*Worker
+	for _, worker := range r.workers {
+		if !worker.disconnectedAt.IsZero() {
+			continue
+		}
+		ret = append(ret, worker)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].name < ret[j].name
+	})
+
+	return ret
+}
+
+func newWorkerRegistry() *workerRegistry {
+	return &workerRegistry{
+		workers: make(map[string]*Worker),
+		labels:  make(map[string]map[string]string),
+	}
+}
+
+// stream is a client connection waiting for the output of a request.
+type stream struct {
+	client *rpc2.Client
+	// The ID the client chose for the request, which output is sent back under.
+	clientID string
+	// The workers the request was sent to. Output from any other worker is dropped.
+	targets map[string]bool
+}
+
+// streamRegistry routes output streamed by workers to the client connection that asked for it.
+// Streams are keyed by the namespaced request ID the workers see.
+type streamRegistry struct {
+	mtx     sync.Mutex
+	streams map[string]stream
+}
+
+// add routes the output of a request sent to targets to client. A request ID that is already
+// streaming is refused so one request can not take over the output of another.
+func (r *streamRegistry) add(requestID string, clientID string, client *rpc2.Client, targets []string) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if _, ok := r.streams[requestID]; ok {
+		return fmt.Errorf("request %s is already streaming output", clientID)
+	}
+
+	s := stream{client: client, clientID: clientID, targets: make(map[string]bool)}
+	for _, target := range targets {
+		s.targets[target] = true
+	}
+
+	r.streams[requestID] = s
+
+	return nil
+}
+
+func (r *streamRegistry) remove(requestID string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	delete(r.streams, requestID)
+}
+
+func (r *streamRegistry) get(requestID string) (stream, bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	s, ok := r.streams[requestID]
+	return s, ok
+}
+
+func newStreamRegistry() *streamRegistry {
+	return &streamRegistry{
+		streams: make(map[string]stream),
+	}
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/Vbitz/raise/v2/pkg/proto"
+)
+
+func TestStreamRegistryRefusesDuplicates(t *testing.T) {
+	r := newStreamRegistry()
+
+	if err := r.add("a/1", "1", nil, []string{"w1"}); err != nil {
+		t.Fatalf("first add: %v", err)
+	}
+
+	if err := r.add("a/1", "1", nil, []string{"w2"}); err == nil {
+		t.Fatalf("second add of the same request ID was accepted")
+	}
+
+	s, ok := r.get("a/1")
+	if !ok || !s.targets["w1"] || s.targets["w2"] {
+		t.Fatalf("the first stream was replaced: %+v", s)
+	}
+
+	r.remove("a/1")
+
+	if err := r.add("a/1", "1", nil, []string{"w2"}); err != nil {
+		t.Fatalf("add after remove: %v", err)
+	}
+}
+
+func TestOutputDropsChunksFromOtherWorkers(t *testing.T) {
+	s := NewServer("", "", "")
+
+	// The stream has no client, so routing a chunk to it would panic.
+	if err := s.streams.add("a/1", "1", nil, []string{"w1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		requestID string
+	}{
+		{"not a target", "a/1"},
+		{"unknown request", "a/2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &Worker{server: s, name: "w2"}
+
+			var resp proto.OutputResp
+			if err := w.Output(nil, proto.OutputChunk{RequestID: tt.requestID, Data: []byte("x")}, &resp); err != nil {
+				t.Fatalf("Output: %v", err)
+			}
+		})
+	}
+}
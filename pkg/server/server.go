@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
@@ -8,8 +9,17 @@ import (
 	"log"
 	"net"
 	"net/http"
-
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Vbitz/raise/v2/pkg/audit"
+	"github.com/Vbitz/raise/v2/pkg/ca"
+	"github.com/Vbitz/raise/v2/pkg/heartbeat"
 	"github.com/Vbitz/raise/v2/pkg/proto"
+	"github.com/Vbitz/raise/v2/pkg/request"
+	"github.com/Vbitz/raise/v2/pkg/selector"
 	"github.com/cenkalti/rpc2"
 	"github.com/gobwas/ws"
 )
@@ -21,20 +31,29 @@ type Client struct {
 
 	server      *Server
 	certificate *x509.Certificate
+	// Set for clients authenticated by a certificate from the CA rather than the client list.
+	issued bool
 }
 
 // GetInfo implements proto.ClientService
-func (c *Client) GetInfo(client *rpc2.Client, req proto.GetInfoReq, resp *proto.GetInfoResp) error {
+func (c *Client) GetInfo(client *rpc2.Client, req proto.GetInfoReq, resp *proto.GetInfoResp) (err error) {
 	if req.Name == "" {
 		return fmt.Errorf("cannot get info of server")
 	}
 
+	event := c.auditEvent(client, proto.Common_GetInfo, req.Name)
+	defer func() { c.finishAudit(event, err) }()
+
 	worker := c.server.getWorker(req.Name)
 	if worker == nil {
 		return fmt.Errorf("worker %s not connected or non existing", req.Name)
 	}
 
-	err := worker.rpcClient.Call(proto.Common_GetInfo, req, &resp)
+	if err := c.server.authorize(c, worker.name, worker.labels, KindInfo, nil); err != nil {
+		return err
+	}
+
+	err = worker.rpcClient.Call(proto.Common_GetInfo, req, &resp)
 	if err != nil {
 		return fmt.Errorf("failed to call GetInfo on worker: %v", err)
 	}
@@ -44,40 +63,225 @@ func (c *Client) GetInfo(client *rpc2.Client, req proto.GetInfoReq, resp *proto.
 
 // GetWorkers implements proto.ClientService
 func (c *Client) GetWorkers(client *rpc2.Client, req proto.GetWorkersReq, resp *proto.GetWorkersResp) error {
+	sel, err := selector.Parse(req.Selector)
+	if err != nil {
+		return err
+	}
+
 	*resp = proto.GetWorkersResp{}
-	for _, worker := range c.server.connectedWorkers {
-		resp.Workers = append(resp.Workers, worker.name)
+	for _, worker := range c.server.workers.list() {
+		if !sel.Matches(worker.labels) {
+			continue
+		}
+		resp.Workers = append(resp.Workers, worker.record())
 	}
 	return nil
 }
 
+// The number of workers SendMessageAll talks to at once when the client does not ask for a limit.
+const defaultParallelism = 32
+
+// How long the server waits past the timeout of a message for the worker to report back.
+const timeoutGrace = 5 * time.Second
+
+// connectionContext returns a context that is cancelled when the connection goes away.
+func connectionContext(client *rpc2.Client) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		select {
+		case <-client.DisconnectNotify():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// requestID returns the ID a request of the client is known by on the server and workers.
+// Clients pick their own IDs so they are prefixed with the client name to keep them apart.
+func (c *Client) requestID(id string) string {
+	if id == "" {
+		return ""
+	}
+
+	return c.Name + "/" + id
+}
+
+// startMessage returns the context a message to targets is forwarded under. req.RequestID must
+// already be the one from requestID and clientID is the one the client chose.
+// It is cancelled by the client disconnecting, the client calling Cancel, or the message timing out.
+func (c *Client) startMessage(client *rpc2.Client, req proto.SendMessageReq, clientID string, targets []string) (context.Context, context.CancelFunc, error) {
+	if req.StreamOutput && req.RequestID != "" {
+		if err := c.server.streams.add(req.RequestID, clientID, client, targets); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	conn, cancelConn := connectionContext(client)
+
+	timeout := req.Timeout
+	if timeout > 0 {
+		timeout += timeoutGrace
+	}
+
+	ctx, cancel := c.server.requests.Start(conn, req.RequestID, c.Name, timeout)
+
+	return ctx, func() {
+		if req.StreamOutput && req.RequestID != "" {
+			c.server.streams.remove(req.RequestID)
+		}
+
+		cancel()
+		cancelConn()
+	}, nil
+}
+
 // SendMessage implements proto.ClientService
 func (c *Client) SendMessage(client *rpc2.Client, req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	clientID := req.RequestID
+	req.RequestID = c.requestID(clientID)
+
+	ctx, cancel, err := c.startMessage(client, req, clientID, []string{req.Target})
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	return c.forwardAudited(client, ctx, req, resp)
+}
+
+// SendMessageAll implements proto.ClientService
+func (c *Client) SendMessageAll(client *rpc2.Client, req proto.SendMessageAllReq, resp *proto.SendMessageAllResp) error {
+	clientID := req.Message.RequestID
+	req.Message.RequestID = c.requestID(clientID)
+
+	ctx, cancel, err := c.startMessage(client, req.Message, clientID, req.Targets)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	parallelism := req.Parallelism
+	if parallelism <= 0 {
+		parallelism = defaultParallelism
+	}
+
+	*resp = proto.SendMessageAllResp{
+		Results: make([]proto.SendMessageResult, len(req.Targets)),
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, parallelism)
+
+	for i, target := range req.Targets {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(result *proto.SendMessageResult, target string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			msg := req.Message
+			msg.Target = target
+
+			result.Target = target
+
+			err := c.forwardAudited(client, ctx, msg, &result.Response)
+			if err == nil {
+				err = result.Response.FileErr()
+			}
+			if err != nil {
+				result.Error = err.Error()
+			}
+		}(&resp.Results[i], target)
+	}
+
+	wg.Wait()
+
+	return nil
+}
+
+func (c *Client) forwardMessage(ctx context.Context, req proto.SendMessageReq, resp *proto.SendMessageResp) error {
 	if req.Target == "" {
 		return fmt.Errorf("cannot send message to server")
 	}
 
 	worker := c.server.getWorker(req.Target)
-	if worker == nil {
+	if worker == nil && req.QueueFor <= 0 {
 		return fmt.Errorf("worker %s not connected or non existing", req.Target)
 	}
 
-	err := worker.rpcClient.Call(proto.Common_SendMessage, req, &resp)
+	// Offline workers are checked against the labels they last had.
+	labels := c.server.workers.lastLabels(req.Target)
+	if !c.server.packGrants.allows(c.Name, req) {
+		if err := c.server.authorize(c, req.Target, labels, string(req.Kind), messagePaths(req)); err != nil {
+			return err
+		}
+	}
+
+	if worker == nil {
+		return c.queueMessage(req, resp)
+	}
+
+	err := worker.rpcClient.CallWithContext(ctx, proto.Common_SendMessage, req, resp)
+	if ctx.Err() != nil {
+		// Nobody is waiting for the result anymore so stop the worker from working on it.
+		if req.RequestID != "" {
+			worker.rpcClient.Notify(proto.Common_Cancel, proto.CancelReq{RequestID: req.RequestID})
+		}
+
+		return fmt.Errorf("message to %s cancelled: %v", req.Target, ctx.Err())
+	}
 	if err != nil {
 		return fmt.Errorf("failed to call SendMessage on worker: %v", err)
 	}
 
+	// The archive is staged in the temporary directory of the worker, which the paths of the client
+	// may not include. Packing the directory was allowed so fetching the result is too.
+	if req.Kind == proto.MessagePack && c.server.policy != nil && resp.FileErr() == nil {
+		c.server.packGrants.add(c.Name, req.Target, string(resp.Content))
+	}
+
+	return nil
+}
+
+// Cancel implements proto.ClientService
+func (c *Client) Cancel(client *rpc2.Client, req proto.CancelReq, resp *proto.CancelResp) error {
+	*resp = proto.CancelResp{}
+
+	// Only the client that sent a request may cancel it. Its ID is namespaced the same way as when it was sent
+	// so the cancel forwarded to the worker can not reach requests of other clients either.
+	cancelled, err := c.server.requests.Cancel(c.requestID(req.RequestID), c.Name)
+	if err != nil {
+		log.Printf("client %s tried to cancel request %s of another client", c.Name, req.RequestID)
+
+		return fmt.Errorf("failed to cancel request %s: %v", req.RequestID, err)
+	}
+
+	if cancelled {
+		log.Printf("client %s cancelled request %s", c.Name, req.RequestID)
+	}
+
 	return nil
 }
 
 // Ping implements proto.ClientService
-func (c *Client) Ping(client *rpc2.Client, req proto.PingReq, resp *proto.PingResp) error {
+func (c *Client) Ping(client *rpc2.Client, req proto.PingReq, resp *proto.PingResp) (err error) {
 	if req.Name != "" {
+		event := c.auditEvent(client, proto.Common_Ping, req.Name)
+		defer func() { c.finishAudit(event, err) }()
+
 		worker := c.server.getWorker(req.Name)
 		if worker == nil {
 			return fmt.Errorf("worker %s not connected or non existing", req.Name)
 		}
 
+		if err := c.server.authorize(c, worker.name, worker.labels, KindPing, nil); err != nil {
+			return err
+		}
+
 		err := worker.rpcClient.Call(proto.Common_Ping, proto.PingReq{}, &resp)
 		if err != nil {
 			return err
@@ -97,16 +301,75 @@ var (
 	_ proto.ClientService = &Client{}
 )
 
+// WorkerIdentity is a worker permitted to connect to the server.
+// A worker may only register under the name its certificate is listed with.
+type WorkerIdentity struct {
+	Name string
+	// Worker certificate as Base64 encoded DER format.
+	CertificateString string
+
+	certificate *x509.Certificate
+	// Set for workers authenticated by a certificate from the CA rather than the worker list.
+	issued bool
+}
+
 type Worker struct {
 	server    *Server
+	identity  *WorkerIdentity
 	name      string
 	addr      string
 	rpcServer *rpc2.Server
 	rpcClient *rpc2.Client
+	monitor   *heartbeat.Monitor
+
+	connectedAt    time.Time
+	disconnectedAt time.Time
+
+	// Set by the first Hello on the session. Hello is only accepted once, even if it failed.
+	helloMtx sync.Mutex
+	hello    bool
+
+	// Reported by the worker in Hello.
+	commit          string
+	operatingSystem string
+	architecture    string
+	labels          map[string]string
+}
+
+func (w *Worker) record() proto.WorkerRecord {
+	return proto.WorkerRecord{
+		Name:            w.name,
+		Address:         w.addr,
+		State:           w.monitor.State(),
+		ConnectedAt:     w.connectedAt,
+		LastHeartbeat:   w.monitor.LastBeat(),
+		Commit:          w.commit,
+		OperatingSystem: w.operatingSystem,
+		Architecture:    w.architecture,
+		Labels:          w.labels,
+	}
 }
 
 // Hello implements proto.ControlService
 func (w *Worker) Hello(client *rpc2.Client, req proto.HelloReq, resp *proto.HelloResp) error {
+	if req.Name != w.identity.Name {
+		log.Printf("worker from %s tried to register as %s using the certificate for %s", w.addr, req.Name, w.identity.Name)
+
+		return fmt.Errorf("worker certificate is not valid for name %s", req.Name)
+	}
+
+	// Handlers run concurrently so the session is claimed before anything else is done.
+	w.helloMtx.Lock()
+	again := w.hello
+	w.hello = true
+	w.helloMtx.Unlock()
+
+	if again {
+		log.Printf("worker %s from %s sent hello again on the same session", req.Name, w.addr)
+
+		return fmt.Errorf("worker session already sent hello")
+	}
+
 	var pingResp proto.PingResp
 
 	err := client.Call(proto.Common_Ping, proto.PingReq{}, &pingResp)
@@ -118,7 +381,62 @@ func (w *Worker) Hello(client *rpc2.Client, req proto.HelloReq, resp *proto.Hell
 
 	w.rpcClient = client
 	w.name = req.Name
+	w.commit = req.Commit
+	w.operatingSystem = req.OperatingSystem
+	w.architecture = req.Architecture
+	w.labels = req.Labels
+
+	previous := w.server.workers.register(w)
+	if previous != nil && previous != w {
+		// The worker reconnected before the old session went away. Drop the stale session.
+		log.Printf("worker %s from %s replaced session from %s", w.name, w.addr, previous.addr)
+
+		previous.rpcClient.Close()
+	}
+
+	go w.watch()
+	go w.server.deliverQueued(w)
+
+	return nil
+}
+
+// watch sends heartbeats to the worker and drops the session once it is lost.
+func (w *Worker) watch() {
+	lost := w.monitor.Run(w.rpcClient.DisconnectNotify(), func(ctx context.Context) error {
+		var resp proto.HeartbeatResp
+		return w.rpcClient.CallWithContext(ctx, proto.Common_Heartbeat, proto.HeartbeatReq{}, &resp)
+	})
+	if lost {
+		log.Printf("worker %s from %s lost, last heartbeat at %s", w.name, w.addr, w.monitor.LastBeat().Format(time.RFC3339))
+
+		w.rpcClient.Close()
+	}
+}
+
+// Output implements proto.ControlService
+func (w *Worker) Output(client *rpc2.Client, req proto.OutputChunk, resp *proto.OutputResp) error {
+	*resp = proto.OutputResp{}
 
+	stream, ok := w.server.streams.get(req.RequestID)
+	if !ok {
+		// The client went away or did not ask for output.
+		return nil
+	}
+
+	if !stream.targets[w.name] {
+		log.Printf("dropping output from worker %s for request %s it was not sent", w.name, req.RequestID)
+		return nil
+	}
+
+	req.Target = w.name
+	req.RequestID = stream.clientID
+
+	return stream.client.Call(proto.Client_Output, req, resp)
+}
+
+// Heartbeat implements proto.ControlService
+func (w *Worker) Heartbeat(client *rpc2.Client, req proto.HeartbeatReq, resp *proto.HeartbeatResp) error {
+	*resp = proto.HeartbeatResp{}
 	return nil
 }
 
@@ -151,27 +469,54 @@ type Server struct {
 	addr             string
 	certFile         string
 	keyFile          string
+	clientsMtx       sync.RWMutex
 	permittedClients []*Client
+	clientConns      map[*Client]map[net.Conn]bool
+	clientListFile   string
+	clientListSum    []byte
+	permittedWorkers []*WorkerIdentity
 	mux              *http.ServeMux
 	upgrader         ws.HTTPUpgrader
-	connectedWorkers []*Worker
+	workers          *workerRegistry
+	requests         *request.Tracker
+	streams          *streamRegistry
+	sessions         *sessionRegistry
+	heartbeatConfig  heartbeat.Config
+	forwardPolicy    map[string][]forwardRule
+	policy           *policy
+	packGrants       *packGrants
+	ca               *ca.Authority
+	auditLog         *audit.Logger
+	auditContent     bool
+	queue            *messageQueue
 }
 
 func (s *Server) getWorker(name string) *Worker {
-	for _, worker := range s.connectedWorkers {
-		if worker.name == name {
-			return worker
+	return s.workers.get(name)
+}
+
+// knownWorker reports whether a worker with the name is allowed to connect.
+func (s *Server) knownWorker(name string) bool {
+	for _, worker := range s.permittedWorkers {
+		if worker.Name == name {
+			return true
 		}
 	}
-	return nil
+	return s.ca != nil && s.ca.Issued(ca.RoleWorker, name)
 }
 
 func (s *Server) authenticateClient(certs []*x509.Certificate) *Client {
-	// log.Printf("certs = %v", certs)
+	// Certificates from the CA are verified by their chain and are the main way clients are trusted.
+	if client := s.issuedClient(certs); client != nil {
+		return client
+	}
+
+	s.clientsMtx.RLock()
+	defer s.clientsMtx.RUnlock()
+
+	// Certificates pinned in the client list are still accepted for clients that did not enroll.
 	for _, cert := range certs {
 		for _, client := range s.permittedClients {
-			// log.Printf("cert = %v client = %v", cert, client)
-			// TODO(joshua): Is this the right way to validate client certificates.
 			if cert.Equal(client.certificate) {
 				return client
 			}
@@ -180,6 +525,25 @@ func (s *Server) authenticateClient(certs []*x509.Certificate) *Client {
 	return nil
 }
 
+func (s *Server) authenticateWorker(certs []*x509.Certificate) *WorkerIdentity {
+	if identity := s.issuedWorker(certs); identity != nil {
+		return identity
+	}
+
+	for _, cert := range certs {
+		for _, worker := range s.permittedWorkers {
+			if cert.Equal(worker.certificate) {
+				return worker
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) SetHeartbeatConfig(config heartbeat.Config) {
+	s.heartbeatConfig = config
+}
+
 func (s *Server) Listen() error {
 	inner, err := net.Listen("tcp", s.addr)
 	if err != nil {
@@ -202,8 +566,69 @@ func (s *Server) Listen() error {
 	return http.Serve(tlsListener, s.mux)
 }
 
-func (s *Server) AddClient(client Client) error {
-	bytes, err := base64.StdEncoding.DecodeString(client.CertificateString)
+// ParseWorkerList parses a list of trusted workers. Each line holds a base64 encoded DER certificate
+// and the name of the worker separated by a space. Empty lines and lines starting with # are skipped.
+func ParseWorkerList(content []byte) ([]WorkerIdentity, error) {
+	var ret []WorkerIdentity
+
+	names := make(map[string]bool)
+
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		tokens := strings.Split(line, " ")
+		if len(tokens) != 2 {
+			return nil, fmt.Errorf("line %d: want <certificate> <name>", i+1)
+		}
+
+		if names[tokens[1]] {
+			return nil, fmt.Errorf("line %d: worker %s is listed twice", i+1, tokens[1])
+		}
+		names[tokens[1]] = true
+
+		bytes, err := base64.StdEncoding.DecodeString(tokens[0])
+		if err == nil {
+			_, err = x509.ParseCertificate(bytes)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid certificate for worker %s: %v", i+1, tokens[1], err)
+		}
+
+		ret = append(ret, WorkerIdentity{
+			Name:              tokens[1],
+			CertificateString: tokens[0],
+		})
+	}
+
+	return ret, nil
+}
+
+// LoadWorkerList adds the workers in a file written as described by ParseWorkerList.
+func (s *Server) LoadWorkerList(filename string) error {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	workers, err := ParseWorkerList(content)
+	if err != nil {
+		return fmt.Errorf("invalid worker list %s: %v", filename, err)
+	}
+
+	for _, worker := range workers {
+		if err := s.AddWorker(worker); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) AddWorker(worker WorkerIdentity) error {
+	bytes, err := base64.StdEncoding.DecodeString(worker.CertificateString)
 	if err != nil {
 		return err
 	}
@@ -212,9 +637,9 @@ func (s *Server) AddClient(client Client) error {
 		return err
 	}
 
-	s.permittedClients = append(s.permittedClients, &Client{
-		Name:              client.Name,
-		CertificateString: client.CertificateString,
+	s.permittedWorkers = append(s.permittedWorkers, &WorkerIdentity{
+		Name:              worker.Name,
+		CertificateString: worker.CertificateString,
 		certificate:       cert,
 	})
 
@@ -240,19 +665,45 @@ func (s *Server) handleClient(w http.ResponseWriter, r *http.Request) {
 	}
 	defer conn.Close()
 
-	client.server = s
+	if !s.clientConnected(client, conn) {
+		log.Printf("client %s from %s was removed while connecting", client.Name, r.RemoteAddr)
+		return
+	}
+	defer s.clientDisconnected(client, conn)
 
 	server := rpc2.NewServer()
 
 	server.Handle(proto.Common_Ping, client.Ping)
 	server.Handle(proto.Common_SendMessage, client.SendMessage)
+	server.Handle(proto.Client_SendMessageAll, client.SendMessageAll)
 	server.Handle(proto.Client_GetWorkers, client.GetWorkers)
 	server.Handle(proto.Common_GetInfo, client.GetInfo)
+	server.Handle(proto.Common_Cancel, client.Cancel)
+	server.Handle(proto.Common_OpenSession, client.OpenSession)
+	server.Handle(proto.Common_SessionData, client.SessionData)
+	server.Handle(proto.Common_CloseSession, client.CloseSession)
+	server.Handle(proto.Client_QueuedMessages, client.QueuedMessages)
+	server.Handle(proto.Client_AuditEvents, client.AuditEvents)
+
+	server.OnDisconnect(s.closeClientSessions)
+
+	state := rpc2.NewState()
+	state.Set(addressStateKey, r.RemoteAddr)
 
-	server.ServeConn(conn)
+	server.ServeCodecWithState(rpc2.NewGobCodec(conn), state)
 }
 
 func (s *Server) handleWorker(w http.ResponseWriter, r *http.Request) {
+	identity := s.authenticateWorker(r.TLS.PeerCertificates)
+
+	if identity == nil {
+		log.Printf("worker failed authentication from: %s", r.RemoteAddr)
+
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "Unauthorised")
+		return
+	}
+
 	log.Printf("worker connected from: %s", r.RemoteAddr)
 
 	conn, _, _, err := s.upgrader.Upgrade(r, w)
@@ -262,17 +713,27 @@ func (s *Server) handleWorker(w http.ResponseWriter, r *http.Request) {
 	defer conn.Close()
 
 	worker := &Worker{
-		server:    s,
-		addr:      r.RemoteAddr,
-		rpcServer: rpc2.NewServer(),
+		server:      s,
+		identity:    identity,
+		addr:        r.RemoteAddr,
+		rpcServer:   rpc2.NewServer(),
+		monitor:     heartbeat.NewMonitor(s.heartbeatConfig),
+		connectedAt: time.Now(),
 	}
 
-	s.connectedWorkers = append(s.connectedWorkers, worker)
-
 	worker.rpcServer.Handle(proto.Common_Ping, worker.Ping)
 	worker.rpcServer.Handle(proto.Control_Hello, worker.Hello)
+	worker.rpcServer.Handle(proto.Common_Heartbeat, worker.Heartbeat)
+	worker.rpcServer.Handle(proto.Control_Output, worker.Output)
+	worker.rpcServer.Handle(proto.Common_SessionData, worker.SessionData)
+	worker.rpcServer.Handle(proto.Common_CloseSession, worker.CloseSession)
 
 	worker.rpcServer.ServeConn(conn)
+
+	s.workers.unregister(worker)
+	s.closeWorkerSessions(worker)
+
+	log.Printf("worker %s from %s disconnected after %s", worker.name, worker.addr, worker.disconnectedAt.Sub(worker.connectedAt))
 }
 
 func NewServer(addr string, certFile string, keyFile string) *Server {
@@ -282,6 +743,16 @@ func NewServer(addr string, certFile string, keyFile string) *Server {
 		keyFile:  keyFile,
 		upgrader: ws.HTTPUpgrader{},
 		mux:      http.NewServeMux(),
+		workers:  newWorkerRegistry(),
+		requests: request.NewTracker(),
+		streams:  newStreamRegistry(),
+		sessions: newSessionRegistry(),
+		queue:    newMessageQueue(),
+
+		clientConns: make(map[*Client]map[net.Conn]bool),
+		packGrants:  newPackGrants(),
+
+		heartbeatConfig: heartbeat.DefaultConfig,
 	}
 
 	s.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -289,6 +760,8 @@ func NewServer(addr string, certFile string, keyFile string) *Server {
 	})
 	s.mux.HandleFunc("/client", s.handleClient)
 	s.mux.HandleFunc("/worker", s.handleWorker)
+	s.mux.HandleFunc("/enroll", s.handleEnroll)
+	s.mux.HandleFunc("/renew", s.handleRenew)
 
 	return s
 }
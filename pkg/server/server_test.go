@@ -0,0 +1,96 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Vbitz/raise/v2/pkg/heartbeat"
+	"github.com/Vbitz/raise/v2/pkg/proto"
+	"github.com/cenkalti/rpc2"
+)
+
+// connectWorker starts a worker session on s the way handleWorker does and returns the worker end of it.
+func connectWorker(t *testing.T, s *Server, name string) *rpc2.Client {
+	t.Helper()
+
+	serverConn, workerConn := net.Pipe()
+
+	worker := &Worker{
+		server:      s,
+		identity:    &WorkerIdentity{Name: name},
+		addr:        "pipe",
+		rpcServer:   rpc2.NewServer(),
+		monitor:     heartbeat.NewMonitor(s.heartbeatConfig),
+		connectedAt: time.Now(),
+	}
+
+	worker.rpcServer.Handle(proto.Control_Hello, worker.Hello)
+
+	go worker.rpcServer.ServeConn(serverConn)
+
+	client := rpc2.NewClient(workerConn)
+	client.Handle(proto.Common_Ping, func(client *rpc2.Client, req proto.PingReq, resp *proto.PingResp) error {
+		return nil
+	})
+	client.Handle(proto.Common_Heartbeat, func(client *rpc2.Client, req proto.HeartbeatReq, resp *proto.HeartbeatResp) error {
+		return nil
+	})
+
+	go client.Run()
+
+	t.Cleanup(func() {
+		client.Close()
+	})
+
+	return client
+}
+
+func TestHelloOnlyOnce(t *testing.T) {
+	tests := []struct {
+		name       string
+		concurrent bool
+	}{
+		{"after registering", false},
+		{"at the same time", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer("", "", "")
+			client := connectWorker(t, s, "web1")
+
+			hello := func() error {
+				var resp proto.HelloResp
+				return client.Call(proto.Control_Hello, proto.HelloReq{Name: "web1", Labels: map[string]string{"n": "1"}}, &resp)
+			}
+
+			var errs [2]error
+
+			if tt.concurrent {
+				var wg sync.WaitGroup
+				for i := range errs {
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						errs[i] = hello()
+					}(i)
+				}
+				wg.Wait()
+			} else {
+				for i := range errs {
+					errs[i] = hello()
+				}
+			}
+
+			if (errs[0] == nil) == (errs[1] == nil) {
+				t.Fatalf("want exactly one hello accepted, got %v and %v", errs[0], errs[1])
+			}
+
+			if len(s.workers.list()) != 1 {
+				t.Fatalf("%d workers registered, want 1", len(s.workers.list()))
+			}
+		})
+	}
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/Vbitz/raise/v2/pkg/proto"
+	"github.com/cenkalti/rpc2"
+)
+
+// session is a long lived session between a client connection and a worker.
+// The server only relays events between the two ends.
+type session struct {
+	id         string
+	kind       proto.SessionKind
+	client     *Client
+	clientConn *rpc2.Client
+	worker     *Worker
+}
+
+type sessionRegistry struct {
+	mtx      sync.Mutex
+	sessions map[string]*session
+}
+
+func (r *sessionRegistry) add(s *session) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if _, ok := r.sessions[s.id]; ok {
+		return fmt.Errorf("session %s already exists", s.id)
+	}
+
+	r.sessions[s.id] = s
+
+	return nil
+}
+
+func (r *sessionRegistry) get(id string) *session {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	return r.sessions[id]
+}
+
+func (r *sessionRegistry) remove(s *session) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.sessions[s.id] != s {
+		return false
+	}
+
+	delete(r.sessions, s.id)
+
+	return true
+}
+
+// removeMatching removes and returns every session for which match returns true.
+func (r *sessionRegistry) removeMatching(match func(s *session) bool) []*session {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	var ret []*session
+	for id, s := range r.sessions {
+		if match(s) {
+			ret = append(ret, s)
+			delete(r.sessions, id)
+		}
+	}
+
+	return ret
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{
+		sessions: make(map[string]*session),
+	}
+}
+
+// clientSession returns the session if it belongs to the client connection.
+func (c *Client) clientSession(client *rpc2.Client, id string) (*session, error) {
+	s := c.server.sessions.get(id)
+	if s == nil || s.clientConn != client {
+		return nil, fmt.Errorf("session %s does not exist", id)
+	}
+	return s, nil
+}
+
+// OpenSession implements proto.ClientService
+func (c *Client) OpenSession(client *rpc2.Client, req proto.OpenSessionReq, resp *proto.OpenSessionResp) (err error) {
+	*resp = proto.OpenSessionResp{}
+
+	event := c.auditEvent(client, proto.Common_OpenSession, req.Target)
+	event.Kind = string(req.Kind)
+	event.RequestID = req.SessionID
+	event.Destination = req.Address
+	defer func() { c.finishAudit(event, err) }()
+
+	if req.SessionID == "" {
+		return fmt.Errorf("session has no ID")
+	}
+
+	worker := c.server.getWorker(req.Target)
+	if worker == nil {
+		return fmt.Errorf("worker %s not connected or non existing", req.Target)
+	}
+
+	if err := c.server.authorize(c, worker.name, worker.labels, string(req.Kind), nil); err != nil {
+		return err
+	}
+
+	if req.Kind == proto.SessionForward && !c.server.allowForward(c, worker, req.Address) {
+		log.Printf("client %s denied forwarding to %s through %s", c.Name, req.Address, worker.name)
+
+		return fmt.Errorf("client %s is not allowed to forward to %s through %s", c.Name, req.Address, worker.name)
+	}
+
+	s := &session{
+		id:         req.SessionID,
+		kind:       req.Kind,
+		client:     c,
+		clientConn: client,
+		worker:     worker,
+	}
+
+	if err := c.server.sessions.add(s); err != nil {
+		return err
+	}
+
+	err = worker.rpcClient.Call(proto.Common_OpenSession, req, resp)
+	if err != nil {
+		c.server.sessions.remove(s)
+
+		return fmt.Errorf("failed to open session on worker: %v", err)
+	}
+
+	log.Printf("client %s opened %s session %s on %s", c.Name, req.Kind, req.SessionID, worker.name)
+
+	return nil
+}
+
+// SessionData implements proto.ClientService
+func (c *Client) SessionData(client *rpc2.Client, req proto.SessionData, resp *proto.SessionDataResp) error {
+	s, err := c.clientSession(client, req.SessionID)
+	if err != nil {
+		return err
+	}
+
+	return s.worker.rpcClient.Call(proto.Common_SessionData, req, resp)
+}
+
+// CloseSession implements proto.ClientService
+func (c *Client) CloseSession(client *rpc2.Client, req proto.CloseSessionReq, resp *proto.CloseSessionResp) error {
+	*resp = proto.CloseSessionResp{}
+
+	s, err := c.clientSession(client, req.SessionID)
+	if err != nil {
+		return err
+	}
+
+	if !c.server.sessions.remove(s) {
+		return nil
+	}
+
+	log.Printf("client %s closed session %s on %s", c.Name, s.id, s.worker.name)
+
+	return s.worker.rpcClient.Call(proto.Common_CloseSession, req, resp)
+}
+
+// workerSession returns the session if it belongs to the worker.
+func (w *Worker) workerSession(id string) (*session, error) {
+	s := w.server.sessions.get(id)
+	if s == nil || s.worker != w {
+		return nil, fmt.Errorf("session %s does not exist", id)
+	}
+	return s, nil
+}
+
+// SessionData implements proto.ControlService
+func (w *Worker) SessionData(client *rpc2.Client, req proto.SessionData, resp *proto.SessionDataResp) error {
+	s, err := w.workerSession(req.SessionID)
+	if err != nil {
+		return err
+	}
+
+	return s.clientConn.Call(proto.Common_SessionData, req, resp)
+}
+
+// CloseSession implements proto.ControlService
+func (w *Worker) CloseSession(client *rpc2.Client, req proto.CloseSessionReq, resp *proto.CloseSessionResp) error {
+	*resp = proto.CloseSessionResp{}
+
+	s, err := w.workerSession(req.SessionID)
+	if err != nil {
+		return err
+	}
+
+	if !w.server.sessions.remove(s) {
+		return nil
+	}
+
+	log.Printf("session %s on %s ended", s.id, w.name)
+
+	return s.clientConn.Call(proto.Common_CloseSession, req, resp)
+}
+
+// closeClientSessions closes the sessions opened over a client connection that went away.
+func (s *Server) closeClientSessions(client *rpc2.Client) {
+	for _, sess := range s.sessions.removeMatching(func(sess *session) bool { return sess.clientConn == client }) {
+		var resp proto.CloseSessionResp
+		err := sess.worker.rpcClient.Call(proto.Common_CloseSession, proto.CloseSessionReq{
+			SessionID: sess.id,
+		}, &resp)
+		if err != nil {
+			log.Printf("failed to close session %s on %s: %v", sess.id, sess.worker.name, err)
+		}
+	}
+}
+
+// closeWorkerSessions closes the sessions with a worker that went away.
+func (s *Server) closeWorkerSessions(worker *Worker) {
+	for _, sess := range s.sessions.removeMatching(func(sess *session) bool { return sess.worker == worker }) {
+		var resp proto.CloseSessionResp
+		err := sess.clientConn.Call(proto.Common_CloseSession, proto.CloseSessionReq{
+			SessionID: sess.id,
+			ExitCode:  -1,
+			Error:     fmt.Sprintf("worker %s disconnected", worker.name),
+		}, &resp)
+		if err != nil {
+			log.Printf("failed to close session %s for client %s: %v", sess.id, sess.client.Name, err)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package star
 
 import (
+	"context"
+
 	"go.starlark.net/starlark"
 
 	"github.com/Vbitz/raise/v2/pkg/client"
@@ -14,12 +16,26 @@ func (e *StarEngine) newThread(name string) *starlark.Thread {
 	return &starlark.Thread{Name: name}
 }
 
-func (e *StarEngine) RunFile(client *client.Client, remote *client.Remote, filename string, fileContents []byte) error {
+// RunFile runs a script. Cancelling ctx stops the script and any requests it has in flight.
+func (e *StarEngine) RunFile(ctx context.Context, cl *client.Client, remote *client.Remote, filename string, fileContents []byte) error {
 	thread := e.newThread(filename)
 
+	client.SetThreadContext(thread, ctx)
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			thread.Cancel(ctx.Err().Error())
+		case <-stop:
+		}
+	}()
+
 	builtin := builtin.Globals
 
-	builtin["client"] = client
+	builtin["client"] = cl
 	if remote != nil {
 		builtin["remote"] = remote
 	}
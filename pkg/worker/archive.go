@@ -0,0 +1,395 @@
+package worker
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/Vbitz/raise/v2/pkg/manifest"
+	"github.com/Vbitz/raise/v2/pkg/proto"
+)
+
+// openArchive returns a tar reader for a tar or gzip compressed tar file.
+func openArchive(f *os.File) (*tar.Reader, error) {
+	r := bufio.NewReader(f)
+
+	magic, err := r.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return tar.NewReader(gz), nil
+	}
+
+	return tar.NewReader(r), nil
+}
+
+// archivePath works out the slash separated path an archive entry is extracted to relative to the
+// destination. It returns an empty string for entries that are skipped because of strip.
+func archivePath(name string, strip int) (string, error) {
+	if strings.HasPrefix(name, "/") || filepath.IsAbs(name) {
+		return "", fmt.Errorf("archive entry %s has an absolute path", name)
+	}
+
+	var parts []string
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." {
+			continue
+		}
+		if part == ".." {
+			return "", fmt.Errorf("archive entry %s leaves the destination", name)
+		}
+		parts = append(parts, part)
+	}
+
+	if len(parts) <= strip {
+		return "", nil
+	}
+
+	return path.Join(parts[strip:]...), nil
+}
+
+// checkParents makes sure no directory between root and rel is a symbolic link so an archive
+// can not write outside the destination through a link it created earlier.
+func checkParents(root string, rel string) error {
+	dir := root
+
+	parts := strings.Split(rel, "/")
+	for _, part := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, part)
+
+		fi, err := os.Lstat(dir)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("archive entry %s is inside the symbolic link %s", rel, dir)
+		}
+	}
+
+	return nil
+}
+
+// removeSymlink removes a symbolic link in the way of a directory entry so creating the directory and
+// setting its mode does not follow a link an earlier entry created.
+func removeSymlink(filename string) error {
+	fi, err := os.Lstat(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if fi.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+
+	return os.Remove(filename)
+}
+
+// removeExisting removes a file or link in the way of an archive entry. Directories are kept.
+// The link itself is removed, never what it points to.
+func removeExisting(filename string) error {
+	fi, err := os.Lstat(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if fi.IsDir() {
+		return nil
+	}
+
+	return os.Remove(filename)
+}
+
+func extractEntry(root string, rel string, header *tar.Header, r io.Reader) error {
+	filename := filepath.Join(root, filepath.FromSlash(rel))
+	mode := header.FileInfo().Mode().Perm()
+
+	if err := checkParents(root, rel); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filename), defaultDirMode); err != nil {
+		return err
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if err := removeSymlink(filename); err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(filename, mode); err != nil {
+			return err
+		}
+		return os.Chmod(filename, mode)
+	case tar.TypeReg:
+		if err := removeExisting(filename); err != nil {
+			return err
+		}
+
+		// O_EXCL fails rather than following a link that appeared since it was removed.
+		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		if _, err := io.Copy(f, r); err != nil {
+			return err
+		}
+
+		if err := f.Chmod(mode); err != nil {
+			return err
+		}
+
+		return f.Close()
+	case tar.TypeSymlink:
+		if err := removeExisting(filename); err != nil {
+			return err
+		}
+
+		// The link may point anywhere. checkParents stops later entries from being written through it.
+		return os.Symlink(header.Linkname, filename)
+	case tar.TypeLink:
+		target, err := archivePath(header.Linkname, 0)
+		if err != nil {
+			return err
+		}
+
+		if err := checkParents(root, target); err != nil {
+			return err
+		}
+
+		if err := removeExisting(filename); err != nil {
+			return err
+		}
+
+		return os.Link(filepath.Join(root, filepath.FromSlash(target)), filename)
+	default:
+		return fmt.Errorf("unsupported archive entry type %c", header.Typeflag)
+	}
+}
+
+func (w *Worker) extract(req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	f, err := os.Open(req.Filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tr, err := openArchive(f)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(req.Destination, defaultDirMode); err != nil {
+		return err
+	}
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir, tar.TypeReg, tar.TypeSymlink, tar.TypeLink:
+		default:
+			// Devices, fifos and metadata entries are not extracted.
+			continue
+		}
+
+		rel, err := archivePath(header.Name, req.StripComponents)
+		if err != nil {
+			return err
+		}
+		if rel == "" {
+			continue
+		}
+
+		if err := extractEntry(req.Destination, rel, header, tr); err != nil {
+			return fmt.Errorf("failed to extract %s: %w", header.Name, err)
+		}
+
+		resp.Files = append(resp.Files, proto.FileInfo{
+			Name:       path.Base(rel),
+			Path:       rel,
+			Type:       archiveFileType(header.Typeflag),
+			Size:       header.Size,
+			Mode:       header.FileInfo().Mode(),
+			ModTime:    header.ModTime,
+			Uid:        -1,
+			Gid:        -1,
+			LinkTarget: header.Linkname,
+		})
+	}
+
+	return nil
+}
+
+func archiveFileType(flag byte) proto.FileType {
+	switch flag {
+	case tar.TypeDir:
+		return proto.FileTypeDir
+	case tar.TypeSymlink:
+		return proto.FileTypeSymlink
+	default:
+		return proto.FileTypeFile
+	}
+}
+
+// writeArchive writes every file under root that is not excluded to tw.
+func writeArchive(tw *tar.Writer, root string, exclude []string) error {
+	return filepath.WalkDir(root, func(filename string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if filename == root {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, filename)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		excluded, err := manifest.Excluded(rel, exclude)
+		if err != nil {
+			return err
+		}
+
+		if excluded {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		fi, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(filename)
+			if err != nil {
+				return err
+			}
+		} else if !fi.Mode().IsRegular() && !fi.IsDir() {
+			// Devices, sockets and pipes are left out.
+			return nil
+		}
+
+		header, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+
+		header.Name = rel
+		if fi.IsDir() {
+			header.Name += "/"
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
+
+// pack writes a directory into a new archive in the temporary directory and returns its name in Content.
+// The client downloads it and removes it afterwards.
+func (w *Worker) pack(req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	fi, err := os.Stat(req.Filename)
+	if err != nil {
+		return err
+	}
+
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", req.Filename)
+	}
+
+	f, err := os.CreateTemp("", "raise-archive-*.tar")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ok := false
+	defer func() {
+		if !ok {
+			os.Remove(f.Name())
+		}
+	}()
+
+	var out io.Writer = f
+
+	var gz *gzip.Writer
+	if req.Gzip {
+		gz = gzip.NewWriter(f)
+		out = gz
+	}
+
+	tw := tar.NewWriter(out)
+
+	if err := writeArchive(tw, req.Filename, req.Exclude); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return err
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	ok = true
+	resp.Content = []byte(f.Name())
+
+	return nil
+}
@@ -0,0 +1,239 @@
+package worker
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Vbitz/raise/v2/pkg/proto"
+)
+
+func TestArchivePath(t *testing.T) {
+	tests := []struct {
+		name  string
+		strip int
+		want  string
+		err   bool
+	}{
+		{"a/b", 0, "a/b", false},
+		{"./a//b/", 0, "a/b", false},
+		{"a/b", 1, "b", false},
+		{"a/b", 2, "", false},
+		{"a", 1, "", false},
+		{"/etc/passwd", 0, "", true},
+		{"../x", 0, "", true},
+		{"a/../../x", 0, "", true},
+		// Stripping does not make a path leaving the destination acceptable.
+		{"../x/y", 1, "", true},
+		{"a/..", 0, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := archivePath(tt.name, tt.strip)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("got %q, want an error", got)
+				}
+				return
+			}
+
+			if err != nil || got != tt.want {
+				t.Fatalf("got %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckParents(t *testing.T) {
+	root := t.TempDir()
+
+	if err := os.MkdirAll(filepath.Join(root, "dir", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink("/", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink(".", filepath.Join(root, "dir", "self")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		rel string
+		ok  bool
+	}{
+		{"file", true},
+		{"dir/sub/file", true},
+		{"missing/file", true},
+		// The entry itself may be a link, only directories it is written through may not.
+		{"link", true},
+		{"link/etc/passwd", false},
+		{"dir/self/file", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rel, func(t *testing.T) {
+			err := checkParents(root, tt.rel)
+			if tt.ok && err != nil {
+				t.Fatalf("refused: %v", err)
+			} else if !tt.ok && err == nil {
+				t.Fatalf("allowed")
+			}
+		})
+	}
+}
+
+// archiveEntry is a tar header with the content of a regular file.
+type archiveEntry struct {
+	header  tar.Header
+	content string
+}
+
+func writeTestArchive(t *testing.T, filename string, entries []archiveEntry) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	for _, entry := range entries {
+		header := entry.header
+		header.Size = int64(len(entry.content))
+		if header.Mode == 0 {
+			header.Mode = 0644
+		}
+
+		if err := tw.WriteHeader(&header); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := tw.Write([]byte(entry.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filename, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractStaysInside(t *testing.T) {
+	// OUTSIDE is replaced with a directory next to the destination holding a file named victim.
+	tests := []struct {
+		name    string
+		entries []archiveEntry
+	}{
+		{"file through link", []archiveEntry{
+			{header: tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "OUTSIDE"}},
+			{header: tar.Header{Name: "link/victim", Typeflag: tar.TypeReg}, content: "evil"},
+		}},
+		{"directory through link", []archiveEntry{
+			{header: tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "OUTSIDE"}},
+			{header: tar.Header{Name: "link/dir", Typeflag: tar.TypeDir, Mode: 0755}},
+		}},
+		{"file over link", []archiveEntry{
+			{header: tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "OUTSIDE/victim"}},
+			{header: tar.Header{Name: "link", Typeflag: tar.TypeReg}, content: "evil"},
+		}},
+		{"directory over link", []archiveEntry{
+			{header: tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "OUTSIDE"}},
+			{header: tar.Header{Name: "link", Typeflag: tar.TypeDir, Mode: 0777}},
+		}},
+		{"hard link outside", []archiveEntry{
+			{header: tar.Header{Name: "hard", Typeflag: tar.TypeLink, Linkname: "../outside/victim"}},
+		}},
+		{"hard link through link", []archiveEntry{
+			{header: tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "OUTSIDE"}},
+			{header: tar.Header{Name: "hard", Typeflag: tar.TypeLink, Linkname: "link/victim"}},
+		}},
+		{"parent directory", []archiveEntry{
+			{header: tar.Header{Name: "../outside/victim", Typeflag: tar.TypeReg}, content: "evil"},
+		}},
+		{"absolute", []archiveEntry{
+			{header: tar.Header{Name: "/OUTSIDE/victim", Typeflag: tar.TypeReg}, content: "evil"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := t.TempDir()
+
+			outside := filepath.Join(base, "outside")
+			if err := os.Mkdir(outside, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			victim := filepath.Join(outside, "victim")
+			if err := os.WriteFile(victim, []byte("keep"), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			before := make(map[string]os.FileMode)
+			for _, filename := range []string{victim, outside} {
+				fi, err := os.Stat(filename)
+				if err != nil {
+					t.Fatal(err)
+				}
+				before[filename] = fi.Mode()
+			}
+
+			var entries []archiveEntry
+			for _, entry := range tt.entries {
+				entry.header.Name = strings.ReplaceAll(entry.header.Name, "OUTSIDE", outside)
+				entry.header.Linkname = strings.ReplaceAll(entry.header.Linkname, "OUTSIDE", outside)
+				entries = append(entries, entry)
+			}
+
+			archive := filepath.Join(base, "archive.tar")
+			writeTestArchive(t, archive, entries)
+
+			var resp proto.SendMessageResp
+			(&Worker{}).extract(proto.SendMessageReq{Filename: archive, Destination: filepath.Join(base, "dest")}, &resp)
+
+			got, err := os.ReadFile(victim)
+			if err != nil || string(got) != "keep" {
+				t.Fatalf("victim = %q, %v, want it unchanged", got, err)
+			}
+
+			for filename, mode := range before {
+				fi, err := os.Stat(filename)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if fi.Mode() != mode {
+					t.Fatalf("mode of %s changed from %v to %v", filename, mode, fi.Mode())
+				}
+			}
+
+			victimInfo, err := os.Stat(victim)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			filepath.Walk(filepath.Join(base, "dest"), func(filename string, fi os.FileInfo, err error) error {
+				if err == nil && os.SameFile(fi, victimInfo) {
+					t.Errorf("%s is a hard link to the victim", filename)
+				}
+				return nil
+			})
+
+			children, err := os.ReadDir(outside)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(children) != 1 {
+				t.Fatalf("files were created outside the destination: %v", children)
+			}
+		})
+	}
+}
@@ -0,0 +1,414 @@
+package worker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/Vbitz/raise/v2/pkg/proto"
+)
+
+// uploadID identifies an upload of a file with the given size and checksum to filename.
+// Uploading the same file again gets the same ID so it resumes where the last attempt stopped.
+func uploadID(filename string, size int64, checksum string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%s", filename, size, checksum)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// uploadPath returns where an upload of filename is written until it is finished.
+// It is next to the file so finishing the upload is an atomic rename.
+func uploadPath(filename string, id string) (string, error) {
+	if _, err := hex.DecodeString(id); err != nil || len(id) != 32 {
+		return "", fmt.Errorf("invalid upload id %q", id)
+	}
+
+	return filepath.Join(filepath.Dir(filename), "."+filepath.Base(filename)+"."+id+".part"), nil
+}
+
+// openUpload opens the file an upload is written to. Anyone who can write to the directory can
+// create it first, so links are not followed and anything but a regular file of the worker user
+// with a single link is refused. flag must not include O_TRUNC, truncate after opening instead.
+func openUpload(filename string, id string, flag int) (*os.File, error) {
+	partial, err := uploadPath(filename, id)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(partial, flag|openNoFollow, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if !info.Mode().IsRegular() {
+		f.Close()
+		return nil, fmt.Errorf("upload of %s: %s is not a regular file", filename, partial)
+	}
+
+	if err := checkUploadOwner(partial, info); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// checksumFile returns the hex encoded SHA-256 of the first length bytes of f or all of f if length is zero.
+// f must not have been read from yet.
+func checksumFile(f *os.File, length int64) (string, error) {
+	var r io.Reader = f
+	if length > 0 {
+		r = io.NewSectionReader(f, 0, length)
+	}
+
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return "", err
+	}
+
+	if length > 0 && n != length {
+		return "", fmt.Errorf("file is shorter than %d bytes", length)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func checksumBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// defaultFileMode is the mode of new files written without one.
+const defaultFileMode os.FileMode = 0644
+
+// fileAttributes works out the mode and ownership to give a file written to filename.
+func fileAttributes(req proto.SendMessageReq, filename string) (mode os.FileMode, uid int, gid int, err error) {
+	existing, err := os.Stat(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		existing = nil
+	} else if err != nil {
+		return 0, 0, 0, err
+	}
+
+	mode = req.Mode.Perm()
+	if mode == 0 {
+		if existing != nil {
+			mode = existing.Mode().Perm()
+		} else {
+			mode = defaultFileMode
+		}
+	}
+
+	uid, gid, err = resolveOwner(req.Owner, req.Group, existing)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	return mode, uid, gid, nil
+}
+
+// setAttributes sets the ownership and mode of f and flushes it to disk.
+func setAttributes(f *os.File, mode os.FileMode, uid int, gid int) error {
+	if uid != -1 || gid != -1 {
+		if err := f.Chown(uid, gid); err != nil {
+			return err
+		}
+	}
+
+	// Changing the owner can clear setuid bits so the mode is set afterwards.
+	if err := f.Chmod(mode); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+func (w *Worker) readFile(req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	content, err := os.ReadFile(req.Filename)
+	if err != nil {
+		return err
+	}
+
+	resp.Content = content
+
+	return nil
+}
+
+func (w *Worker) writeFile(req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	mode, uid, gid, err := fileAttributes(req, req.Filename)
+	if err != nil {
+		return err
+	}
+
+	if req.InPlace {
+		f, err := os.OpenFile(req.Filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		if _, err := f.Write(req.Content); err != nil {
+			return err
+		}
+
+		if err := setAttributes(f, mode, uid, gid); err != nil {
+			return err
+		}
+
+		return f.Close()
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(req.Filename), "."+filepath.Base(req.Filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	renamed := false
+	defer func() {
+		if !renamed {
+			os.Remove(f.Name())
+		}
+	}()
+
+	if _, err := f.Write(req.Content); err != nil {
+		return err
+	}
+
+	// setAttributes flushes the content to disk, which has to happen before the rename or a crash can
+	// leave an empty file behind.
+	if err := setAttributes(f, mode, uid, gid); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(f.Name(), req.Filename); err != nil {
+		return err
+	}
+
+	renamed = true
+
+	return syncDir(filepath.Dir(req.Filename))
+}
+
+func (w *Worker) statFile(req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	f, err := os.Open(req.Filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", req.Filename)
+	}
+
+	resp.Size = info.Size()
+
+	if req.Length > resp.Size {
+		// There is no prefix that long to checksum.
+		return nil
+	}
+
+	resp.Checksum, err = checksumFile(f, req.Length)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (w *Worker) readChunk(req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	if req.Length <= 0 || req.Length > int64(proto.MaxTransferChunkSize) {
+		return fmt.Errorf("invalid chunk size %d", req.Length)
+	}
+
+	f, err := os.Open(req.Filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", req.Filename)
+	}
+
+	buf := make([]byte, req.Length)
+
+	n, err := f.ReadAt(buf, req.Offset)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	resp.Content = buf[:n]
+	resp.Size = info.Size()
+	resp.Checksum = checksumBytes(resp.Content)
+
+	return nil
+}
+
+func (w *Worker) writeChunk(req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	if len(req.Content) > proto.MaxTransferChunkSize {
+		return fmt.Errorf("invalid chunk size %d", len(req.Content))
+	}
+
+	if checksumBytes(req.Content) != req.Checksum {
+		return fmt.Errorf("chunk at offset %d of %s is corrupt", req.Offset, req.Filename)
+	}
+
+	flags := os.O_WRONLY
+	if req.Offset == 0 {
+		flags |= os.O_CREATE
+	}
+
+	// The final mode is only set once the upload is finished.
+	f, err := openUpload(req.Filename, req.UploadID, flags)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if req.Offset == 0 {
+		// The first chunk starts the upload over.
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size() != req.Offset {
+		return fmt.Errorf("upload of %s is at offset %d, not %d", req.Filename, info.Size(), req.Offset)
+	}
+
+	_, err = f.WriteAt(req.Content, req.Offset)
+	if err != nil {
+		return err
+	}
+
+	resp.Size = req.Offset + int64(len(req.Content))
+
+	return f.Close()
+}
+
+func (w *Worker) statUpload(req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	resp.UploadID = uploadID(req.Filename, req.Length, req.Checksum)
+
+	f, err := openUpload(req.Filename, resp.UploadID, os.O_RDONLY)
+	if errors.Is(err, os.ErrNotExist) {
+		// Nothing has been uploaded yet.
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	resp.Size = info.Size()
+
+	resp.Checksum, err = checksumFile(f, 0)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (w *Worker) finishWrite(req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	partial, err := uploadPath(req.Filename, req.UploadID)
+	if err != nil {
+		return err
+	}
+
+	mode, uid, gid, err := fileAttributes(req, req.Filename)
+	if err != nil {
+		return err
+	}
+
+	flags := os.O_RDWR
+	if req.Length == 0 {
+		// Empty files have no chunks so there may be nothing to finish.
+		flags |= os.O_CREATE
+	}
+
+	f, err := openUpload(req.Filename, req.UploadID, flags)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if req.Length == 0 {
+		// Whatever an earlier attempt left behind is not part of an empty file.
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	checksum, err := checksumFile(f, 0)
+	if err != nil {
+		return err
+	}
+
+	if info.Size() != req.Length || checksum != req.Checksum {
+		f.Close()
+		os.Remove(partial)
+
+		return fmt.Errorf("upload of %s does not match the source file", req.Filename)
+	}
+
+	if err := setAttributes(f, mode, uid, gid); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	err = os.Rename(partial, req.Filename)
+	if err != nil {
+		return err
+	}
+
+	if err := syncDir(filepath.Dir(req.Filename)); err != nil {
+		return err
+	}
+
+	resp.Size = info.Size()
+	resp.Checksum = checksum
+
+	return nil
+}
@@ -0,0 +1,180 @@
+package worker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Vbitz/raise/v2/pkg/proto"
+)
+
+// upload sends content to filename the way the client does and returns the first error.
+func upload(w *Worker, filename string, content []byte) error {
+	checksum := checksumBytes(content)
+
+	var stat proto.SendMessageResp
+	if err := w.statUpload(proto.SendMessageReq{Filename: filename, Length: int64(len(content)), Checksum: checksum}, &stat); err != nil {
+		return err
+	}
+
+	if len(content) > 0 {
+		var resp proto.SendMessageResp
+		err := w.writeChunk(proto.SendMessageReq{
+			Filename: filename,
+			Content:  content,
+			Checksum: checksum,
+			UploadID: stat.UploadID,
+		}, &resp)
+		if err != nil {
+			return err
+		}
+	}
+
+	var resp proto.SendMessageResp
+	return w.finishWrite(proto.SendMessageReq{
+		Filename: filename,
+		Length:   int64(len(content)),
+		Checksum: checksum,
+		UploadID: stat.UploadID,
+	}, &resp)
+}
+
+func TestUploadRefusesPlantedPartFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		plant   func(partial string, victim string) error
+	}{
+		{"symlink", "evil", func(partial, victim string) error { return os.Symlink(victim, partial) }},
+		{"symlink empty upload", "", func(partial, victim string) error { return os.Symlink(victim, partial) }},
+		{"hard link", "evil", func(partial, victim string) error { return os.Link(victim, partial) }},
+		{"directory", "evil", func(partial, victim string) error { return os.Mkdir(partial, 0700) }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			filename := filepath.Join(dir, "file")
+			victim := filepath.Join(dir, "victim")
+
+			if err := os.WriteFile(victim, []byte("secret"), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			content := []byte(test.content)
+			partial, err := uploadPath(filename, uploadID(filename, int64(len(content)), checksumBytes(content)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := test.plant(partial, victim); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := upload(&Worker{}, filename, content); err == nil {
+				t.Errorf("upload through a planted %s succeeded", test.name)
+			}
+
+			got, err := os.ReadFile(victim)
+			if err != nil || string(got) != "secret" {
+				t.Errorf("victim = %q, %v, want it unchanged", got, err)
+			}
+		})
+	}
+}
+
+func TestUploadIDs(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "file")
+
+	a := uploadID(filename, 3, checksumBytes([]byte("abc")))
+	b := uploadID(filename, 3, checksumBytes([]byte("xyz")))
+
+	if a == b {
+		t.Errorf("different content got the same upload id %s", a)
+	}
+
+	if a != uploadID(filename, 3, checksumBytes([]byte("abc"))) {
+		t.Errorf("the same upload got a different id so it can not resume")
+	}
+
+	for _, id := range []string{"", "../../etc/passwd", "zz" + a[2:], a + "00"} {
+		if _, err := uploadPath(filename, id); err == nil {
+			t.Errorf("uploadPath accepted id %q", id)
+		}
+	}
+}
+
+func TestUploadEmptyOverStalePart(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "file")
+
+	partial, err := uploadPath(filename, uploadID(filename, 0, checksumBytes(nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(partial, []byte("stale"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := upload(&Worker{}, filename, nil); err != nil {
+		t.Fatalf("empty upload: %v", err)
+	}
+
+	got, err := os.ReadFile(filename)
+	if err != nil || len(got) != 0 {
+		t.Errorf("file = %q, %v, want it empty", got, err)
+	}
+}
+
+func TestUploadRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "file")
+
+	if err := upload(&Worker{}, filename, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(filename)
+	if err != nil || string(got) != "hello" {
+		t.Errorf("file = %q, %v, want %q", got, err, "hello")
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("%d files left in the directory, want only the upload", len(entries))
+	}
+}
+
+func TestUploadResumes(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "file")
+	content := []byte("hello world")
+	req := proto.SendMessageReq{Filename: filename, Length: int64(len(content)), Checksum: checksumBytes(content)}
+
+	var stat proto.SendMessageResp
+	if err := (&Worker{}).statUpload(req, &stat); err != nil {
+		t.Fatal(err)
+	}
+
+	var resp proto.SendMessageResp
+	err := (&Worker{}).writeChunk(proto.SendMessageReq{
+		Filename: filename,
+		Content:  content[:5],
+		Checksum: checksumBytes(content[:5]),
+		UploadID: stat.UploadID,
+	}, &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var again proto.SendMessageResp
+	if err := (&Worker{}).statUpload(req, &again); err != nil {
+		t.Fatal(err)
+	}
+
+	if again.UploadID != stat.UploadID || again.Size != 5 || again.Checksum != checksumBytes(content[:5]) {
+		t.Errorf("stat after the first chunk = %s %d, want %s 5", again.UploadID, again.Size, stat.UploadID)
+	}
+}
@@ -0,0 +1,42 @@
+//go:build !windows
+
+package worker
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// openNoFollow makes opening a symbolic link fail instead of opening what it points to.
+const openNoFollow = syscall.O_NOFOLLOW
+
+// checkUploadOwner returns an error unless the file an upload is written to belongs to the worker user
+// and has no other links, so writing to it can not change a file someone else pointed it at.
+func checkUploadOwner(filename string, info os.FileInfo) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+
+	if int(st.Uid) != os.Geteuid() {
+		return fmt.Errorf("%s is owned by uid %d, not the worker user", filename, st.Uid)
+	}
+
+	if st.Nlink != 1 {
+		return fmt.Errorf("%s has %d links", filename, st.Nlink)
+	}
+
+	return nil
+}
+
+// syncDir flushes the entries of a directory to disk so a file renamed into it survives a crash.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
@@ -0,0 +1,18 @@
+//go:build windows
+
+package worker
+
+import "os"
+
+// openNoFollow is zero since Windows has no flag to refuse opening links.
+const openNoFollow = 0
+
+// checkUploadOwner does nothing. Windows files have no uid to compare with the worker user.
+func checkUploadOwner(filename string, info os.FileInfo) error {
+	return nil
+}
+
+// syncDir does nothing. Windows can not open a directory to flush it.
+func syncDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,138 @@
+package worker
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Vbitz/raise/v2/pkg/proto"
+	"github.com/cenkalti/rpc2"
+)
+
+// forwardDialTimeout is how long the worker waits to connect to a forwarded address.
+var forwardDialTimeout = 10 * time.Second
+
+// forwardSession relays a TCP connection. Each direction can be closed on its own and the session
+// only ends once both are done, so protocols that half-close after sending a request still get the response.
+type forwardSession struct {
+	conn net.Conn
+	// end closes the connection and tells the client the session is over.
+	end func(err error)
+
+	mtx        sync.Mutex
+	clientDone bool
+	remoteDone bool
+}
+
+// handle implements session
+func (s *forwardSession) handle(event proto.SessionData) error {
+	if len(event.Data) > 0 {
+		if _, err := s.conn.Write(event.Data); err != nil {
+			return err
+		}
+	}
+
+	if event.EOF {
+		if cw, ok := s.conn.(interface{ CloseWrite() error }); ok {
+			if err := cw.CloseWrite(); err != nil {
+				return err
+			}
+		}
+
+		if s.setDone(&s.clientDone) {
+			s.end(nil)
+		}
+	}
+
+	return nil
+}
+
+// setDone marks a direction as done and reports whether both are.
+func (s *forwardSession) setDone(done *bool) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	*done = true
+
+	return s.clientDone && s.remoteDone
+}
+
+// close implements session
+func (s *forwardSession) close() error {
+	return s.conn.Close()
+}
+
+func (w *Worker) openForward(client *rpc2.Client, req proto.OpenSessionReq) error {
+	conn, err := net.DialTimeout("tcp", req.Address, forwardDialTimeout)
+	if err != nil {
+		return err
+	}
+
+	var once sync.Once
+
+	s := &forwardSession{
+		conn: conn,
+		end: func(err error) {
+			once.Do(func() {
+				conn.Close()
+				w.endSession(client, req.SessionID, 0, err)
+			})
+		},
+	}
+
+	err = w.sessions.add(req.SessionID, s)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	log.Printf("opened forward session %s to %s", req.SessionID, req.Address)
+
+	go func() {
+		buf := make([]byte, 32*1024)
+
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				var resp proto.SessionDataResp
+				callErr := client.Call(proto.Common_SessionData, proto.SessionData{
+					SessionID: req.SessionID,
+					Data:      buf[:n],
+				}, &resp)
+				if callErr != nil {
+					s.end(callErr)
+					return
+				}
+			}
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					err = nil
+				}
+				s.end(err)
+				return
+			}
+		}
+
+		// The remote end is done sending. Pass that on and wait for the client to finish too.
+		var resp proto.SessionDataResp
+		err := client.Call(proto.Common_SessionData, proto.SessionData{
+			SessionID: req.SessionID,
+			EOF:       true,
+		}, &resp)
+		if err != nil {
+			s.end(err)
+			return
+		}
+
+		if s.setDone(&s.remoteDone) {
+			s.end(nil)
+		}
+	}()
+
+	return nil
+}
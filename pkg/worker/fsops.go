@@ -0,0 +1,187 @@
+package worker
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/Vbitz/raise/v2/pkg/manifest"
+	"github.com/Vbitz/raise/v2/pkg/proto"
+)
+
+// defaultDirMode is the mode of new directories created without one.
+const defaultDirMode os.FileMode = 0755
+
+// fileOperation returns the handler for a message kind that works on files or nil.
+func (w *Worker) fileOperation(kind proto.MessageKind) func(req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	switch kind {
+	case proto.MessageReadFile:
+		return w.readFile
+	case proto.MessageWriteFile:
+		return w.writeFile
+	case proto.MessageStatFile:
+		return w.statFile
+	case proto.MessageReadChunk:
+		return w.readChunk
+	case proto.MessageWriteChunk:
+		return w.writeChunk
+	case proto.MessageStatUpload:
+		return w.statUpload
+	case proto.MessageFinishWrite:
+		return w.finishWrite
+	case proto.MessageStat:
+		return w.stat
+	case proto.MessageListDir:
+		return w.listDir
+	case proto.MessageMkdir:
+		return w.mkdir
+	case proto.MessageRemove:
+		return w.remove
+	case proto.MessageRename:
+		return w.rename
+	case proto.MessageSymlink:
+		return w.symlink
+	case proto.MessageReadlink:
+		return w.readlink
+	case proto.MessageChmod:
+		return w.chmod
+	case proto.MessageChown:
+		return w.chown
+	case proto.MessageManifest:
+		return w.manifest
+	case proto.MessageExtract:
+		return w.extract
+	case proto.MessagePack:
+		return w.pack
+	default:
+		return nil
+	}
+}
+
+func fileInfo(path string, fi os.FileInfo, names *ownerNames) proto.FileInfo {
+	info := proto.FileInfo{
+		Name:    fi.Name(),
+		Path:    path,
+		Size:    fi.Size(),
+		Mode:    fi.Mode(),
+		ModTime: fi.ModTime(),
+	}
+
+	switch {
+	case fi.Mode().IsRegular():
+		info.Type = proto.FileTypeFile
+	case fi.IsDir():
+		info.Type = proto.FileTypeDir
+	case fi.Mode()&os.ModeSymlink != 0:
+		info.Type = proto.FileTypeSymlink
+		info.LinkTarget, _ = os.Readlink(path)
+	default:
+		info.Type = proto.FileTypeOther
+	}
+
+	names.fill(&info, fi)
+
+	return info
+}
+
+func (w *Worker) stat(req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	fi, err := os.Lstat(req.Filename)
+	if err != nil {
+		return err
+	}
+
+	resp.Files = []proto.FileInfo{fileInfo(req.Filename, fi, newOwnerNames())}
+
+	return nil
+}
+
+func (w *Worker) listDir(req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	entries, err := os.ReadDir(req.Filename)
+	if err != nil {
+		return err
+	}
+
+	names := newOwnerNames()
+
+	for _, entry := range entries {
+		fi, err := entry.Info()
+		if os.IsNotExist(err) {
+			// Removed since the directory was read.
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		resp.Files = append(resp.Files, fileInfo(filepath.Join(req.Filename, entry.Name()), fi, names))
+	}
+
+	return nil
+}
+
+func (w *Worker) mkdir(req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	mode := req.Mode.Perm()
+	if mode == 0 {
+		mode = defaultDirMode
+	}
+
+	if req.Recursive {
+		return os.MkdirAll(req.Filename, mode)
+	} else {
+		return os.Mkdir(req.Filename, mode)
+	}
+}
+
+func (w *Worker) remove(req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	if req.Recursive {
+		// RemoveAll succeeds if the path does not exist so check first to report it.
+		if _, err := os.Lstat(req.Filename); err != nil {
+			return err
+		}
+
+		return os.RemoveAll(req.Filename)
+	} else {
+		return os.Remove(req.Filename)
+	}
+}
+
+func (w *Worker) rename(req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	return os.Rename(req.Filename, req.Destination)
+}
+
+func (w *Worker) symlink(req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	return os.Symlink(req.Destination, req.Filename)
+}
+
+func (w *Worker) readlink(req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	target, err := os.Readlink(req.Filename)
+	if err != nil {
+		return err
+	}
+
+	resp.Content = []byte(target)
+
+	return nil
+}
+
+func (w *Worker) chmod(req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	return os.Chmod(req.Filename, req.Mode.Perm())
+}
+
+func (w *Worker) chown(req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	uid, gid, err := resolveOwner(req.Owner, req.Group, nil)
+	if err != nil {
+		return err
+	}
+
+	return os.Lchown(req.Filename, uid, gid)
+}
+
+func (w *Worker) manifest(req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	files, err := manifest.Build(req.Filename, req.Exclude)
+	if err != nil {
+		return err
+	}
+
+	resp.Files = files
+
+	return nil
+}
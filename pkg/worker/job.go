@@ -0,0 +1,528 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Vbitz/raise/v2/pkg/proto"
+	"github.com/Vbitz/raise/v2/pkg/request"
+)
+
+// jobPollInterval is how often MessageWaitJob checks whether a job has finished.
+var jobPollInterval = 250 * time.Millisecond
+
+var jobIDPattern = regexp.MustCompile(`^[0-9a-f]+$`)
+
+// jobRecord is written to job.json when a job starts.
+type jobRecord struct {
+	ID        string
+	Script    string
+	Pid       int
+	StartTime time.Time
+	// Identifies the process as returned by processStart so a new process that was given the same ID
+	// after the job exited is not taken for the job.
+	ProcessStart string
+}
+
+// running reports whether the process the job was started as is still running.
+func (r jobRecord) running() bool {
+	start, err := processStart(r.Pid)
+	if err != nil || start != r.ProcessStart {
+		return false
+	}
+
+	return processAlive(r.Pid)
+}
+
+// jobStore keeps detached jobs in a directory with a subdirectory for each job holding the script,
+// its output and how it finished. Everything is on disk so jobs keep running and can still be
+// inspected after the worker restarts. The exit code is written by a wrapper shell, not the worker.
+type jobStore struct {
+	dir string
+
+	mtx sync.Mutex
+}
+
+func newJobStore(dir string) *jobStore {
+	return &jobStore{dir: dir}
+}
+
+// defaultJobsDir returns a directory for jobs that only the worker user can write to and that
+// survives a reboot: /var/lib/raise/jobs for root and the state directory of other users, or raise-jobs
+// in the working directory for a user without a home directory.
+func defaultJobsDir() string {
+	if os.Geteuid() == 0 {
+		return "/var/lib/raise/jobs"
+	}
+
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "raise", "jobs")
+	}
+
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".local", "state", "raise", "jobs")
+	}
+
+	return "raise-jobs"
+}
+
+// checkDir creates the jobs directory if needed and makes sure nobody else can change the scripts in it.
+// Scripts are run from it as the worker user.
+func (s *jobStore) checkDir() error {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+
+	fi, err := os.Lstat(s.dir)
+	if err != nil {
+		return err
+	}
+
+	if !fi.IsDir() {
+		return fmt.Errorf("jobs directory %s is not a directory", s.dir)
+	}
+
+	return checkPrivateDir(s.dir, fi)
+}
+
+func (s *jobStore) jobDir(id string) (string, error) {
+	if !jobIDPattern.MatchString(id) {
+		return "", fmt.Errorf("invalid job id %q", id)
+	}
+
+	if err := s.checkDir(); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(s.dir, id), nil
+}
+
+func (s *jobStore) start(script string) (proto.JobInfo, error) {
+	id := request.NewID()[:12]
+
+	dir, err := s.jobDir(id)
+	if err != nil {
+		return proto.JobInfo{}, err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return proto.JobInfo{}, err
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "script"), []byte(script), 0600); err != nil {
+		return proto.JobInfo{}, err
+	}
+
+	cmd, err := jobCommand(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return proto.JobInfo{}, err
+	}
+
+	setProcessGroup(cmd)
+
+	// Listing waits for job.json so a job is never seen half started.
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	record := jobRecord{
+		ID:        id,
+		Script:    script,
+		StartTime: time.Now(),
+	}
+
+	if err := cmd.Start(); err != nil {
+		os.RemoveAll(dir)
+		return proto.JobInfo{}, err
+	}
+
+	record.Pid = cmd.Process.Pid
+
+	// The process is not reaped until Wait so it can still be read even if it exited already.
+	record.ProcessStart, err = processStart(record.Pid)
+	if err != nil {
+		killJob(record.Pid)
+		cmd.Wait()
+		os.RemoveAll(dir)
+		return proto.JobInfo{}, fmt.Errorf("failed to identify job process %d: %v", record.Pid, err)
+	}
+
+	// Reap the wrapper. It records the exit code itself so nothing is lost if the worker stops first.
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			log.Printf("job %s: %v", id, err)
+		}
+	}()
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return proto.JobInfo{}, err
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "job.json"), data, 0600); err != nil {
+		return proto.JobInfo{}, err
+	}
+
+	log.Printf("started job %s as process %d", id, record.Pid)
+
+	return s.statusLocked(id)
+}
+
+func (s *jobStore) status(id string) (proto.JobInfo, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.statusLocked(id)
+}
+
+func (s *jobStore) recordLocked(id string) (jobRecord, error) {
+	dir, err := s.jobDir(id)
+	if err != nil {
+		return jobRecord{}, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "job.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return jobRecord{}, fmt.Errorf("unknown job %s", id)
+	} else if err != nil {
+		return jobRecord{}, err
+	}
+
+	var record jobRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return jobRecord{}, fmt.Errorf("invalid record for job %s: %v", id, err)
+	}
+
+	return record, nil
+}
+
+func (s *jobStore) statusLocked(id string) (proto.JobInfo, error) {
+	dir, err := s.jobDir(id)
+	if err != nil {
+		return proto.JobInfo{}, err
+	}
+
+	record, err := s.recordLocked(id)
+	if err != nil {
+		return proto.JobInfo{}, err
+	}
+
+	info := proto.JobInfo{
+		ID:        record.ID,
+		Script:    record.Script,
+		Pid:       record.Pid,
+		StartTime: record.StartTime,
+		ExitCode:  -1,
+	}
+
+	if fi, err := os.Stat(filepath.Join(dir, "stdout")); err == nil {
+		info.StdoutSize = fi.Size()
+	}
+
+	if fi, err := os.Stat(filepath.Join(dir, "stderr")); err == nil {
+		info.StderrSize = fi.Size()
+	}
+
+	exitFile := filepath.Join(dir, "exit")
+
+	if data, err := os.ReadFile(exitFile); err == nil {
+		info.ExitCode, err = strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			return proto.JobInfo{}, fmt.Errorf("invalid exit code for job %s: %v", id, err)
+		}
+
+		if info.ExitCode == 0 {
+			info.State = proto.JobSucceeded
+		} else {
+			info.State = proto.JobFailed
+		}
+
+		if fi, err := os.Stat(exitFile); err == nil {
+			info.EndTime = fi.ModTime()
+		}
+	} else if fi, err := os.Stat(filepath.Join(dir, "cancelled")); err == nil {
+		info.State = proto.JobCancelled
+		info.EndTime = fi.ModTime()
+	} else if record.running() {
+		info.State = proto.JobRunning
+	} else {
+		// Either the worker or the machine stopped before the wrapper could write the exit code.
+		info.State = proto.JobLost
+	}
+
+	return info, nil
+}
+
+// list describes every job oldest first.
+func (s *jobStore) list() ([]proto.JobInfo, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if err := s.checkDir(); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var ret []proto.JobInfo
+
+	for _, entry := range entries {
+		if !entry.IsDir() || !jobIDPattern.MatchString(entry.Name()) {
+			continue
+		}
+
+		info, err := s.statusLocked(entry.Name())
+		if err != nil {
+			log.Printf("skipping job %s: %v", entry.Name(), err)
+			continue
+		}
+
+		ret = append(ret, info)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].StartTime.Before(ret[j].StartTime)
+	})
+
+	return ret, nil
+}
+
+// output reads part of the stdout or stderr of a job and returns the size of the whole stream.
+func (s *jobStore) output(id string, stream proto.OutputStream, offset int64, length int64) ([]byte, int64, error) {
+	dir, err := s.jobDir(id)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if _, err := s.status(id); err != nil {
+		return nil, 0, err
+	}
+
+	if stream == "" {
+		stream = proto.StreamStdout
+	} else if stream != proto.StreamStdout && stream != proto.StreamStderr {
+		return nil, 0, fmt.Errorf("unknown output stream %s", stream)
+	}
+
+	if length <= 0 {
+		length = int64(proto.TransferChunkSize)
+	} else if length > int64(proto.MaxTransferChunkSize) {
+		length = int64(proto.MaxTransferChunkSize)
+	}
+
+	f, err := os.Open(filepath.Join(dir, string(stream)))
+	if errors.Is(err, os.ErrNotExist) {
+		// The wrapper has not created it yet.
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if offset >= fi.Size() {
+		return nil, fi.Size(), nil
+	}
+
+	buf := make([]byte, length)
+
+	n, err := f.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+
+	return buf[:n], fi.Size(), nil
+}
+
+// wait returns once the job has finished or ctx is done, whichever is first.
+func (s *jobStore) wait(ctx context.Context, id string) (proto.JobInfo, error) {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+
+	for {
+		info, err := s.status(id)
+		if err != nil || info.Finished() {
+			return info, err
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return info, nil
+		}
+	}
+}
+
+func (s *jobStore) cancel(id string) (proto.JobInfo, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	info, err := s.statusLocked(id)
+	if err != nil || info.Finished() {
+		return info, err
+	}
+
+	record, err := s.recordLocked(id)
+	if err != nil {
+		return proto.JobInfo{}, err
+	}
+
+	dir, err := s.jobDir(id)
+	if err != nil {
+		return proto.JobInfo{}, err
+	}
+
+	// Mark the job first so it is never seen as lost while it is being killed.
+	if err := os.WriteFile(filepath.Join(dir, "cancelled"), nil, 0600); err != nil {
+		return proto.JobInfo{}, err
+	}
+
+	// Check the process again right before signalling it in case it exited and its ID was reused since.
+	if !record.running() {
+		os.Remove(filepath.Join(dir, "cancelled"))
+		return s.statusLocked(id)
+	}
+
+	if err := killJob(record.Pid); err != nil {
+		return proto.JobInfo{}, fmt.Errorf("failed to kill job %s: %v", id, err)
+	}
+
+	log.Printf("cancelled job %s", id)
+
+	return s.statusLocked(id)
+}
+
+func (s *jobStore) remove(id string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	info, err := s.statusLocked(id)
+	if err != nil {
+		return err
+	}
+
+	if !info.Finished() {
+		return fmt.Errorf("job %s is still running", id)
+	}
+
+	dir, err := s.jobDir(id)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(dir)
+}
+
+// jobOperation returns the handler for a job message kind or nil.
+func (w *Worker) jobOperation(kind proto.MessageKind) func(ctx context.Context, req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	switch kind {
+	case proto.MessageStartJob:
+		return w.startJob
+	case proto.MessageJobs:
+		return w.listJobs
+	case proto.MessageJobStatus:
+		return w.jobStatus
+	case proto.MessageJobOutput:
+		return w.jobOutput
+	case proto.MessageWaitJob:
+		return w.waitJob
+	case proto.MessageCancelJob:
+		return w.cancelJob
+	case proto.MessageRemoveJob:
+		return w.removeJob
+	default:
+		return nil
+	}
+}
+
+func (w *Worker) startJob(ctx context.Context, req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	info, err := w.jobs.start(string(req.Content))
+	if err != nil {
+		return err
+	}
+
+	resp.Jobs = []proto.JobInfo{info}
+
+	return nil
+}
+
+func (w *Worker) listJobs(ctx context.Context, req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	jobs, err := w.jobs.list()
+	if err != nil {
+		return err
+	}
+
+	resp.Jobs = jobs
+
+	return nil
+}
+
+func (w *Worker) jobStatus(ctx context.Context, req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	info, err := w.jobs.status(req.JobID)
+	if err != nil {
+		return err
+	}
+
+	resp.Jobs = []proto.JobInfo{info}
+
+	return nil
+}
+
+func (w *Worker) jobOutput(ctx context.Context, req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	content, size, err := w.jobs.output(req.JobID, req.Stream, req.Offset, req.Length)
+	if err != nil {
+		return err
+	}
+
+	resp.Content = content
+	resp.Size = size
+
+	return nil
+}
+
+func (w *Worker) waitJob(ctx context.Context, req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	info, err := w.jobs.wait(ctx, req.JobID)
+	if err != nil {
+		return err
+	}
+
+	resp.Jobs = []proto.JobInfo{info}
+
+	return nil
+}
+
+func (w *Worker) cancelJob(ctx context.Context, req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	info, err := w.jobs.cancel(req.JobID)
+	if err != nil {
+		return err
+	}
+
+	resp.Jobs = []proto.JobInfo{info}
+
+	return nil
+}
+
+func (w *Worker) removeJob(ctx context.Context, req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	return w.jobs.remove(req.JobID)
+}
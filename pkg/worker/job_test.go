@@ -0,0 +1,127 @@
+//go:build linux
+
+package worker
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Vbitz/raise/v2/pkg/proto"
+)
+
+// TestJobsCheckProcessStart plants job records pointing at a process that is not the job,
+// like a process that was given the ID of a job after it exited.
+func TestJobsCheckProcessStart(t *testing.T) {
+	cmd := exec.Command("sleep", "30")
+	setProcessGroup(cmd)
+
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		killProcessGroup(cmd)
+		cmd.Wait()
+	}()
+
+	start, err := processStart(cmd.Process.Pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		start string
+		state proto.JobState
+	}{
+		{"same process", start, proto.JobRunning},
+		{"other process", start + "0", proto.JobLost},
+		{"not recorded", "", proto.JobLost},
+	}
+
+	store := newJobStore(filepath.Join(t.TempDir(), "jobs"))
+	if err := store.checkDir(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := []string{"a1", "b2", "c3"}[i]
+
+			record := jobRecord{ID: id, Pid: cmd.Process.Pid, StartTime: time.Now(), ProcessStart: tt.start}
+
+			data, err := json.Marshal(record)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dir := filepath.Join(store.dir, id)
+			if err := os.Mkdir(dir, 0700); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := os.WriteFile(filepath.Join(dir, "job.json"), data, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := store.status(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if info.State != tt.state {
+				t.Fatalf("state is %s, want %s", info.State, tt.state)
+			}
+
+			if tt.state == proto.JobRunning {
+				return
+			}
+
+			info, err = store.cancel(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if info.State != proto.JobLost {
+				t.Fatalf("state after cancel is %s, want %s", info.State, proto.JobLost)
+			}
+
+			if !processAlive(cmd.Process.Pid) {
+				t.Fatalf("cancelling the job killed a process that was not the job")
+			}
+		})
+	}
+}
+
+func TestJobRunsAndCancels(t *testing.T) {
+	store := newJobStore(filepath.Join(t.TempDir(), "jobs"))
+
+	info, err := store.start("sleep 30")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.State != proto.JobRunning {
+		t.Fatalf("state is %s, want %s", info.State, proto.JobRunning)
+	}
+
+	info, err = store.cancel(info.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.State != proto.JobCancelled {
+		t.Fatalf("state after cancel is %s, want %s", info.State, proto.JobCancelled)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for processAlive(info.Pid) {
+		if time.Now().After(deadline) {
+			t.Fatalf("job process %d is still running", info.Pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,59 @@
+package worker
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/Vbitz/raise/v2/pkg/proto"
+)
+
+// The longest line lineWriter holds on to before sending it anyway.
+const maxLineLength = 32 * 1024
+
+// lineWriter passes everything written to it to send split on line boundaries.
+// Close sends whatever is left of an unterminated last line.
+type lineWriter struct {
+	stream proto.OutputStream
+	send   func(stream proto.OutputStream, data []byte)
+
+	mtx     sync.Mutex
+	partial []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	w.partial = append(w.partial, p...)
+
+	end := bytes.LastIndexByte(w.partial, '\n') + 1
+	if end == 0 && len(w.partial) >= maxLineLength {
+		end = len(w.partial)
+	}
+
+	if end > 0 {
+		w.send(w.stream, w.partial[:end])
+		w.partial = append([]byte{}, w.partial[end:]...)
+	}
+
+	return len(p), nil
+}
+
+func (w *lineWriter) Close() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if len(w.partial) > 0 {
+		w.send(w.stream, w.partial)
+		w.partial = nil
+	}
+
+	return nil
+}
+
+func newLineWriter(stream proto.OutputStream, send func(stream proto.OutputStream, data []byte)) *lineWriter {
+	return &lineWriter{
+		stream: stream,
+		send:   send,
+	}
+}
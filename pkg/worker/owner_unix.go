@@ -0,0 +1,109 @@
+//go:build !windows
+
+package worker
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"github.com/Vbitz/raise/v2/pkg/proto"
+)
+
+// resolveOwner returns the uid and gid to give a written file. owner and group are names or numeric ids.
+// -1 leaves an id as it is. When running as root the ownership of the file being replaced is kept by default.
+func resolveOwner(owner string, group string, existing os.FileInfo) (int, int, error) {
+	uid, gid := -1, -1
+
+	if stat, ok := existingStat(existing); ok && os.Geteuid() == 0 {
+		uid, gid = int(stat.Uid), int(stat.Gid)
+	}
+
+	if owner != "" {
+		id, err := strconv.Atoi(owner)
+		if err != nil {
+			u, err := user.Lookup(owner)
+			if err != nil {
+				return 0, 0, err
+			}
+
+			id, err = strconv.Atoi(u.Uid)
+			if err != nil {
+				return 0, 0, fmt.Errorf("invalid uid for user %s: %s", owner, u.Uid)
+			}
+		}
+		uid = id
+	}
+
+	if group != "" {
+		id, err := strconv.Atoi(group)
+		if err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return 0, 0, err
+			}
+
+			id, err = strconv.Atoi(g.Gid)
+			if err != nil {
+				return 0, 0, fmt.Errorf("invalid gid for group %s: %s", group, g.Gid)
+			}
+		}
+		gid = id
+	}
+
+	return uid, gid, nil
+}
+
+func existingStat(existing os.FileInfo) (*syscall.Stat_t, bool) {
+	if existing == nil {
+		return nil, false
+	}
+
+	stat, ok := existing.Sys().(*syscall.Stat_t)
+	return stat, ok
+}
+
+// ownerNames looks up the names of users and groups, remembering them for a whole directory listing.
+type ownerNames struct {
+	users  map[uint32]string
+	groups map[uint32]string
+}
+
+func newOwnerNames() *ownerNames {
+	return &ownerNames{
+		users:  make(map[uint32]string),
+		groups: make(map[uint32]string),
+	}
+}
+
+// fill sets the ownership fields of info from the stat result of the file.
+func (n *ownerNames) fill(info *proto.FileInfo, fi os.FileInfo) {
+	info.Uid, info.Gid = -1, -1
+
+	stat, ok := existingStat(fi)
+	if !ok {
+		return
+	}
+
+	info.Uid, info.Gid = int(stat.Uid), int(stat.Gid)
+
+	name, ok := n.users[stat.Uid]
+	if !ok {
+		if u, err := user.LookupId(strconv.Itoa(int(stat.Uid))); err == nil {
+			name = u.Username
+		}
+		n.users[stat.Uid] = name
+	}
+	info.Owner = name
+
+	name, ok = n.groups[stat.Gid]
+	if !ok {
+		if g, err := user.LookupGroupId(strconv.Itoa(int(stat.Gid))); err == nil {
+			name = g.Name
+		}
+		n.groups[stat.Gid] = name
+	}
+	info.Group = name
+}
@@ -0,0 +1,30 @@
+//go:build windows
+
+package worker
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Vbitz/raise/v2/pkg/proto"
+)
+
+// resolveOwner returns -1 for both ids. Windows files have no uid or gid to set.
+func resolveOwner(owner string, group string, existing os.FileInfo) (int, int, error) {
+	if owner != "" || group != "" {
+		return 0, 0, fmt.Errorf("setting the owner of a file is not supported on windows")
+	}
+
+	return -1, -1, nil
+}
+
+type ownerNames struct{}
+
+func newOwnerNames() *ownerNames {
+	return &ownerNames{}
+}
+
+// fill marks the ownership of info as unknown. Windows has no uid or gid.
+func (n *ownerNames) fill(info *proto.FileInfo, fi os.FileInfo) {
+	info.Uid, info.Gid = -1, -1
+}
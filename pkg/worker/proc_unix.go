@@ -0,0 +1,83 @@
+//go:build !windows
+
+package worker
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// setProcessGroup starts the command in its own process group so everything it spawns can be killed together.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+var signalNames = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"KILL":  syscall.SIGKILL,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"TERM":  syscall.SIGTERM,
+	"CONT":  syscall.SIGCONT,
+	"STOP":  syscall.SIGSTOP,
+	"TSTP":  syscall.SIGTSTP,
+	"WINCH": syscall.SIGWINCH,
+}
+
+// parseSignal parses a signal name such as "SIGTERM" or "TERM".
+func parseSignal(name string) (syscall.Signal, error) {
+	sig, ok := signalNames[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !ok {
+		return 0, fmt.Errorf("unknown signal %s", name)
+	}
+	return sig, nil
+}
+
+func signalProcess(pid int, sig syscall.Signal) error {
+	return syscall.Kill(pid, sig)
+}
+
+// jobWrapper runs the script of a detached job with its output going to files in the job directory
+// and records the exit code once it finishes.
+const jobWrapper = `/bin/bash "$1/script" < /dev/null > "$1/stdout" 2> "$1/stderr"
+echo $? > "$1/exit.tmp" && mv "$1/exit.tmp" "$1/exit"`
+
+func jobCommand(dir string) (*exec.Cmd, error) {
+	return exec.Command("/bin/bash", "-c", jobWrapper, "raise-job", dir), nil
+}
+
+// killJob kills the process group a job was started in.
+func killJob(pid int) error {
+	err := syscall.Kill(-pid, syscall.SIGKILL)
+	if err == syscall.ESRCH {
+		return nil
+	}
+	return err
+}
+
+// checkPrivateDir returns an error unless dir is owned by the worker user and no one else can access it.
+func checkPrivateDir(dir string, fi os.FileInfo) error {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Geteuid() {
+		return fmt.Errorf("%s is owned by uid %d, not the worker user", dir, st.Uid)
+	}
+
+	if fi.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("%s has mode %o, it must only be accessible by the worker user", dir, fi.Mode().Perm())
+	}
+
+	return nil
+}
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
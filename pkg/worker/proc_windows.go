@@ -0,0 +1,45 @@
+//go:build windows
+
+package worker
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// killProcessGroup only kills the top level process. Windows has no equivalent of killing a process group
+// without job objects.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+func parseSignal(name string) (syscall.Signal, error) {
+	return 0, fmt.Errorf("signals are not supported on windows")
+}
+
+func signalProcess(pid int, sig syscall.Signal) error {
+	return fmt.Errorf("signals are not supported on windows")
+}
+
+func jobCommand(dir string) (*exec.Cmd, error) {
+	return nil, fmt.Errorf("jobs are not supported on windows")
+}
+
+func killJob(pid int) error {
+	return fmt.Errorf("jobs are not supported on windows")
+}
+
+// checkPrivateDir does nothing since jobs are not supported on windows.
+func checkPrivateDir(dir string, fi os.FileInfo) error {
+	return nil
+}
+
+func processAlive(pid int) bool {
+	return false
+}
@@ -0,0 +1,167 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/Vbitz/raise/v2/pkg/proto"
+)
+
+// processOperation returns the handler for a message kind that works on processes or nil.
+func (w *Worker) processOperation(kind proto.MessageKind) func(req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	switch kind {
+	case proto.MessageProcesses:
+		return w.processes
+	case proto.MessageKill:
+		return w.kill
+	default:
+		return nil
+	}
+}
+
+// processMatcher checks processes against a proto.ProcessFilter.
+type processMatcher struct {
+	filter      proto.ProcessFilter
+	commandLine *regexp.Regexp
+}
+
+func newProcessMatcher(filter proto.ProcessFilter) (*processMatcher, error) {
+	m := &processMatcher{filter: filter}
+
+	if filter.Name != "" {
+		if _, err := path.Match(filter.Name, ""); err != nil {
+			return nil, fmt.Errorf("invalid name pattern %s: %v", filter.Name, err)
+		}
+	}
+
+	if filter.CommandLine != "" {
+		re, err := regexp.Compile(filter.CommandLine)
+		if err != nil {
+			return nil, fmt.Errorf("invalid command line pattern: %v", err)
+		}
+		m.commandLine = re
+	}
+
+	return m, nil
+}
+
+func (m *processMatcher) match(info proto.ProcessInfo) bool {
+	if m.filter.Name != "" {
+		if ok, _ := path.Match(m.filter.Name, info.Command); !ok {
+			return false
+		}
+	}
+
+	if m.filter.User != "" && m.filter.User != info.User && m.filter.User != strconv.Itoa(info.Uid) {
+		return false
+	}
+
+	if m.commandLine != nil && !m.commandLine.MatchString(strings.Join(info.CommandLine, " ")) {
+		return false
+	}
+
+	return true
+}
+
+// matchingProcesses lists the processes the filter matches.
+func matchingProcesses(filter proto.ProcessFilter) ([]proto.ProcessInfo, error) {
+	matcher, err := newProcessMatcher(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	all, err := listProcesses()
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []proto.ProcessInfo
+	for _, info := range all {
+		if matcher.match(info) {
+			ret = append(ret, info)
+		}
+	}
+
+	return ret, nil
+}
+
+func (w *Worker) processes(req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	processes, err := matchingProcesses(req.Filter)
+	if err != nil {
+		return err
+	}
+
+	resp.Processes = processes
+
+	return nil
+}
+
+// kill sends a signal to req.Pid or to every process req.Filter matches other than the worker itself.
+// The processes that were signalled are returned.
+func (w *Worker) kill(req proto.SendMessageReq, resp *proto.SendMessageResp) error {
+	name := req.Signal
+	if name == "" {
+		name = "TERM"
+	}
+
+	sig, err := parseSignal(name)
+	if err != nil {
+		return err
+	}
+
+	// Zero means no pid was given. Negative pids would signal process groups or every process.
+	if req.Pid < 0 {
+		return fmt.Errorf("invalid pid %d", req.Pid)
+	} else if req.Pid == os.Getpid() {
+		return fmt.Errorf("refusing to signal the worker itself")
+	} else if req.Pid != 0 {
+		if err := signalProcess(req.Pid, sig); err != nil {
+			return fmt.Errorf("failed to signal process %d: %v", req.Pid, err)
+		}
+
+		resp.Processes = []proto.ProcessInfo{{Pid: req.Pid, Uid: -1}}
+
+		return nil
+	}
+
+	// An empty filter would take the whole machine down with the worker.
+	if req.Filter.IsEmpty() {
+		return fmt.Errorf("kill needs a pid or a process filter")
+	}
+
+	processes, err := matchingProcesses(req.Filter)
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+
+	for _, info := range processes {
+		if info.Pid == os.Getpid() {
+			continue
+		}
+
+		err := signalProcess(info.Pid, sig)
+		if errors.Is(err, syscall.ESRCH) {
+			// The process exited after it was listed.
+			continue
+		} else if err != nil {
+			failed = append(failed, fmt.Sprintf("%d: %v", info.Pid, err))
+			continue
+		}
+
+		resp.Processes = append(resp.Processes, info)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to signal processes %s", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,169 @@
+package worker
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Vbitz/raise/v2/pkg/proto"
+)
+
+// clockTicks is the unit of the times in /proc/<pid>/stat. It is 100 on every architecture Linux runs on
+// unless the kernel was built otherwise.
+const clockTicks = 100
+
+// bootTime reads the time the machine started from /proc/stat.
+func bootTime() (time.Time, error) {
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "btime" {
+			seconds, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return time.Time{}, err
+			}
+			return time.Unix(seconds, 0), nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("no btime in /proc/stat")
+}
+
+func ticksToDuration(ticks string) time.Duration {
+	value, _ := strconv.ParseInt(ticks, 10, 64)
+	return time.Duration(value) * time.Second / clockTicks
+}
+
+// readStat reads /proc/<pid>/stat and returns the command name and the fields after it,
+// which start at field 3 of proc(5).
+func readStat(pid int) (string, []string, error) {
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return "", nil, err
+	}
+
+	// The command name is in brackets and may contain spaces or brackets itself.
+	open := bytes.IndexByte(stat, '(')
+	end := bytes.LastIndexByte(stat, ')')
+	if open < 0 || end < open {
+		return "", nil, fmt.Errorf("invalid stat for process %d", pid)
+	}
+
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 22 {
+		return "", nil, fmt.Errorf("invalid stat for process %d", pid)
+	}
+
+	return string(stat[open+1 : end]), fields, nil
+}
+
+// processStart identifies a process by the boot it was started in and its start time in clock ticks
+// since then. A process ID can be reused once its process exits but not with the same start.
+func processStart(pid int) (string, error) {
+	bootID, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return "", err
+	}
+
+	_, fields, err := readStat(pid)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(bootID)) + "/" + fields[19], nil
+}
+
+// readProcess describes one process from /proc.
+func readProcess(pid int, boot time.Time, users map[int]string) (proto.ProcessInfo, error) {
+	dir := filepath.Join("/proc", strconv.Itoa(pid))
+
+	command, fields, err := readStat(pid)
+	if err != nil {
+		return proto.ProcessInfo{}, err
+	}
+
+	info := proto.ProcessInfo{
+		Pid:     pid,
+		Uid:     -1,
+		Command: command,
+		State:   fields[0],
+		CPUTime: ticksToDuration(fields[11]) + ticksToDuration(fields[12]),
+	}
+
+	info.PPid, _ = strconv.Atoi(fields[1])
+
+	if rss, err := strconv.ParseInt(fields[21], 10, 64); err == nil {
+		info.RSS = rss * int64(os.Getpagesize())
+	}
+
+	if !boot.IsZero() {
+		info.StartTime = boot.Add(ticksToDuration(fields[19]))
+	}
+
+	if cmdline, err := os.ReadFile(filepath.Join(dir, "cmdline")); err == nil && len(cmdline) > 0 {
+		info.CommandLine = strings.Split(strings.TrimSuffix(string(cmdline), "\x00"), "\x00")
+	}
+
+	if fi, err := os.Stat(dir); err == nil {
+		if sys, ok := fi.Sys().(*syscall.Stat_t); ok {
+			info.Uid = int(sys.Uid)
+
+			name, ok := users[info.Uid]
+			if !ok {
+				if u, err := user.LookupId(strconv.Itoa(info.Uid)); err == nil {
+					name = u.Username
+				}
+				users[info.Uid] = name
+			}
+			info.User = name
+		}
+	}
+
+	return info, nil
+}
+
+// listProcesses describes every process on the machine in order of pid.
+func listProcesses() ([]proto.ProcessInfo, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	// The start times are left out if the boot time is not known.
+	boot, _ := bootTime()
+	users := make(map[int]string)
+
+	var ret []proto.ProcessInfo
+
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+
+		info, err := readProcess(pid, boot, users)
+		if err != nil {
+			// The process exited while it was being read.
+			continue
+		}
+
+		ret = append(ret, info)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Pid < ret[j].Pid
+	})
+
+	return ret, nil
+}
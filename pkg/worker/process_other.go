@@ -0,0 +1,19 @@
+//go:build !linux
+
+package worker
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/Vbitz/raise/v2/pkg/proto"
+)
+
+func listProcesses() ([]proto.ProcessInfo, error) {
+	return nil, fmt.Errorf("listing processes is not supported on %s", runtime.GOOS)
+}
+
+// processStart can not tell processes with the same ID apart here so processes are only identified by it.
+func processStart(pid int) (string, error) {
+	return "", nil
+}
@@ -0,0 +1,76 @@
+//go:build linux
+
+package worker
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// openPTY opens a new pseudo-terminal pair.
+func openPTY() (master *os.File, slave *os.File, err error) {
+	fd, err := unix.Open("/dev/ptmx", unix.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	master = os.NewFile(uintptr(fd), "/dev/ptmx")
+
+	n, err := unix.IoctlGetUint32(fd, unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+
+	// Unlock the slave so it can be opened.
+	err = unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+
+	slaveName := fmt.Sprintf("/dev/pts/%d", n)
+
+	slave, err = os.OpenFile(slaveName, os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+
+	return master, slave, nil
+}
+
+// startInPTY starts cmd in a new session with slave as its controlling terminal.
+func startInPTY(cmd *exec.Cmd, slave *os.File) error {
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setsid:  true,
+		Setctty: true,
+		Ctty:    0,
+	}
+
+	return cmd.Start()
+}
+
+func setWindowSize(master *os.File, rows uint16, cols uint16) error {
+	return unix.IoctlSetWinsize(int(master.Fd()), unix.TIOCSWINSZ, &unix.Winsize{
+		Row: rows,
+		Col: cols,
+	})
+}
+
+// signalForeground sends a signal to the foreground process group of the terminal.
+func signalForeground(master *os.File, sig syscall.Signal) error {
+	pgrp, err := unix.IoctlGetInt(int(master.Fd()), unix.TIOCGPGRP)
+	if err != nil {
+		return err
+	}
+
+	return syscall.Kill(-pgrp, sig)
+}
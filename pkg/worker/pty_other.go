@@ -0,0 +1,27 @@
+//go:build !linux
+
+package worker
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+)
+
+func openPTY() (master *os.File, slave *os.File, err error) {
+	return nil, nil, fmt.Errorf("pseudo-terminals are not supported on %s", runtime.GOOS)
+}
+
+func startInPTY(cmd *exec.Cmd, slave *os.File) error {
+	return fmt.Errorf("pseudo-terminals are not supported on %s", runtime.GOOS)
+}
+
+func setWindowSize(master *os.File, rows uint16, cols uint16) error {
+	return fmt.Errorf("pseudo-terminals are not supported on %s", runtime.GOOS)
+}
+
+func signalForeground(master *os.File, sig syscall.Signal) error {
+	return fmt.Errorf("pseudo-terminals are not supported on %s", runtime.GOOS)
+}
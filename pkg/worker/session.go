@@ -0,0 +1,258 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+
+	"github.com/Vbitz/raise/v2/pkg/proto"
+	"github.com/cenkalti/rpc2"
+)
+
+// session is a long lived session opened with OpenSession.
+type session interface {
+	// handle processes an event sent by the client.
+	handle(event proto.SessionData) error
+	// close ends the session because the client or server asked for it.
+	close() error
+}
+
+type sessionRegistry struct {
+	mtx      sync.Mutex
+	sessions map[string]session
+}
+
+func (r *sessionRegistry) add(id string, s session) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if _, ok := r.sessions[id]; ok {
+		return fmt.Errorf("session %s already exists", id)
+	}
+
+	r.sessions[id] = s
+
+	return nil
+}
+
+func (r *sessionRegistry) remove(id string) session {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	s := r.sessions[id]
+	delete(r.sessions, id)
+
+	return s
+}
+
+func (r *sessionRegistry) get(id string) session {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	return r.sessions[id]
+}
+
+// closeAll closes every session. It is used when the connection to the server goes away.
+func (r *sessionRegistry) closeAll() {
+	r.mtx.Lock()
+	sessions := r.sessions
+	r.sessions = make(map[string]session)
+	r.mtx.Unlock()
+
+	for id, s := range sessions {
+		if err := s.close(); err != nil {
+			log.Printf("failed to close session %s: %v", id, err)
+		}
+	}
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{
+		sessions: make(map[string]session),
+	}
+}
+
+// OpenSession implements proto.WorkerService
+func (w *Worker) OpenSession(client *rpc2.Client, req proto.OpenSessionReq, resp *proto.OpenSessionResp) error {
+	*resp = proto.OpenSessionResp{}
+
+	if req.Kind == proto.SessionShell {
+		return w.openShell(client, req)
+	} else if req.Kind == proto.SessionForward {
+		return w.openForward(client, req)
+	} else {
+		return fmt.Errorf("unknown session kind: %s", req.Kind)
+	}
+}
+
+// SessionData implements proto.WorkerService
+func (w *Worker) SessionData(client *rpc2.Client, req proto.SessionData, resp *proto.SessionDataResp) error {
+	*resp = proto.SessionDataResp{}
+
+	s := w.sessions.get(req.SessionID)
+	if s == nil {
+		return fmt.Errorf("session %s does not exist", req.SessionID)
+	}
+
+	return s.handle(req)
+}
+
+// CloseSession implements proto.WorkerService
+func (w *Worker) CloseSession(client *rpc2.Client, req proto.CloseSessionReq, resp *proto.CloseSessionResp) error {
+	*resp = proto.CloseSessionResp{}
+
+	s := w.sessions.remove(req.SessionID)
+	if s == nil {
+		return nil
+	}
+
+	return s.close()
+}
+
+// endSession tells the server a session ended by itself.
+func (w *Worker) endSession(client *rpc2.Client, id string, exitCode int, err error) {
+	if w.sessions.remove(id) == nil {
+		// The session was closed by the other side.
+		return
+	}
+
+	req := proto.CloseSessionReq{
+		SessionID: id,
+		ExitCode:  exitCode,
+	}
+	if err != nil {
+		req.Error = err.Error()
+	}
+
+	var resp proto.CloseSessionResp
+	if err := client.Call(proto.Common_CloseSession, req, &resp); err != nil {
+		log.Printf("failed to close session %s: %v", id, err)
+	}
+}
+
+type shellSession struct {
+	cmd    *exec.Cmd
+	master *os.File
+}
+
+// handle implements session
+func (s *shellSession) handle(event proto.SessionData) error {
+	if event.Rows != 0 && event.Cols != 0 {
+		if err := setWindowSize(s.master, event.Rows, event.Cols); err != nil {
+			return err
+		}
+	}
+
+	if event.Signal != "" {
+		sig, err := parseSignal(event.Signal)
+		if err != nil {
+			return err
+		}
+
+		if err := signalForeground(s.master, sig); err != nil {
+			return err
+		}
+	}
+
+	if len(event.Data) > 0 {
+		if _, err := s.master.Write(event.Data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// close implements session
+func (s *shellSession) close() error {
+	err := killProcessGroup(s.cmd)
+	if err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return err
+	}
+
+	return nil
+}
+
+func (w *Worker) openShell(client *rpc2.Client, req proto.OpenSessionReq) error {
+	command := req.Command
+	if command == "" {
+		command = os.Getenv("SHELL")
+	}
+	if command == "" {
+		command = "/bin/sh"
+	}
+
+	master, slave, err := openPTY()
+	if err != nil {
+		return err
+	}
+	defer slave.Close()
+
+	if req.Rows != 0 && req.Cols != 0 {
+		if err := setWindowSize(master, req.Rows, req.Cols); err != nil {
+			master.Close()
+			return err
+		}
+	}
+
+	cmd := exec.Command(command)
+	cmd.Env = append(os.Environ(), "TERM="+req.Term)
+	if home, err := os.UserHomeDir(); err == nil {
+		cmd.Dir = home
+	}
+
+	if err := startInPTY(cmd, slave); err != nil {
+		master.Close()
+		return err
+	}
+
+	err = w.sessions.add(req.SessionID, &shellSession{
+		cmd:    cmd,
+		master: master,
+	})
+	if err != nil {
+		cmd.Process.Kill()
+		master.Close()
+		return err
+	}
+
+	log.Printf("opened shell session %s running %s", req.SessionID, command)
+
+	go func() {
+		buf := make([]byte, 32*1024)
+
+		for {
+			n, err := master.Read(buf)
+			if n > 0 {
+				var resp proto.SessionDataResp
+				callErr := client.Call(proto.Common_SessionData, proto.SessionData{
+					SessionID: req.SessionID,
+					Data:      buf[:n],
+				}, &resp)
+				if callErr != nil {
+					log.Printf("failed to send shell output: %v", callErr)
+				}
+			}
+			if err != nil {
+				// Linux reports EIO once every process holding the terminal has exited.
+				break
+			}
+		}
+
+		err := cmd.Wait()
+		master.Close()
+
+		if _, ok := err.(*exec.ExitError); ok {
+			err = nil
+		}
+
+		log.Printf("shell session %s exited with code %d", req.SessionID, cmd.ProcessState.ExitCode())
+
+		w.endSession(client, req.SessionID, cmd.ProcessState.ExitCode(), err)
+	}()
+
+	return nil
+}
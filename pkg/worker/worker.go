@@ -7,13 +7,20 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
 	"runtime"
+	"syscall"
 	"time"
 
+	"github.com/Vbitz/raise/v2/pkg/common"
+	"github.com/Vbitz/raise/v2/pkg/facts"
+	"github.com/Vbitz/raise/v2/pkg/heartbeat"
 	"github.com/Vbitz/raise/v2/pkg/proto"
+	"github.com/Vbitz/raise/v2/pkg/request"
+	"github.com/Vbitz/raise/v2/pkg/security"
 	"github.com/cenkalti/rpc2"
 	"github.com/gobwas/ws"
 )
@@ -22,6 +29,15 @@ type Worker struct {
 	serverCertificate string
 	serverAddress     string
 	name              string
+	workerCertificate string
+	workerKey         string
+	heartbeatConfig   heartbeat.Config
+	labels            map[string]string
+	disabledFacts     map[string]bool
+	customFacts       *facts.ScriptCollector
+	jobs              *jobStore
+	requests          *request.Tracker
+	sessions          *sessionRegistry
 
 	rpcClient *rpc2.Client
 }
@@ -44,6 +60,13 @@ func (w *Worker) GetInfo(client *rpc2.Client, req proto.GetInfoReq, resp *proto.
 
 	resp.OperatingSystem = runtime.GOOS
 	resp.Architecture = runtime.GOARCH
+	resp.Version = common.Commit
+
+	facts.Collect(resp, w.disabledFacts)
+
+	if w.customFacts != nil && !w.disabledFacts[facts.CustomName] {
+		w.customFacts.Collect(resp)
+	}
 
 	return nil
 }
@@ -52,29 +75,45 @@ func (w *Worker) GetInfo(client *rpc2.Client, req proto.GetInfoReq, resp *proto.
 func (w *Worker) SendMessage(client *rpc2.Client, req proto.SendMessageReq, resp *proto.SendMessageResp) error {
 	*resp = proto.SendMessageResp{}
 
-	if req.Kind == proto.MessageReadFile {
-		content, err := os.ReadFile(req.Filename)
-		if err != nil {
-			return err
-		}
-
-		resp.Content = content
+	// Only the server sends messages to the worker and it prefixes request IDs with the client, so
+	// requests have no owner here.
+	ctx, cancel := w.requests.Start(context.Background(), req.RequestID, "", req.Timeout)
+	defer cancel()
 
-		return nil
-	} else if req.Kind == proto.MessageWriteFile {
-		err := os.WriteFile(req.Filename, req.Content, os.ModePerm)
-		if err != nil {
-			return err
+	if op := w.fileOperation(req.Kind); op != nil {
+		err := op(req, resp)
+		if code := proto.FileErrorCodeFor(err); code != "" {
+			*resp = proto.SendMessageResp{ErrorCode: code, ErrorMessage: err.Error()}
+			return nil
 		}
-
-		return nil
+		return err
+	} else if op := w.processOperation(req.Kind); op != nil {
+		return op(req, resp)
+	} else if op := w.jobOperation(req.Kind); op != nil {
+		return op(ctx, req, resp)
 	} else if req.Kind == proto.MessageRunScript {
-		content, err := w.RunScript(string(req.Content))
+		var output func(stream proto.OutputStream, data []byte)
+		if req.StreamOutput {
+			output = func(stream proto.OutputStream, data []byte) {
+				var resp proto.OutputResp
+				err := client.Call(proto.Control_Output, proto.OutputChunk{
+					RequestID: req.RequestID,
+					Stream:    stream,
+					Data:      data,
+				}, &resp)
+				if err != nil {
+					log.Printf("failed to stream output: %v", err)
+				}
+			}
+		}
+
+		result, err := w.RunScript(ctx, string(req.Content), output)
 		if err != nil {
 			return err
 		}
 
-		resp.Content = content
+		resp.Content = result.Stdout
+		resp.ScriptResult = result
 
 		return nil
 	} else {
@@ -92,7 +131,74 @@ func (w *Worker) Ping(client *rpc2.Client, req proto.PingReq, resp *proto.PingRe
 	return nil
 }
 
-func (w *Worker) RunScript(script string) ([]byte, error) {
+// Cancel implements proto.WorkerService
+func (w *Worker) Cancel(client *rpc2.Client, req proto.CancelReq, resp *proto.CancelResp) error {
+	*resp = proto.CancelResp{}
+
+	if cancelled, _ := w.requests.Cancel(req.RequestID, ""); cancelled {
+		log.Printf("cancelled request %s", req.RequestID)
+	}
+
+	return nil
+}
+
+// Heartbeat implements proto.WorkerService
+func (w *Worker) Heartbeat(client *rpc2.Client, req proto.HeartbeatReq, resp *proto.HeartbeatResp) error {
+	*resp = proto.HeartbeatResp{}
+	return nil
+}
+
+func (w *Worker) SetHeartbeatConfig(config heartbeat.Config) {
+	w.heartbeatConfig = config
+}
+
+// SetLabels sets the labels the worker registers with. Clients use them to select workers.
+func (w *Worker) SetLabels(labels map[string]string) {
+	w.labels = labels
+}
+
+// SetFactsDir runs the executables in dir for custom facts. Their results are cached for ttl.
+func (w *Worker) SetFactsDir(dir string, ttl time.Duration) {
+	w.customFacts = facts.NewScriptCollector(dir, ttl)
+}
+
+// SetJobsDir sets the directory detached jobs are kept in. It defaults to /var/lib/raise/jobs for root
+// and the state directory of other users. It is created if missing and must only be accessible by the worker user.
+func (w *Worker) SetJobsDir(dir string) error {
+	jobs := newJobStore(dir)
+	if err := jobs.checkDir(); err != nil {
+		return err
+	}
+
+	w.jobs = jobs
+
+	return nil
+}
+
+// SetDisabledFacts turns off fact collectors by name. See facts.Names for the collectors there are.
+func (w *Worker) SetDisabledFacts(names []string) error {
+	known := map[string]bool{facts.CustomName: true}
+	for _, name := range facts.Names() {
+		known[name] = true
+	}
+
+	disabled := make(map[string]bool)
+	for _, name := range names {
+		if !known[name] {
+			return fmt.Errorf("unknown fact collector: %s", name)
+		}
+		disabled[name] = true
+	}
+
+	w.disabledFacts = disabled
+
+	return nil
+}
+
+// RunScript runs a script with the system shell. The error is only set if the script could not be started
+// or was cancelled. The script and everything it started is killed once ctx is done.
+// If output is set it is called with the output of the script as it is produced.
+func (w *Worker) RunScript(ctx context.Context, script string, output func(stream proto.OutputStream, data []byte)) (proto.ScriptResult, error) {
 	var cmd *exec.Cmd
 
 	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
@@ -102,25 +208,75 @@ func (w *Worker) RunScript(script string) ([]byte, error) {
 		cmd = exec.Command("powershell.exe", "-Command", "-")
 		cmd.Stdin = bytes.NewReader([]byte(script))
 	} else {
-		return nil, fmt.Errorf("operating system %s not supported", runtime.GOOS)
+		return proto.ScriptResult{}, fmt.Errorf("operating system %s not supported", runtime.GOOS)
 	}
 
+	setProcessGroup(cmd)
+
 	stdoutBuffer := new(bytes.Buffer)
+	stderrBuffer := new(bytes.Buffer)
 
 	cmd.Stdout = stdoutBuffer
-	cmd.Stderr = stdoutBuffer
+	cmd.Stderr = stderrBuffer
+
+	if output != nil {
+		stdoutWriter := newLineWriter(proto.StreamStdout, output)
+		stderrWriter := newLineWriter(proto.StreamStderr, output)
+		defer stdoutWriter.Close()
+		defer stderrWriter.Close()
+
+		cmd.Stdout = io.MultiWriter(stdoutBuffer, stdoutWriter)
+		cmd.Stderr = io.MultiWriter(stderrBuffer, stderrWriter)
+	}
+
+	result := proto.ScriptResult{
+		StartTime: time.Now(),
+	}
 
 	err := cmd.Start()
 	if err != nil {
-		return nil, err
+		return proto.ScriptResult{}, err
 	}
 
+	done := make(chan struct{})
+	killed := make(chan bool, 1)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			if err := killProcessGroup(cmd); err != nil {
+				log.Printf("failed to kill script: %v", err)
+			}
+			killed <- true
+		case <-done:
+			killed <- false
+		}
+	}()
+
 	err = cmd.Wait()
-	if err != nil {
-		return nil, err
+	close(done)
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		return proto.ScriptResult{}, err
 	}
 
-	return stdoutBuffer.Bytes(), nil
+	if <-killed {
+		if ctx.Err() != context.DeadlineExceeded {
+			return proto.ScriptResult{}, fmt.Errorf("script cancelled")
+		}
+
+		result.TimedOut = true
+	}
+
+	result.Duration = time.Since(result.StartTime)
+	result.Stdout = stdoutBuffer.Bytes()
+	result.Stderr = stderrBuffer.Bytes()
+	result.ExitCode = cmd.ProcessState.ExitCode()
+
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		result.Signal = status.Signal().String()
+	}
+
+	return result, nil
 }
 
 func (w *Worker) Connect() error {
@@ -140,8 +296,25 @@ func (w *Worker) Connect() error {
 
 	dialer.TLSConfig = &tls.Config{}
 
+	// The server only accepts workers presenting a certificate it has been told to trust for this name.
+	crt, err := security.LoadCertificatePair(w.workerCertificate, w.workerKey)
+	if err != nil {
+		return err
+	}
+
 	dialer.TLSConfig.ServerName = "localhost"
 
+	dialer.TLSConfig.GetClientCertificate = func(
+		cri *tls.CertificateRequestInfo,
+	) (*tls.Certificate, error) {
+		err := cri.SupportsCertificate(&crt)
+		if err != nil {
+			return nil, err
+		}
+
+		return &crt, nil
+	}
+
 	dialer.TLSConfig.RootCAs = certPool
 
 	conn, _, _, err := dialer.Dial(context.Background(), w.serverAddress+"/worker")
@@ -156,11 +329,20 @@ func (w *Worker) Connect() error {
 	w.rpcClient.Handle(proto.Common_Ping, w.Ping)
 	w.rpcClient.Handle(proto.Common_SendMessage, w.SendMessage)
 	w.rpcClient.Handle(proto.Common_GetInfo, w.GetInfo)
+	w.rpcClient.Handle(proto.Common_Heartbeat, w.Heartbeat)
+	w.rpcClient.Handle(proto.Common_Cancel, w.Cancel)
+	w.rpcClient.Handle(proto.Common_OpenSession, w.OpenSession)
+	w.rpcClient.Handle(proto.Common_SessionData, w.SessionData)
+	w.rpcClient.Handle(proto.Common_CloseSession, w.CloseSession)
 
 	// Send the hello message to register the worker with the server.
 	var helloResp proto.HelloResp
 	err = w.rpcClient.Call(proto.Control_Hello, proto.HelloReq{
-		Name: w.name,
+		Name:            w.name,
+		Commit:          common.Commit,
+		OperatingSystem: runtime.GOOS,
+		Architecture:    runtime.GOARCH,
+		Labels:          w.labels,
 	}, &helloResp)
 	if err != nil {
 		return err
@@ -168,19 +350,38 @@ func (w *Worker) Connect() error {
 
 	log.Printf("worker registered as %s on server %s", w.name, w.serverAddress)
 
-	for {
-		time.Sleep(1 * time.Hour)
+	// Sessions can not outlive the connection they were opened on.
+	defer w.sessions.closeAll()
+
+	// Block until the connection goes away. A silent server is treated the same as a closed connection.
+	monitor := heartbeat.NewMonitor(w.heartbeatConfig)
+	lost := monitor.Run(w.rpcClient.DisconnectNotify(), func(ctx context.Context) error {
+		var resp proto.HeartbeatResp
+		return w.rpcClient.CallWithContext(ctx, proto.Common_Heartbeat, proto.HeartbeatReq{}, &resp)
+	})
+	if lost {
+		w.rpcClient.Close()
+
+		return fmt.Errorf("lost connection to server, last heartbeat at %s", monitor.LastBeat().Format(time.RFC3339))
 	}
+
+	return fmt.Errorf("disconnected from server")
 }
 
 var (
 	_ proto.WorkerService = &Worker{}
 )
 
-func NewWorker(serverAddress string, serverCertificate string, name string) *Worker {
+func NewWorker(serverAddress string, serverCertificate string, name string, workerCertificate string, workerKey string) *Worker {
 	return &Worker{
 		serverCertificate: serverCertificate,
 		serverAddress:     serverAddress,
 		name:              name,
+		workerCertificate: workerCertificate,
+		workerKey:         workerKey,
+		heartbeatConfig:   heartbeat.DefaultConfig,
+		jobs:              newJobStore(defaultJobsDir()),
+		requests:          request.NewTracker(),
+		sessions:          newSessionRegistry(),
 	}
 }